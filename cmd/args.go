@@ -10,7 +10,19 @@ import (
 	lua "github.com/yuin/gopher-lua"
 )
 
-func executeArgs(optExecute string) (string, string, *lua.LTable, error) {
+// includeDirs collects the repeatable -I flag.
+type includeDirs []string
+
+func (d *includeDirs) String() string {
+	return strings.Join(*d, string(os.PathListSeparator))
+}
+
+func (d *includeDirs) Set(dir string) error {
+	*d = append(*d, dir)
+	return nil
+}
+
+func executeArgs(optExecute string, includes []string) (string, string, *lua.LTable, error) {
 
 	// Get executable path
 	exePath, err := getExePath()
@@ -56,11 +68,32 @@ func executeArgs(optExecute string) (string, string, *lua.LTable, error) {
 	// Fix path issues in Windows
 	workDir = filepath.ToSlash(workDir)
 
-	// Get Lua package path
-	packagePath := "package.path='" + workDir + "/?.lua;'..package.path"
+	// Get Lua package path: the script directory, -I directories, LUG_PATH
+	// entries, then the default path
+	paths := []string{workDir + "/?.lua"}
+	for _, dir := range includes {
+		paths = append(paths, searchPath(dir))
+	}
+	for _, dir := range filepath.SplitList(os.Getenv("LUG_PATH")) {
+		if dir != "" {
+			paths = append(paths, searchPath(dir))
+		}
+	}
+	quoted := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(strings.Join(paths, ";"))
+	packagePath := "package.path='" + quoted + ";'..package.path"
 	return scriptPath, packagePath, Largs, nil
 }
 
+// searchPath turns a directory into a package.path template. Entries that
+// already contain a '?' are used as they are.
+func searchPath(dir string) string {
+	dir = filepath.ToSlash(dir)
+	if strings.Contains(dir, "?") {
+		return dir
+	}
+	return strings.TrimSuffix(dir, "/") + "/?.lua"
+}
+
 // getExePath retrieves the path to the executable.
 func getExePath() (string, error) {
 	exePath, err := os.Executable()
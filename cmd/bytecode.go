@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"lug/pkg"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// bytecodeMagic starts every file written by -c, followed by the stamp of
+// the lug and gopher-lua versions the code was compiled for.
+const bytecodeMagic = "\x1bLug"
+
+var (
+	bytecodeStamp = pkg.Version + "/" + lua.PackageVersion
+
+	errBytecodeVersion = errors.New("bytecode was compiled by another lug version")
+	errBytecodeStale   = errors.New("bytecode was compiled from another source")
+)
+
+// compileFile parses and compiles a script without running it.
+func compileFile(path string) ([]ast.Stmt, *lua.FunctionProto, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	chunk, err := parse.Parse(bufio.NewReader(file), path)
+	if err != nil {
+		return nil, nil, err
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chunk, proto, nil
+}
+
+// writeBytecode compiles the script at src and stores it in dst.
+func writeBytecode(src, dst string) error {
+	source, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	chunk, err := parse.Parse(bytes.NewReader(source), src)
+	if err != nil {
+		return err
+	}
+	// The compiler folds constants in place, so the tree is written first.
+	// gopher-lua only builds a runnable prototype in its compiler, so the
+	// syntax tree is stored instead of the prototype: loading skips the
+	// parser and compiles the tree.
+	w := treeWriter{buf: []byte(bytecodeMagic + bytecodeStamp + "\n")}
+	w.string(src)
+	w.string(sourceHash(source))
+	w.stmts(chunk)
+	if w.err != nil {
+		return w.err
+	}
+	// compiling reports the errors the parser lets through
+	if _, err := lua.Compile(chunk, src); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, w.buf, 0644)
+}
+
+// readBytecode loads a file written by writeBytecode. With a source, the
+// file must have been compiled from that very content.
+func readBytecode(path string, source []byte) (*lua.FunctionProto, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	stamp, ok := strings.CutPrefix(strings.TrimSuffix(header, "\n"), bytecodeMagic)
+	if !ok {
+		return nil, fmt.Errorf("%s: not a lug bytecode file", path)
+	}
+	if stamp != bytecodeStamp {
+		return nil, fmt.Errorf("%s: %w", path, errBytecodeVersion)
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	r := treeReader{data: data}
+	name, hash := r.string(), r.string()
+	if r.err != nil {
+		return nil, fmt.Errorf("%s: %w", path, r.err)
+	}
+	if source != nil && hash != sourceHash(source) {
+		return nil, fmt.Errorf("%s: %w", path, errBytecodeStale)
+	}
+	chunk := r.stmts()
+	if r.err == nil && len(r.data) > 0 {
+		r.err = errCorruptTree
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%s: %w", path, r.err)
+	}
+	return lua.Compile(chunk, name)
+}
+
+// isBytecode reports whether path starts with the bytecode magic.
+func isBytecode(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(bytecodeMagic))
+	_, err = io.ReadFull(file, magic)
+	return err == nil && string(magic) == bytecodeMagic
+}
+
+// bytecodeCache returns the .luac file next to a script.
+func bytecodeCache(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".luac"
+}
+
+func sourceHash(source []byte) string {
+	sum := sha256.Sum256(source)
+	return hex.EncodeToString(sum[:])
+}
+
+// executeFile runs a script. Bytecode files are loaded directly, and a source
+// file is replaced by its .luac cache when that was compiled from the same
+// content. Only the main script is looked up this way, modules loaded with
+// require always run from source.
+func executeFile(L *lua.LState, path string) error {
+	var proto *lua.FunctionProto
+	var err error
+
+	if isBytecode(path) {
+		if proto, err = readBytecode(path, nil); err != nil {
+			return err
+		}
+	} else if source, err := os.ReadFile(path); err == nil && isBytecode(bytecodeCache(path)) {
+		// a stale or foreign cache falls back to the source
+		proto, _ = readBytecode(bytecodeCache(path), source)
+	}
+	if proto == nil {
+		return L.DoFile(path)
+	}
+
+	L.Push(L.NewFunctionFromProto(proto))
+	return L.PCall(0, lua.MultRet, nil)
+}
+
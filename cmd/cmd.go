@@ -14,6 +14,7 @@ import (
 func Run() error {
 	var (
 		optExecute     string
+		optCompile     string
 		optLibrary     string
 		optProfile     string
 		optMemoryLimit int
@@ -21,10 +22,13 @@ func Run() error {
 		optVersion     bool
 		optDumpAST     bool
 		optDumpCode    bool
+		optIncludes    includeDirs
 	)
 
 	flag.StringVar(&optExecute, "e", "", "")
+	flag.StringVar(&optCompile, "c", "", "")
 	flag.StringVar(&optLibrary, "l", "", "")
+	flag.Var(&optIncludes, "I", "")
 	flag.IntVar(&optMemoryLimit, "m", 0, "")
 	flag.BoolVar(&optDumpAST, "dt", false, "")
 	flag.BoolVar(&optDumpCode, "dc", false, "")
@@ -36,8 +40,10 @@ func Run() error {
 		fmt.Fprintf(os.Stderr, `Usage: %s [options] [script [args]]
 Available options are:
   -e stat  execute string 'stat'
+  -c file  compile 'script' to bytecode in the file and exit
   -i       enter interactive mode after executing 'script'
   -l name  require library 'name'
+  -I dir   add 'dir' to the module search path (repeatable, also LUG_PATH)
   -m MB    memory limit (default: unlimited)
   -dt      dump AST trees
   -dc      dump VM codes
@@ -65,15 +71,27 @@ Available options are:
 		optInteractive = true
 	}
 
-	scriptPath, packagePath, arg, err := executeArgs(optExecute)
+	scriptPath, packagePath, arg, err := executeArgs(optExecute, optIncludes)
 	if err != nil {
 		return err
 	}
 
+	// Compile script to bytecode without running it
+	if optCompile != "" {
+		if scriptPath == "" {
+			return fmt.Errorf("-c requires a script to compile")
+		}
+		return writeBytecode(scriptPath, optCompile)
+	}
+
 	// Initialize Lua state
 	L := util.VmPool.Get()
 	defer util.VmPool.Put(L)
 
+	// Raise an error in the running script on Ctrl-C instead of dying
+	stopInterrupts := newInterrupter().watch(L)
+	defer stopInterrupts()
+
 	// Set memory limit
 	if optMemoryLimit > 0 {
 		L.SetMx(optMemoryLimit)
@@ -116,8 +134,8 @@ Available options are:
 				return err
 			}
 		} else {
-			// Execute script file
-			if err := L.DoFile(scriptPath); err != nil {
+			// Execute script file, or its bytecode cache
+			if err := executeFile(L, scriptPath); err != nil {
 				return err
 			}
 		}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaCompleter completes global names and, after a '.' or ':', the fields
+// of the table the preceding expression refers to in the live state.
+type luaCompleter struct {
+	L *lua.LState
+}
+
+// Do implements readline.AutoCompleter.
+func (c *luaCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	start := pos
+	for start > 0 && isCompleteRune(line[start-1]) {
+		start--
+	}
+	expr := string(line[start:pos])
+
+	table := c.L.G.Global
+	partial := expr
+	if i := strings.LastIndexAny(expr, ".:"); i >= 0 {
+		partial = expr[i+1:]
+		var ok bool
+		if table, ok = c.resolve(expr[:i]); !ok {
+			return nil, 0
+		}
+	}
+
+	var names []string
+	table.ForEach(func(k, _ lua.LValue) {
+		if key, ok := k.(lua.LString); ok && strings.HasPrefix(string(key), partial) {
+			names = append(names, string(key))
+		}
+	})
+	sort.Strings(names)
+
+	candidates := make([][]rune, len(names))
+	for i, name := range names {
+		candidates[i] = []rune(name[len(partial):])
+	}
+	return candidates, len([]rune(partial))
+}
+
+// resolve looks up a dotted path of table fields starting at the globals.
+func (c *luaCompleter) resolve(path string) (*lua.LTable, bool) {
+	table := c.L.G.Global
+	for _, name := range strings.FieldsFunc(path, func(r rune) bool { return r == '.' || r == ':' }) {
+		next, ok := table.RawGetString(name).(*lua.LTable)
+		if !ok {
+			return nil, false
+		}
+		table = next
+	}
+	return table, true
+}
+
+func isCompleteRune(r rune) bool {
+	return r == '_' || r == '.' || r == ':' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
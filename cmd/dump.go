@@ -2,7 +2,6 @@ package cmd
 
 import (
 	"fmt"
-	"os"
 
 	lua "github.com/yuin/gopher-lua"
 	"github.com/yuin/gopher-lua/parse"
@@ -10,15 +9,8 @@ import (
 
 func executeDump(L *lua.LState, scriptPath string, dumpAST, dumpVM bool) error {
 
-	// Read script content once
-	file, err := os.Open(scriptPath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	// Parse script content
-	chunk, err := parse.Parse(file, scriptPath)
+	// Parse and compile script content
+	chunk, proto, err := compileFile(scriptPath)
 	if err != nil {
 		return err
 	}
@@ -28,12 +20,7 @@ func executeDump(L *lua.LState, scriptPath string, dumpAST, dumpVM bool) error {
 		fmt.Println(parse.Dump(chunk))
 	}
 
-	// Compile and optionally dump VM code
-	proto, err := lua.Compile(chunk, scriptPath)
-	if err != nil {
-		return err
-	}
-
+	// Dump VM code if requested
 	if dumpVM {
 		fmt.Println(proto.String())
 	}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// inspectDepth limits how deep nested tables are expanded.
+const inspectDepth = 8
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true, "until": true,
+	"while": true,
+}
+
+// inspect renders a value for the REPL: strings quoted and tables expanded
+// with sorted keys, one field per line.
+func inspect(v lua.LValue) string {
+	var sb strings.Builder
+	writeValue(&sb, v, 0, map[*lua.LTable]bool{})
+	return sb.String()
+}
+
+func writeValue(sb *strings.Builder, v lua.LValue, depth int, seen map[*lua.LTable]bool) {
+	switch v := v.(type) {
+	case lua.LString:
+		sb.WriteString(strconv.Quote(string(v)))
+	case *lua.LTable:
+		writeTable(sb, v, depth, seen)
+	default:
+		sb.WriteString(v.String())
+	}
+}
+
+func writeTable(sb *strings.Builder, t *lua.LTable, depth int, seen map[*lua.LTable]bool) {
+	switch {
+	case seen[t]:
+		sb.WriteString("<cycle>")
+		return
+	case depth >= inspectDepth:
+		sb.WriteString("{...}")
+		return
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
+	n := t.Len()
+	var keys []lua.LValue
+	t.ForEach(func(k, _ lua.LValue) {
+		if i, ok := k.(lua.LNumber); ok && float64(i) == float64(int(i)) && int(i) >= 1 && int(i) <= n {
+			return
+		}
+		keys = append(keys, k)
+	})
+	if n == 0 && len(keys) == 0 {
+		sb.WriteString("{}")
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ki, kj := keys[i], keys[j]
+		if ki.Type() != kj.Type() {
+			return ki.Type() < kj.Type()
+		}
+		if a, ok := ki.(lua.LNumber); ok {
+			return a < kj.(lua.LNumber)
+		}
+		return ki.String() < kj.String()
+	})
+
+	indent := strings.Repeat("  ", depth+1)
+	sb.WriteString("{\n")
+	for i := 1; i <= n; i++ {
+		sb.WriteString(indent)
+		writeValue(sb, t.RawGetInt(i), depth+1, seen)
+		sb.WriteString(",\n")
+	}
+	for _, k := range keys {
+		sb.WriteString(indent)
+		if s, ok := k.(lua.LString); ok && isIdentifier(string(s)) {
+			sb.WriteString(string(s))
+		} else {
+			sb.WriteByte('[')
+			writeValue(sb, k, depth+1, seen)
+			sb.WriteByte(']')
+		}
+		sb.WriteString(" = ")
+		writeValue(sb, t.RawGet(k), depth+1, seen)
+		sb.WriteString(",\n")
+	}
+	fmt.Fprintf(sb, "%s}", strings.Repeat("  ", depth))
+}
+
+func isIdentifier(s string) bool {
+	if s == "" || luaKeywords[s] {
+		return false
+	}
+	for i, r := range s {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// interrupter is the context of the main Lua state. SIGINT cancels the
+// current round, which makes the VM raise an "interrupted" error at the next
+// instruction. The VM checks Done before every instruction: the first check
+// that sees the round cancelled consumes it, and the one after that starts a
+// new round, so the error is raised once and pcall handlers can still run
+// their cleanup. A second SIGINT before the script noticed the first exits
+// the process. Signals claimed by Go code through util.ClaimInterrupts are
+// left to it.
+//
+// Go functions must not hand the interrupter itself to other code, since
+// their Done calls would consume the round; util.Context returns the round's
+// plain context.Context instead.
+type interrupter struct {
+	mu      sync.Mutex // serializes interrupt
+	round   atomic.Pointer[interruptRound]
+	signals chan os.Signal
+}
+
+// interruptRound is the context between two interrupts. Its ctx is a
+// standard context and, once cancelled, stays cancelled.
+type interruptRound struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	done   <-chan struct{}
+	raised atomic.Bool // the VM saw done closed
+}
+
+func newInterruptRound() *interruptRound {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &interruptRound{ctx: ctx, cancel: cancel, done: ctx.Done()}
+}
+
+func newInterrupter() *interrupter {
+	it := &interrupter{signals: make(chan os.Signal, 1)}
+	it.round.Store(newInterruptRound())
+	return it
+}
+
+// watch installs the SIGINT handler on L until the returned func is called.
+func (it *interrupter) watch(L *lua.LState) func() {
+	L.SetContext(it)
+	signal.Notify(it.signals, os.Interrupt)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-it.signals:
+				it.interrupt()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(it.signals)
+		close(stop)
+		L.RemoveContext()
+	}
+}
+
+func (it *interrupter) interrupt() {
+	if util.InterruptsClaimed() {
+		return
+	}
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	round := it.round.Load()
+	if round.ctx.Err() != nil {
+		if !round.raised.Load() {
+			fmt.Fprintln(os.Stderr, errInterrupted)
+			os.Exit(128 + int(syscall.SIGINT))
+		}
+		// raised, but the VM has not started the next round yet
+		it.round.CompareAndSwap(round, newInterruptRound())
+		round = it.round.Load()
+	}
+	round.cancel(errInterrupted)
+}
+
+// Done is called by the VM before every instruction, so it takes no lock.
+func (it *interrupter) Done() <-chan struct{} {
+	round := it.round.Load()
+	select {
+	case <-round.done:
+	default:
+		return round.done
+	}
+	if round.raised.CompareAndSwap(false, true) {
+		return round.done
+	}
+	it.round.CompareAndSwap(round, newInterruptRound())
+	return it.round.Load().done
+}
+
+// Err reports the current round. The round only changes in Done, so it is
+// never nil right after Done returned a closed channel.
+func (it *interrupter) Err() error {
+	return context.Cause(it.round.Load().ctx)
+}
+
+// Context returns the current round as a standard context, for Go code that
+// must keep observing one interrupt, such as an outgoing request.
+func (it *interrupter) Context() context.Context {
+	return it.round.Load().ctx
+}
+
+func (it *interrupter) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (it *interrupter) Value(key any) any {
+	return nil
+}
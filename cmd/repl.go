@@ -2,16 +2,29 @@ package cmd
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"strings"
 
+	"lug/pkg"
+
 	"github.com/chzyer/readline"
 	lua "github.com/yuin/gopher-lua"
 	"github.com/yuin/gopher-lua/parse"
 )
 
+// historyLimit is the number of lines kept in the history file.
+const historyLimit = 1000
+
 // doREPL implements the Read-Eval-Print Loop (REPL).
 func doREPL(L *lua.LState) error {
-	rl, err := readline.New("> ")
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:       "> ",
+		HistoryFile:  historyFile(),
+		HistoryLimit: historyLimit,
+		AutoComplete: &luaCompleter{L: L},
+	})
 	if err != nil {
 		return err
 	}
@@ -20,19 +33,59 @@ func doREPL(L *lua.LState) error {
 	for {
 		line, err := loadline(rl, L)
 		if err != nil {
-			if err == readline.ErrInterrupt {
+			if err == readline.ErrInterrupt || err == io.EOF {
 				break
 			}
 			fmt.Println(err)
 			continue
 		}
-		if err := L.DoString(line); err != nil {
+		if err := evalLine(L, line); err != nil {
 			fmt.Println(err)
 		}
 	}
 	return nil
 }
 
+// evalLine runs a chunk read by loadline and prints what it returns, so an
+// expression shows its value without an explicit print.
+func evalLine(L *lua.LState, line string) error {
+	fn, err := L.LoadString("return " + line)
+	if err != nil {
+		if fn, err = L.LoadString(line); err != nil {
+			return err
+		}
+	}
+
+	top := L.GetTop()
+	defer L.SetTop(top)
+	L.Push(fn)
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		return err
+	}
+
+	results := make([]string, 0, L.GetTop()-top)
+	for i := top + 1; i <= L.GetTop(); i++ {
+		results = append(results, inspect(L.Get(i)))
+	}
+	if len(results) > 0 {
+		fmt.Println(strings.Join(results, "\t"))
+	}
+	return nil
+}
+
+// historyFile returns the REPL history path, ~/.lug_history unless the
+// LUG_HISTORY environment variable is set. An empty LUG_HISTORY disables it.
+func historyFile() string {
+	if path, ok := os.LookupEnv("LUG_HISTORY"); ok {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, "."+pkg.Name+"_history")
+}
+
 // loadline reads a single line of input and handles multiline fallback.
 func loadline(rl *readline.Instance, L *lua.LState) (string, error) {
 	rl.SetPrompt("> ")
@@ -0,0 +1,535 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/yuin/gopher-lua/ast"
+)
+
+// The syntax tree is written node by node: a tag for the node type, its
+// lines and then its fields in declaration order. Tags are part of the file
+// format, new ones go at the end.
+const (
+	tagNil uint64 = iota
+	tagAssign
+	tagLocalAssign
+	tagFuncCallStmt
+	tagDoBlock
+	tagWhile
+	tagRepeat
+	tagIf
+	tagNumberFor
+	tagGenericFor
+	tagFuncDef
+	tagReturn
+	tagBreak
+	tagLabel
+	tagGoto
+	tagTrue
+	tagFalse
+	tagNilExpr
+	tagNumber
+	tagString
+	tagComma3
+	tagIdent
+	tagAttrGet
+	tagTable
+	tagFuncCall
+	tagLogicalOp
+	tagRelationalOp
+	tagStringConcat
+	tagArithmeticOp
+	tagUnaryMinus
+	tagUnaryNot
+	tagUnaryLen
+	tagFunction
+)
+
+var errCorruptTree = errors.New("corrupt syntax tree")
+
+// treeWriter encodes a syntax tree. The first error sticks.
+type treeWriter struct {
+	buf []byte
+	err error
+}
+
+func (w *treeWriter) uint(n uint64) {
+	w.buf = binary.AppendUvarint(w.buf, n)
+}
+
+func (w *treeWriter) int(n int) {
+	w.buf = binary.AppendVarint(w.buf, int64(n))
+}
+
+func (w *treeWriter) bool(b bool) {
+	if b {
+		w.uint(1)
+	} else {
+		w.uint(0)
+	}
+}
+
+func (w *treeWriter) string(str string) {
+	w.uint(uint64(len(str)))
+	w.buf = append(w.buf, str...)
+}
+
+func (w *treeWriter) strings(strs []string) {
+	w.uint(uint64(len(strs)))
+	for _, str := range strs {
+		w.string(str)
+	}
+}
+
+func (w *treeWriter) node(tag uint64, node ast.PositionHolder) {
+	w.uint(tag)
+	w.int(node.Line())
+	w.int(node.LastLine())
+}
+
+func (w *treeWriter) stmts(stmts []ast.Stmt) {
+	w.uint(uint64(len(stmts)))
+	for _, stmt := range stmts {
+		w.stmt(stmt)
+	}
+}
+
+func (w *treeWriter) stmt(stmt ast.Stmt) {
+	switch s := stmt.(type) {
+	case *ast.AssignStmt:
+		w.node(tagAssign, s)
+		w.exprs(s.Lhs)
+		w.exprs(s.Rhs)
+	case *ast.LocalAssignStmt:
+		w.node(tagLocalAssign, s)
+		w.strings(s.Names)
+		w.exprs(s.Exprs)
+	case *ast.FuncCallStmt:
+		w.node(tagFuncCallStmt, s)
+		w.expr(s.Expr)
+	case *ast.DoBlockStmt:
+		w.node(tagDoBlock, s)
+		w.stmts(s.Stmts)
+	case *ast.WhileStmt:
+		w.node(tagWhile, s)
+		w.expr(s.Condition)
+		w.stmts(s.Stmts)
+	case *ast.RepeatStmt:
+		w.node(tagRepeat, s)
+		w.expr(s.Condition)
+		w.stmts(s.Stmts)
+	case *ast.IfStmt:
+		w.node(tagIf, s)
+		w.expr(s.Condition)
+		w.stmts(s.Then)
+		w.stmts(s.Else)
+	case *ast.NumberForStmt:
+		w.node(tagNumberFor, s)
+		w.string(s.Name)
+		w.expr(s.Init)
+		w.expr(s.Limit)
+		w.expr(s.Step)
+		w.stmts(s.Stmts)
+	case *ast.GenericForStmt:
+		w.node(tagGenericFor, s)
+		w.strings(s.Names)
+		w.exprs(s.Exprs)
+		w.stmts(s.Stmts)
+	case *ast.FuncDefStmt:
+		w.node(tagFuncDef, s)
+		w.expr(s.Name.Func)
+		w.expr(s.Name.Receiver)
+		w.string(s.Name.Method)
+		w.expr(s.Func)
+	case *ast.ReturnStmt:
+		w.node(tagReturn, s)
+		w.exprs(s.Exprs)
+	case *ast.BreakStmt:
+		w.node(tagBreak, s)
+	case *ast.LabelStmt:
+		w.node(tagLabel, s)
+		w.string(s.Name)
+	case *ast.GotoStmt:
+		w.node(tagGoto, s)
+		w.string(s.Label)
+	default:
+		w.err = fmt.Errorf("unsupported statement %T", stmt)
+	}
+}
+
+func (w *treeWriter) exprs(exprs []ast.Expr) {
+	w.uint(uint64(len(exprs)))
+	for _, expr := range exprs {
+		w.expr(expr)
+	}
+}
+
+func (w *treeWriter) expr(expr ast.Expr) {
+	switch e := expr.(type) {
+	case nil:
+		w.uint(tagNil)
+	case *ast.TrueExpr:
+		w.node(tagTrue, e)
+	case *ast.FalseExpr:
+		w.node(tagFalse, e)
+	case *ast.NilExpr:
+		w.node(tagNilExpr, e)
+	case *ast.NumberExpr:
+		w.node(tagNumber, e)
+		w.string(e.Value)
+	case *ast.StringExpr:
+		w.node(tagString, e)
+		w.string(e.Value)
+	case *ast.Comma3Expr:
+		w.node(tagComma3, e)
+		w.bool(e.AdjustRet)
+	case *ast.IdentExpr:
+		w.node(tagIdent, e)
+		w.string(e.Value)
+	case *ast.AttrGetExpr:
+		w.node(tagAttrGet, e)
+		w.expr(e.Object)
+		w.expr(e.Key)
+	case *ast.TableExpr:
+		w.node(tagTable, e)
+		w.uint(uint64(len(e.Fields)))
+		for _, field := range e.Fields {
+			w.expr(field.Key)
+			w.expr(field.Value)
+		}
+	case *ast.FuncCallExpr:
+		w.node(tagFuncCall, e)
+		w.expr(e.Func)
+		w.expr(e.Receiver)
+		w.string(e.Method)
+		w.exprs(e.Args)
+		w.bool(e.AdjustRet)
+	case *ast.LogicalOpExpr:
+		w.node(tagLogicalOp, e)
+		w.string(e.Operator)
+		w.expr(e.Lhs)
+		w.expr(e.Rhs)
+	case *ast.RelationalOpExpr:
+		w.node(tagRelationalOp, e)
+		w.string(e.Operator)
+		w.expr(e.Lhs)
+		w.expr(e.Rhs)
+	case *ast.StringConcatOpExpr:
+		w.node(tagStringConcat, e)
+		w.expr(e.Lhs)
+		w.expr(e.Rhs)
+	case *ast.ArithmeticOpExpr:
+		w.node(tagArithmeticOp, e)
+		w.string(e.Operator)
+		w.expr(e.Lhs)
+		w.expr(e.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		w.node(tagUnaryMinus, e)
+		w.expr(e.Expr)
+	case *ast.UnaryNotOpExpr:
+		w.node(tagUnaryNot, e)
+		w.expr(e.Expr)
+	case *ast.UnaryLenOpExpr:
+		w.node(tagUnaryLen, e)
+		w.expr(e.Expr)
+	case *ast.FunctionExpr:
+		w.node(tagFunction, e)
+		w.bool(e.ParList.HasVargs)
+		w.strings(e.ParList.Names)
+		w.stmts(e.Stmts)
+	default:
+		w.err = fmt.Errorf("unsupported expression %T", expr)
+	}
+}
+
+// treeReader decodes what treeWriter wrote. The first error sticks.
+type treeReader struct {
+	data []byte
+	err  error
+}
+
+func (r *treeReader) uint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	n, size := binary.Uvarint(r.data)
+	if size <= 0 {
+		r.err = errCorruptTree
+		return 0
+	}
+	r.data = r.data[size:]
+	return n
+}
+
+func (r *treeReader) int() int {
+	if r.err != nil {
+		return 0
+	}
+	n, size := binary.Varint(r.data)
+	if size <= 0 {
+		r.err = errCorruptTree
+		return 0
+	}
+	r.data = r.data[size:]
+	return int(n)
+}
+
+func (r *treeReader) bool() bool {
+	return r.uint() != 0
+}
+
+// count reads a length, which cannot exceed the bytes left.
+func (r *treeReader) count() int {
+	n := r.uint()
+	if n > uint64(len(r.data)) {
+		r.err = errCorruptTree
+		return 0
+	}
+	return int(n)
+}
+
+func (r *treeReader) string() string {
+	n := r.count()
+	if r.err != nil {
+		return ""
+	}
+	str := string(r.data[:n])
+	r.data = r.data[n:]
+	return str
+}
+
+func (r *treeReader) strings() []string {
+	n := r.count()
+	if n == 0 {
+		return nil
+	}
+	strs := make([]string, n)
+	for i := range strs {
+		strs[i] = r.string()
+	}
+	return strs
+}
+
+func (r *treeReader) lines(node ast.PositionHolder) {
+	node.SetLine(r.int())
+	node.SetLastLine(r.int())
+}
+
+func (r *treeReader) stmts() []ast.Stmt {
+	n := r.count()
+	if n == 0 {
+		return nil
+	}
+	stmts := make([]ast.Stmt, n)
+	for i := range stmts {
+		stmts[i] = r.stmt()
+	}
+	return stmts
+}
+
+func (r *treeReader) stmt() ast.Stmt {
+	var stmt ast.Stmt
+	switch tag := r.uint(); tag {
+	case tagAssign:
+		s := &ast.AssignStmt{}
+		r.lines(s)
+		s.Lhs, s.Rhs = r.exprs(), r.exprs()
+		stmt = s
+	case tagLocalAssign:
+		s := &ast.LocalAssignStmt{}
+		r.lines(s)
+		s.Names, s.Exprs = r.strings(), r.exprs()
+		stmt = s
+	case tagFuncCallStmt:
+		s := &ast.FuncCallStmt{}
+		r.lines(s)
+		s.Expr = r.expr()
+		stmt = s
+	case tagDoBlock:
+		s := &ast.DoBlockStmt{}
+		r.lines(s)
+		s.Stmts = r.stmts()
+		stmt = s
+	case tagWhile:
+		s := &ast.WhileStmt{}
+		r.lines(s)
+		s.Condition, s.Stmts = r.expr(), r.stmts()
+		stmt = s
+	case tagRepeat:
+		s := &ast.RepeatStmt{}
+		r.lines(s)
+		s.Condition, s.Stmts = r.expr(), r.stmts()
+		stmt = s
+	case tagIf:
+		s := &ast.IfStmt{}
+		r.lines(s)
+		s.Condition, s.Then, s.Else = r.expr(), r.stmts(), r.stmts()
+		stmt = s
+	case tagNumberFor:
+		s := &ast.NumberForStmt{}
+		r.lines(s)
+		s.Name = r.string()
+		s.Init, s.Limit, s.Step = r.expr(), r.expr(), r.expr()
+		s.Stmts = r.stmts()
+		stmt = s
+	case tagGenericFor:
+		s := &ast.GenericForStmt{}
+		r.lines(s)
+		s.Names, s.Exprs, s.Stmts = r.strings(), r.exprs(), r.stmts()
+		stmt = s
+	case tagFuncDef:
+		s := &ast.FuncDefStmt{Name: &ast.FuncName{}}
+		r.lines(s)
+		s.Name.Func, s.Name.Receiver, s.Name.Method = r.expr(), r.expr(), r.string()
+		s.Func, _ = r.expr().(*ast.FunctionExpr)
+		if s.Func == nil && r.err == nil {
+			r.err = errCorruptTree
+		}
+		stmt = s
+	case tagReturn:
+		s := &ast.ReturnStmt{}
+		r.lines(s)
+		s.Exprs = r.exprs()
+		stmt = s
+	case tagBreak:
+		s := &ast.BreakStmt{}
+		r.lines(s)
+		stmt = s
+	case tagLabel:
+		s := &ast.LabelStmt{}
+		r.lines(s)
+		s.Name = r.string()
+		stmt = s
+	case tagGoto:
+		s := &ast.GotoStmt{}
+		r.lines(s)
+		s.Label = r.string()
+		stmt = s
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("unknown statement %d", tag)
+		}
+	}
+	return stmt
+}
+
+func (r *treeReader) exprs() []ast.Expr {
+	n := r.count()
+	if n == 0 {
+		return nil
+	}
+	exprs := make([]ast.Expr, n)
+	for i := range exprs {
+		exprs[i] = r.expr()
+	}
+	return exprs
+}
+
+func (r *treeReader) expr() ast.Expr {
+	var expr ast.Expr
+	switch tag := r.uint(); tag {
+	case tagNil:
+		return nil
+	case tagTrue:
+		e := &ast.TrueExpr{}
+		r.lines(e)
+		expr = e
+	case tagFalse:
+		e := &ast.FalseExpr{}
+		r.lines(e)
+		expr = e
+	case tagNilExpr:
+		e := &ast.NilExpr{}
+		r.lines(e)
+		expr = e
+	case tagNumber:
+		e := &ast.NumberExpr{}
+		r.lines(e)
+		e.Value = r.string()
+		expr = e
+	case tagString:
+		e := &ast.StringExpr{}
+		r.lines(e)
+		e.Value = r.string()
+		expr = e
+	case tagComma3:
+		e := &ast.Comma3Expr{}
+		r.lines(e)
+		e.AdjustRet = r.bool()
+		expr = e
+	case tagIdent:
+		e := &ast.IdentExpr{}
+		r.lines(e)
+		e.Value = r.string()
+		expr = e
+	case tagAttrGet:
+		e := &ast.AttrGetExpr{}
+		r.lines(e)
+		e.Object, e.Key = r.expr(), r.expr()
+		expr = e
+	case tagTable:
+		e := &ast.TableExpr{}
+		r.lines(e)
+		if n := r.count(); n > 0 {
+			e.Fields = make([]*ast.Field, n)
+			for i := range e.Fields {
+				e.Fields[i] = &ast.Field{Key: r.expr(), Value: r.expr()}
+			}
+		}
+		expr = e
+	case tagFuncCall:
+		e := &ast.FuncCallExpr{}
+		r.lines(e)
+		e.Func, e.Receiver, e.Method = r.expr(), r.expr(), r.string()
+		e.Args, e.AdjustRet = r.exprs(), r.bool()
+		expr = e
+	case tagLogicalOp:
+		e := &ast.LogicalOpExpr{}
+		r.lines(e)
+		e.Operator, e.Lhs, e.Rhs = r.string(), r.expr(), r.expr()
+		expr = e
+	case tagRelationalOp:
+		e := &ast.RelationalOpExpr{}
+		r.lines(e)
+		e.Operator, e.Lhs, e.Rhs = r.string(), r.expr(), r.expr()
+		expr = e
+	case tagStringConcat:
+		e := &ast.StringConcatOpExpr{}
+		r.lines(e)
+		e.Lhs, e.Rhs = r.expr(), r.expr()
+		expr = e
+	case tagArithmeticOp:
+		e := &ast.ArithmeticOpExpr{}
+		r.lines(e)
+		e.Operator, e.Lhs, e.Rhs = r.string(), r.expr(), r.expr()
+		expr = e
+	case tagUnaryMinus:
+		e := &ast.UnaryMinusOpExpr{}
+		r.lines(e)
+		e.Expr = r.expr()
+		expr = e
+	case tagUnaryNot:
+		e := &ast.UnaryNotOpExpr{}
+		r.lines(e)
+		e.Expr = r.expr()
+		expr = e
+	case tagUnaryLen:
+		e := &ast.UnaryLenOpExpr{}
+		r.lines(e)
+		e.Expr = r.expr()
+		expr = e
+	case tagFunction:
+		e := &ast.FunctionExpr{ParList: &ast.ParList{}}
+		r.lines(e)
+		e.ParList.HasVargs, e.ParList.Names = r.bool(), r.strings()
+		e.Stmts = r.stmts()
+		expr = e
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("unknown expression %d", tag)
+		}
+	}
+	return expr
+}
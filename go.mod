@@ -4,14 +4,18 @@ go 1.23.4
 
 require (
 	github.com/chzyer/readline v1.5.1
+	github.com/fsnotify/fsnotify v1.8.0
 	github.com/go-sql-driver/mysql v1.9.1
 	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.26
 	github.com/yuin/gopher-lua v1.1.1
+	golang.org/x/net v0.37.0
 	golang.org/x/sync v0.12.0
+	golang.org/x/time v0.11.0
 )
 
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
-	golang.org/x/sys v0.0.0-20220310020820-b874c991c1a5 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
 )
@@ -0,0 +1,97 @@
+package libs
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type Crypto struct{}
+
+func CryptoLoader(L *lua.LState) int {
+	instance := &Crypto{}
+	api := util.SetMethods(L, util.Methods{
+		"md5":    instance.digest("md5"),
+		"sha1":   instance.digest("sha1"),
+		"sha256": instance.digest("sha256"),
+		"sha512": instance.digest("sha512"),
+		"hmac":   instance.hmac,
+		"base64": util.SetMethods(L, util.Methods{
+			"encode": instance.base64Encode,
+			"decode": instance.base64Decode,
+		}),
+		"hex": util.SetMethods(L, util.Methods{
+			"encode": instance.hexEncode,
+			"decode": instance.hexDecode,
+		}),
+	})
+	return util.Push(L, api)
+}
+
+// checkHash returns the constructor of the algorithm named by argument n.
+func checkHash(L *lua.LState, n int, algo string) func() hash.Hash {
+	newHash, ok := util.HashFunc(algo)
+	if !ok {
+		L.ArgError(n, "unsupported hash algorithm: "+algo)
+	}
+	return newHash
+}
+
+// digest returns a function hashing its string argument to a hex digest.
+func (c *Crypto) digest(algo string) lua.LGFunction {
+	newHash, _ := util.HashFunc(algo)
+	return func(L *lua.LState) int {
+		h := newHash()
+		h.Write([]byte(L.CheckString(1)))
+		return util.Push(L, lua.LString(hex.EncodeToString(h.Sum(nil))))
+	}
+}
+
+// hmac returns the hex HMAC of msg: crypto.hmac(algo, key, msg).
+func (c *Crypto) hmac(L *lua.LState) int {
+	newHash := checkHash(L, 1, L.CheckString(1))
+	key, msg := L.CheckString(2), L.CheckString(3)
+	mac := hmac.New(newHash, []byte(key))
+	mac.Write([]byte(msg))
+	return util.Push(L, lua.LString(hex.EncodeToString(mac.Sum(nil))))
+}
+
+// base64Encoding picks the standard alphabet, or the URL safe one without
+// padding when the second argument is true.
+func base64Encoding(L *lua.LState) *base64.Encoding {
+	if L.OptBool(2, false) {
+		return base64.RawURLEncoding
+	}
+	return base64.StdEncoding
+}
+
+func (c *Crypto) base64Encode(L *lua.LState) int {
+	str := L.CheckString(1)
+	return util.Push(L, lua.LString(base64Encoding(L).EncodeToString([]byte(str))))
+}
+
+func (c *Crypto) base64Decode(L *lua.LState) int {
+	str := L.CheckString(1)
+	data, err := base64Encoding(L).DecodeString(str)
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, lua.LString(data))
+}
+
+func (c *Crypto) hexEncode(L *lua.LState) int {
+	return util.Push(L, lua.LString(hex.EncodeToString([]byte(L.CheckString(1)))))
+}
+
+func (c *Crypto) hexDecode(L *lua.LState) int {
+	data, err := hex.DecodeString(L.CheckString(1))
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, lua.LString(data))
+}
@@ -1,20 +1,45 @@
 package libs
 
 import (
+	"bufio"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"lug/util"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 
 	lua "github.com/yuin/gopher-lua"
 )
 
-type Fs struct{}
+type (
+	Fs       struct{}
+	fileLock struct {
+		mu   sync.Mutex
+		refs int
+	}
+)
+
+// per-path write locks, removed again once no writer holds or waits on them
+var (
+	fileLocks   = make(map[string]*fileLock)
+	fileLocksMu sync.Mutex
+)
+
+// registry key of the temporary paths created by tempFile and tempDir. They
+// are kept per Lua state, so concurrent requests never see each other's
+// files, and dropped when a state goes back to util.VmPool.
+const tempPathsKey = "lug.fs.tempPaths"
 
-var fileLocks sync.Map
+func init() {
+	util.ResetOnPut(tempPathsKey)
+}
 
 func FsLoader(L *lua.LState) int {
 	instance := &Fs{}
@@ -25,6 +50,8 @@ func FsLoader(L *lua.LState) int {
 		"move":      instance.moveFile,
 		"remove":    instance.remove,
 		"read":      instance.read,
+		"readLines": instance.readLines,
+		"lines":     instance.lines,
 		"write":     instance.write,
 		"isdir":     instance.isdir,
 		"dirname":   instance.dirname,
@@ -34,13 +61,20 @@ func FsLoader(L *lua.LState) int {
 		"symlink":   instance.symlink,
 		"ext":       instance.ext,
 		"exists":    instance.exists,
+		"stat":      instance.stat,
+		"hash":      instance.hash,
 		"glob":      instance.glob,
+		"walk":      instance.walk,
+		"watch":     instance.watch,
 		"join":      instance.join,
 		"clean":     instance.clean,
 		"abspath":   instance.abspath,
 		"isabs":     instance.isabs,
 		"fromSlash": instance.fromSlash,
 		"toSlash":   instance.toSlash,
+		"tempFile":  instance.tempFile,
+		"tempDir":   instance.tempDir,
+		"cleanup":   instance.cleanup,
 	})
 	return util.Push(L, api)
 }
@@ -139,6 +173,41 @@ func (f *Fs) exists(L *lua.LState) int {
 	return util.Push(L, lua.LBool(!os.IsNotExist(err)))
 }
 
+// stat describes path without following a final symlink.
+func (f *Fs) stat(L *lua.LState) int {
+	info, err := os.Lstat(L.CheckString(1))
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	result := L.CreateTable(0, 6)
+	result.RawSetString("name", lua.LString(info.Name()))
+	result.RawSetString("size", lua.LNumber(info.Size()))
+	result.RawSetString("mode", lua.LString(fmt.Sprintf("%04o", info.Mode().Perm())))
+	result.RawSetString("modTime", lua.LNumber(info.ModTime().Unix()))
+	result.RawSetString("isDir", lua.LBool(info.IsDir()))
+	result.RawSetString("isSymlink", lua.LBool(info.Mode()&os.ModeSymlink != 0))
+	return util.Push(L, result)
+}
+
+// hash streams a file through md5, sha1, sha256 (the default) or sha512 and
+// returns the hex digest.
+func (f *Fs) hash(L *lua.LState) int {
+	path, algo := L.CheckString(1), L.OptString(2, "sha256")
+	newHash := checkHash(L, 2, algo)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	defer file.Close()
+
+	h := newHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, lua.LString(hex.EncodeToString(h.Sum(nil))))
+}
+
 func (f *Fs) read(L *lua.LState) int {
 	path := L.CheckString(1)
 	content, err := os.ReadFile(path)
@@ -148,15 +217,134 @@ func (f *Fs) read(L *lua.LState) int {
 	return util.Push(L, lua.LString(content))
 }
 
+// readLines returns the lines of a file without their line endings.
+func (f *Fs) readLines(L *lua.LState) int {
+	path := L.CheckString(1)
+	maxLine := checkMaxLineSize(L, 2)
+	result := L.NewTable()
+	err := scanLines(path, maxLine, func(line string) bool {
+		result.Append(lua.LString(line))
+		return true
+	})
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, result)
+}
+
+// lines calls fn for every line of a file, reading it line by line. Returning
+// false from fn stops early. The number of lines passed to fn is returned.
+func (f *Fs) lines(L *lua.LState) int {
+	path, fn := L.CheckString(1), L.CheckFunction(2)
+	maxLine := checkMaxLineSize(L, 3)
+	count := 0
+	var callErr error
+	err := scanLines(path, maxLine, func(line string) bool {
+		count++
+		if callErr = L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, lua.LString(line)); callErr != nil {
+			return false
+		}
+		stop := L.Get(-1) == lua.LFalse
+		L.Pop(1)
+		return !stop
+	})
+	if callErr != nil {
+		err = callErr
+	}
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, lua.LNumber(count))
+}
+
+// checkMaxLineSize reads the {maxLineSize = bytes} option, lines longer than
+// it fail the read. The default is 64KB.
+func checkMaxLineSize(L *lua.LState, n int) int {
+	maxLine := bufio.MaxScanTokenSize
+	L.OptTable(n, L.NewTable()).ForEach(func(k, v lua.LValue) {
+		key := k.String()
+		switch key {
+		case "maxLineSize":
+			if val, ok := util.CheckInt(L, key, v, n); ok {
+				if val <= 0 {
+					L.ArgError(n, "maxLineSize must be positive")
+				}
+				maxLine = val
+			}
+		default:
+			L.ArgError(n, "unknown lines field: "+key)
+		}
+	})
+	return maxLine
+}
+
+func scanLines(path string, maxLine int, fn func(line string) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, min(maxLine, 4096)), maxLine)
+	for scanner.Scan() {
+		if !fn(scanner.Text()) {
+			return nil
+		}
+	}
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		return fmt.Errorf("%s: line longer than %d bytes", path, maxLine)
+	}
+	return scanner.Err()
+}
+
+// write stores data at path. It takes either positional append and mode
+// arguments or an options table {append, mode, atomic}. An atomic write goes
+// to a temporary file next to path that is renamed over it once complete, so
+// readers never see a partial file.
 func (f *Fs) write(L *lua.LState) int {
-	path, data, append := L.CheckString(1), L.CheckString(2), L.OptBool(3, false)
+	path, data := L.CheckString(1), L.CheckString(2)
+	append, atomic := false, false
 	mode := os.FileMode(0644)
 
-	if L.GetTop() >= 4 {
-		if m, err := oct2decimal(L.CheckInt(4)); err != nil {
+	if lopt, ok := L.Get(3).(*lua.LTable); ok {
+		var err error
+		lopt.ForEach(func(k, v lua.LValue) {
+			key := k.String()
+			switch key {
+			case "append":
+				if val, ok := util.CheckBool(L, key, v, 3); ok {
+					append = val
+				}
+			case "atomic":
+				if val, ok := util.CheckBool(L, key, v, 3); ok {
+					atomic = val
+				}
+			case "mode":
+				if val, ok := util.CheckInt(L, key, v, 3); ok {
+					var m uint64
+					if m, err = oct2decimal(val); err == nil {
+						mode = os.FileMode(m)
+					}
+				}
+			default:
+				L.ArgError(3, "unknown write field: "+key)
+			}
+		})
+		if err != nil {
 			return util.NilError(L, err)
-		} else {
-			mode = os.FileMode(m)
+		}
+		if append && atomic {
+			L.ArgError(3, "append and atomic cannot be combined")
+		}
+	} else {
+		append = L.OptBool(3, false)
+		if L.GetTop() >= 4 {
+			if m, err := oct2decimal(L.CheckInt(4)); err != nil {
+				return util.NilError(L, err)
+			} else {
+				mode = os.FileMode(m)
+			}
 		}
 	}
 
@@ -164,11 +352,11 @@ func (f *Fs) write(L *lua.LState) int {
 		return util.NilError(L, err)
 	}
 
-	mu, _ := fileLocks.LoadOrStore(path, &sync.Mutex{})
-	mu.(*sync.Mutex).Lock()
-	defer mu.(*sync.Mutex).Unlock()
+	unlock := lockFile(path)
+	defer unlock()
 
-	if append {
+	switch {
+	case append:
 		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode)
 		if err != nil {
 			return util.NilError(L, err)
@@ -178,7 +366,11 @@ func (f *Fs) write(L *lua.LState) int {
 		if _, err := file.WriteString(data); err != nil {
 			return util.NilError(L, err)
 		}
-	} else {
+	case atomic:
+		if err := writeAtomic(path, []byte(data), mode); err != nil {
+			return util.NilError(L, err)
+		}
+	default:
 		if err := os.WriteFile(path, []byte(data), mode); err != nil {
 			return util.NilError(L, err)
 		}
@@ -187,6 +379,57 @@ func (f *Fs) write(L *lua.LState) int {
 	return util.Push(L, lua.LTrue)
 }
 
+func writeAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// lockFile serializes writers of the same path and returns the unlock func.
+func lockFile(path string) func() {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	fileLocksMu.Lock()
+	lock, ok := fileLocks[path]
+	if !ok {
+		lock = &fileLock{}
+		fileLocks[path] = lock
+	}
+	lock.refs++
+	fileLocksMu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+		fileLocksMu.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(fileLocks, path)
+		}
+		fileLocksMu.Unlock()
+	}
+}
+
 func (f *Fs) glob(L *lua.LState) int {
 	pattern := L.CheckString(1)
 
@@ -201,6 +444,37 @@ func (f *Fs) glob(L *lua.LState) int {
 	return util.Push(L, result)
 }
 
+// walk calls fn(path, name, isDir, size) for root and everything below it in
+// lexical order. Returning false for a directory skips its contents.
+func (f *Fs) walk(L *lua.LState) int {
+	root, fn := L.CheckString(1), L.CheckFunction(2)
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		err = L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true},
+			lua.LString(path), lua.LString(d.Name()), lua.LBool(d.IsDir()), lua.LNumber(info.Size()))
+		if err != nil {
+			return err
+		}
+		skip := L.Get(-1) == lua.LFalse
+		L.Pop(1)
+		if skip && d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, lua.LTrue)
+}
+
 func (f *Fs) join(L *lua.LState) int {
 	elems := make([]string, L.GetTop())
 	for i := 1; i <= L.GetTop(); i++ {
@@ -228,41 +502,182 @@ func (f *Fs) isabs(L *lua.LState) int {
 	return util.Push(L, lua.LBool(filepath.IsAbs(path)))
 }
 
+// copyFile copies a file, or a directory tree with {merge, symlinks} options.
+// Copying a directory onto an existing one fails unless merge is set, which
+// overwrites files of the same name. Symlinks are followed unless symlinks is
+// set, in which case they are recreated as links.
 func (f *Fs) copyFile(L *lua.LState) int {
 	src, dest := L.CheckString(1), L.CheckString(2)
+	var cfg copyConfig
+
+	L.OptTable(3, L.NewTable()).ForEach(func(k, v lua.LValue) {
+		key := k.String()
+		switch key {
+		case "merge":
+			if val, ok := util.CheckBool(L, key, v, 3); ok {
+				cfg.merge = val
+			}
+		case "symlinks":
+			if val, ok := util.CheckBool(L, key, v, 3); ok {
+				cfg.symlinks = val
+			}
+		default:
+			L.ArgError(3, "unknown copy field: "+key)
+		}
+	})
 
-	sf, err := os.Open(src)
-	if err != nil {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
 		return util.NilError(L, err)
 	}
-	defer sf.Close()
 
-	si, err := sf.Stat()
+	info, err := os.Stat(src)
 	if err != nil {
 		return util.NilError(L, err)
 	}
-
-	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+	if info.IsDir() {
+		err = copyDir(src, dest, cfg)
+	} else {
+		err = copyRegular(src, dest)
+	}
+	if err != nil {
 		return util.NilError(L, err)
 	}
+	return util.Push(L, lua.LTrue)
+}
+
+type copyConfig struct {
+	merge    bool
+	symlinks bool
+}
+
+// copyDir copies the tree below src into dest.
+func copyDir(src, dest string, cfg copyConfig) error {
+	if _, err := os.Lstat(dest); err == nil && !cfg.merge {
+		return &fs.PathError{Op: "copy", Path: dest, Err: fs.ErrExist}
+	}
+	absSrc, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	absDest, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(absSrc, absDest)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("copy %s: destination is inside the source", dest)
+	}
+	var dirs []dirMode
+	if err := copyTree(src, dest, cfg, map[string]bool{}, &dirs); err != nil {
+		return err
+	}
+	// Directories are created writable and get their modes once the files
+	// are in, deepest first, so read-only trees can be copied.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirMode is the permission a copied directory gets after its content.
+type dirMode struct {
+	path string
+	mode fs.FileMode
+}
+
+// copyTree walks src, following symlinked directories unless links are
+// preserved. visited holds the directories being copied to detect cycles,
+// dirs collects the modes of the created directories in walk order.
+func copyTree(src, dest string, cfg copyConfig, visited map[string]bool, dirs *[]dirMode) error {
+	real, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	if visited[real] {
+		return fmt.Errorf("copy %s: symlink cycle", src)
+	}
+	visited[real] = true
+	defer delete(visited, real)
+
+	// walk the resolved path, WalkDir does not follow a symlinked root
+	return filepath.WalkDir(real, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(real, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if cfg.symlinks {
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				os.Remove(target)
+				return os.Symlink(link, target)
+			}
+			if info, err = os.Stat(path); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return copyTree(path, target, cfg, visited, dirs)
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			*dirs = append(*dirs, dirMode{path: target, mode: info.Mode().Perm()})
+			return nil
+		case info.Mode().IsRegular():
+			return copyRegular(path, target)
+		}
+		return fmt.Errorf("copy %s: unsupported file type %s", path, info.Mode().Type())
+	})
+}
+
+// copyRegular copies the content and mode of the file src to dest.
+func copyRegular(src, dest string) error {
+	sf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+
+	si, err := sf.Stat()
+	if err != nil {
+		return err
+	}
 
 	df, err := os.Create(dest)
 	if err != nil {
-		return util.NilError(L, err)
+		return err
 	}
 	defer df.Close()
 
 	if _, err := io.Copy(df, sf); err != nil {
-		return util.NilError(L, err)
+		return err
 	}
-
-	if err := os.Chmod(dest, si.Mode()); err != nil {
-		return util.NilError(L, err)
+	if err := df.Close(); err != nil {
+		return err
 	}
-
-	return util.Push(L, lua.LTrue)
+	return os.Chmod(dest, si.Mode())
 }
 
+// moveFile renames src to dest. Files and directories are copied and the
+// source removed when dest is on another filesystem, where rename fails with
+// EXDEV.
 func (f *Fs) moveFile(L *lua.LState) int {
 	src, dest := L.CheckString(1), L.CheckString(2)
 
@@ -270,13 +685,39 @@ func (f *Fs) moveFile(L *lua.LState) int {
 		return util.NilError(L, err)
 	}
 
-	if err := os.Rename(src, dest); err != nil {
+	err := os.Rename(src, dest)
+	if errors.Is(err, syscall.EXDEV) {
+		err = moveAcross(src, dest)
+	}
+	if err != nil {
 		return util.NilError(L, err)
 	}
 
 	return util.Push(L, lua.LTrue)
 }
 
+func moveAcross(src, dest string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.IsDir():
+		if err := copyDir(src, dest, copyConfig{symlinks: true}); err != nil {
+			os.RemoveAll(dest)
+			return err
+		}
+		return os.RemoveAll(src)
+	case !info.Mode().IsRegular():
+		return fmt.Errorf("move %s: only files and directories can be moved across filesystems", src)
+	}
+	if err := copyRegular(src, dest); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return os.Remove(src)
+}
+
 func (f *Fs) chmod(L *lua.LState) int {
 	path := L.CheckString(1)
 	mode, err := oct2decimal(L.CheckInt(2))
@@ -299,6 +740,63 @@ func (f *Fs) toSlash(L *lua.LState) int {
 	return util.Push(L, lua.LString(filepath.ToSlash(path)))
 }
 
+// tempFile creates an empty file in dir, the system temp directory by
+// default, and returns its path. A * in prefix marks where the random part
+// goes, otherwise it is appended.
+func (f *Fs) tempFile(L *lua.LState) int {
+	prefix, dir := L.OptString(1, ""), L.OptString(2, "")
+	file, err := os.CreateTemp(dir, prefix)
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	if err := file.Close(); err != nil {
+		return util.NilError(L, err)
+	}
+	trackTemp(L, file.Name())
+	return util.Push(L, lua.LString(file.Name()))
+}
+
+// tempDir is tempFile for directories.
+func (f *Fs) tempDir(L *lua.LState) int {
+	prefix, dir := L.OptString(1, ""), L.OptString(2, "")
+	path, err := os.MkdirTemp(dir, prefix)
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	trackTemp(L, path)
+	return util.Push(L, lua.LString(path))
+}
+
+// cleanup removes every temporary file and directory this Lua state created
+// so far. Other states, such as concurrent requests, keep theirs.
+func (f *Fs) cleanup(L *lua.LState) int {
+	paths := tempPaths(L)
+	L.G.Registry.RawSetString(tempPathsKey, lua.LNil)
+
+	var errs []error
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, lua.LTrue)
+}
+
+func tempPaths(L *lua.LState) []string {
+	if ud, ok := L.G.Registry.RawGetString(tempPathsKey).(*lua.LUserData); ok {
+		return ud.Value.([]string)
+	}
+	return nil
+}
+
+func trackTemp(L *lua.LState, path string) {
+	paths := append(tempPaths(L), path)
+	L.G.Registry.RawSetString(tempPathsKey, &lua.LUserData{Value: paths})
+}
+
 func oct2decimal(oct int) (uint64, error) {
 	return strconv.ParseUint(fmt.Sprintf("%d", oct), 8, 32)
 }
@@ -0,0 +1,81 @@
+package libs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// TestFileLocksDrain writes many unique and a few shared paths from several
+// states at once. Every lock must be dropped again once its writers are done.
+func TestFileLocksDrain(t *testing.T) {
+	dir := t.TempDir()
+	const workers, files = 8, 200
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			L := lua.NewState()
+			defer L.Close()
+			L.PreloadModule("fs", FsLoader)
+			L.SetGlobal("dir", lua.LString(dir))
+			L.SetGlobal("worker", lua.LNumber(w))
+			errs <- L.DoString(fmt.Sprintf(`
+				local fs = require("fs")
+				for i = 1, %d do
+					assert(fs.write(fs.join(dir, worker .. "-" .. i .. ".txt"), "data"))
+					assert(fs.write(fs.join(dir, "shared-" .. i %% 4 .. ".log"), "line\n", true))
+				end
+			`, files))
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fileLocksMu.Lock()
+	left := len(fileLocks)
+	fileLocksMu.Unlock()
+	if left != 0 {
+		t.Fatalf("%d file locks left after all writes finished", left)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := workers*files + 4; len(entries) != want {
+		t.Fatalf("got %d files, want %d", len(entries), want)
+	}
+	shared, err := os.ReadFile(filepath.Join(dir, "shared-0.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := workers * files / 4 * len("line\n"); len(shared) != want {
+		t.Fatalf("shared log has %d bytes, want %d", len(shared), want)
+	}
+}
+
+// TestTempPathsPooled checks that a state put back into the pool forgets the
+// temporary paths of its last user.
+func TestTempPathsPooled(t *testing.T) {
+	vm := util.VmPool.Get()
+	trackTemp(vm, filepath.Join(t.TempDir(), "request.tmp"))
+	util.VmPool.Put(vm)
+	if paths := tempPaths(vm); len(paths) != 0 {
+		t.Fatalf("pooled state still tracks %q", paths)
+	}
+}
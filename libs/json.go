@@ -2,6 +2,7 @@ package libs
 
 import (
 	"encoding/json"
+	"strings"
 
 	"lug/util"
 
@@ -19,15 +20,74 @@ func JsonLoader(L *lua.LState) int {
 	return util.Push(L, api)
 }
 
+// Encode serializes a value. Options: indent, a string or a number of
+// spaces to pretty print with, and emptyArray, to encode empty tables as []
+// instead of {}.
 func (j *Json) Encode(L *lua.LState) int {
-	value := L.CheckAny(1)
-	data, err := json.Marshal(util.ToGoValue(value, true))
+	var indent string
+	var emptyArray bool
+	L.OptTable(2, L.NewTable()).ForEach(func(k, v lua.LValue) {
+		key := k.String()
+		switch key {
+		case "indent":
+			switch val := v.(type) {
+			case lua.LNumber:
+				if val < 0 {
+					L.ArgError(2, "indent must not be negative")
+				}
+				indent = strings.Repeat(" ", int(val))
+			case lua.LString:
+				indent = string(val)
+			default:
+				L.ArgError(2, "indent must be a string or a number")
+			}
+		case "emptyArray":
+			if val, ok := util.CheckBool(L, key, v, 2); ok {
+				emptyArray = val
+			}
+		default:
+			L.ArgError(2, "unknown encode field: "+key)
+		}
+	})
+
+	value, err := util.ToJSONValue(L.CheckAny(1))
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	if emptyArray {
+		value = emptyObjectsToArrays(value)
+	}
+
+	var data []byte
+	if indent != "" {
+		data, err = json.MarshalIndent(value, "", indent)
+	} else {
+		data, err = json.Marshal(value)
+	}
 	if err != nil {
 		return util.NilError(L, err)
 	}
 	return util.Push(L, lua.LString(data))
 }
 
+// emptyObjectsToArrays replaces the empty objects produced for empty tables.
+func emptyObjectsToArrays(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return []interface{}{}
+		}
+		for key, val := range v {
+			v[key] = emptyObjectsToArrays(val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = emptyObjectsToArrays(val)
+		}
+	}
+	return value
+}
+
 func (j *Json) Decode(L *lua.LState) int {
 	str := L.CheckString(1)
 	var goValue interface{}
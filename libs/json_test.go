@@ -0,0 +1,28 @@
+package libs
+
+import (
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestJsonEncodeIndent(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	L.PreloadModule("json", JsonLoader)
+
+	if err := L.DoString(`
+		local json = require("json")
+		assert(json.encode({ a = 1 }, { indent = 2 }) == '{\n  "a": 1\n}')
+		assert(json.encode({ a = 1 }, { indent = "\t" }) == '{\n\t"a": 1\n}')
+		assert(json.encode({ a = 1 }, { indent = 0 }) == '{"a":1}')
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	err := L.DoString(`require("json").encode({}, { indent = -1 })`)
+	if err == nil || !strings.Contains(err.Error(), "indent must not be negative") {
+		t.Fatalf("got %v, want an argument error", err)
+	}
+}
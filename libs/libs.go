@@ -9,11 +9,14 @@ import (
 
 var libPrefix = ""
 var libModules = map[string]lua.LGFunction{
+	"crypto":    CryptoLoader,
 	"fs":        FsLoader,
 	"json":      JsonLoader,
+	"msgpack":   MsgpackLoader,
 	"request":   RequestLoader,
 	"server":    server.Loader,
 	"sql":       sql.Loader,
+	"status":    StatusLoader,
 	"template":  TemplateLoader,
 	"url":       UrlLoader,
 	"utf8":      Uft8Loader,
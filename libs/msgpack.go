@@ -0,0 +1,34 @@
+package libs
+
+import (
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type Msgpack struct{}
+
+func MsgpackLoader(L *lua.LState) int {
+	instance := &Msgpack{}
+	api := util.SetMethods(L, util.Methods{
+		"encode": instance.Encode,
+		"decode": instance.Decode,
+	})
+	return util.Push(L, api)
+}
+
+func (m *Msgpack) Encode(L *lua.LState) int {
+	data, err := util.EncodeMsgpack(L.CheckAny(1))
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, lua.LString(data))
+}
+
+func (m *Msgpack) Decode(L *lua.LState) int {
+	value, err := util.DecodeMsgpack([]byte(L.CheckString(1)))
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, value)
+}
@@ -3,12 +3,16 @@ package libs
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"lug/pkg"
@@ -20,21 +24,36 @@ import (
 type Client struct{ config ClientConfig }
 
 type ClientConfig struct {
-	userAgent   string
-	headers     http.Header
-	proxy       *url.URL
-	basicAuth   map[string]string
-	body        []byte
-	timeout     time.Duration
-	keepAlive   time.Duration
-	maxBodySize int64
+	userAgent     string
+	headers       http.Header
+	proxy         *url.URL
+	basicAuth     map[string]string
+	body          []byte
+	timeout       time.Duration
+	keepAlive     time.Duration
+	maxBodySize   int64
+	retries       int
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration // cap of the backoff and of Retry-After
+	retryStatus   []int
 }
 
 type ClientResponse struct {
-	status   lua.LNumber
-	headers  *lua.LTable
-	body     lua.LString
-	bodySize lua.LNumber
+	status     lua.LNumber
+	headers    *lua.LTable
+	body       lua.LString
+	bodySize   lua.LNumber
+	retryAfter time.Duration
+}
+
+// methods that are safe to send again after a failed attempt
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
 }
 
 func RequestLoader(L *lua.LState) int {
@@ -44,12 +63,20 @@ func RequestLoader(L *lua.LState) int {
 func newRequest(L *lua.LState) int {
 
 	cfg := ClientConfig{
-		userAgent:   pkg.Name + "/" + pkg.Version,
-		headers:     make(http.Header),
-		basicAuth:   make(map[string]string),
-		timeout:     10 * time.Second, // 10S
-		keepAlive:   60 * time.Second, // 60S
-		maxBodySize: 10 * 1024 * 1024, // 10MB
+		userAgent:     pkg.Name + "/" + pkg.Version,
+		headers:       make(http.Header),
+		basicAuth:     make(map[string]string),
+		timeout:       10 * time.Second, // 10S
+		keepAlive:     60 * time.Second, // 60S
+		maxBodySize:   10 * 1024 * 1024, // 10MB
+		retryDelay:    1 * time.Second,  // 1S
+		maxRetryDelay: 30 * time.Second, // 30S
+		retryStatus: []int{
+			http.StatusTooManyRequests,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
 	}
 
 	if L.GetTop() >= 1 {
@@ -82,12 +109,34 @@ func (c *Client) handle(method string) lua.LGFunction {
 			updateClientConfig(L, opts, &cfg)
 		}
 
-		req, err := c.createRequest(method, url, cfg)
-		if err != nil {
-			return util.NilError(L, err)
-		}
+		ctx := util.Context(L)
+
+		var response *ClientResponse
+		var err error
+		for attempt := 0; ; attempt++ {
+			// a fresh request re-reads the body from the start on every attempt
+			var req *http.Request
+			req, err = c.createRequest(ctx, method, url, cfg)
+			if err != nil {
+				return util.NilError(L, err)
+			}
+
+			response, err = c.createResponse(L, req, cfg)
+			if !c.shouldRetry(ctx, method, attempt, response, err, cfg) {
+				break
+			}
 
-		response, err := c.createResponse(L, req, cfg)
+			var retryAfter time.Duration
+			if response != nil {
+				retryAfter = response.retryAfter
+			}
+			if werr := sleepContext(ctx, retryBackoff(cfg, attempt, retryAfter)); werr != nil {
+				if err == nil {
+					err = werr
+				}
+				break
+			}
+		}
 		if err != nil {
 			return util.NilError(L, err)
 		}
@@ -102,8 +151,8 @@ func (c *Client) handle(method string) lua.LGFunction {
 	}
 }
 
-func (c *Client) createRequest(method, url string, cfg ClientConfig) (*http.Request, error) {
-	request, err := http.NewRequest(method, url, bytes.NewReader(cfg.body))
+func (c *Client) createRequest(ctx context.Context, method, url string, cfg ClientConfig) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(cfg.body))
 	if err != nil {
 		return nil, fmt.Errorf("create request failed: %v", err)
 	}
@@ -142,13 +191,14 @@ func (c *Client) createResponse(L *lua.LState, req *http.Request, cfg ClientConf
 
 	res, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %v", err)
+		return nil, fmt.Errorf("request failed: %w", err)
 	}
 	defer res.Body.Close()
 
 	response := &ClientResponse{
-		status:  lua.LNumber(res.StatusCode),
-		headers: L.NewTable(),
+		status:     lua.LNumber(res.StatusCode),
+		headers:    L.NewTable(),
+		retryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
 	}
 
 	for key, values := range res.Header {
@@ -178,6 +228,75 @@ func (c *Client) createResponse(L *lua.LState, req *http.Request, cfg ClientConf
 	return response, nil
 }
 
+// shouldRetry reports whether another attempt should be made after a
+// transient error or a retryable status code.
+func (c *Client) shouldRetry(ctx context.Context, method string, attempt int, res *ClientResponse, err error, cfg ClientConfig) bool {
+	if attempt >= cfg.retries || !idempotentMethods[method] || ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return transientError(err)
+	}
+	status := int(res.status)
+	for _, code := range cfg.retryStatus {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// transientError reports whether err may go away on its own: a timeout, a
+// refused or reset connection, or a response cut short. TLS failures, bad
+// URLs and too many redirects fail the same way every time.
+func transientError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryBackoff doubles retryDelay with every attempt unless the server sent
+// Retry-After, either way the wait is capped at maxRetryDelay.
+func retryBackoff(cfg ClientConfig, attempt int, retryAfter time.Duration) time.Duration {
+	delay := retryAfter
+	if delay <= 0 {
+		delay = cfg.retryDelay
+		for i := 0; i < attempt && delay < cfg.maxRetryDelay; i++ {
+			delay *= 2
+		}
+	}
+	return min(delay, cfg.maxRetryDelay)
+}
+
+// parseRetryAfter accepts both the delay-seconds and HTTP-date forms.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 func updateClientConfig(L *lua.LState, opts *lua.LTable, cfg *ClientConfig) {
 
 	opts.ForEach(func(k lua.LValue, v lua.LValue) {
@@ -231,6 +350,32 @@ func updateClientConfig(L *lua.LState, opts *lua.LTable, cfg *ClientConfig) {
 			if val, ok := util.CheckInt64(L, key, v, 2); ok {
 				cfg.maxBodySize = val
 			}
+
+		case `retries`:
+			if val, ok := util.CheckInt(L, key, v, 2); ok {
+				if val < 0 {
+					L.ArgError(2, "retries must be non-negative")
+				}
+				cfg.retries = val
+			}
+
+		case `retryDelay`:
+			if val, ok := util.CheckDuration(L, key, v, 2); ok {
+				cfg.retryDelay = val
+			}
+
+		case `maxRetryDelay`:
+			if val, ok := util.CheckDuration(L, key, v, 2); ok {
+				if val <= 0 {
+					L.ArgError(2, "maxRetryDelay must be positive")
+				}
+				cfg.maxRetryDelay = val
+			}
+
+		case `retryStatus`:
+			if val, ok := util.CheckIntTable(L, key, v, 2); ok {
+				cfg.retryStatus = val
+			}
 		}
 	})
 }
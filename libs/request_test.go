@@ -0,0 +1,64 @@
+package libs
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	cfg := ClientConfig{retryDelay: time.Second, maxRetryDelay: 30 * time.Second}
+	tests := []struct {
+		attempt    int
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{0, 0, time.Second},
+		{1, 0, 2 * time.Second},
+		{4, 0, 16 * time.Second},
+		{5, 0, 30 * time.Second},
+		{70, 0, 30 * time.Second}, // a plain shift would overflow here
+		{0, 5 * time.Second, 5 * time.Second},
+		{0, 24 * time.Hour, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(cfg, tt.attempt, tt.retryAfter); got != tt.want {
+			t.Errorf("attempt %d, Retry-After %v: got %v, want %v", tt.attempt, tt.retryAfter, got, tt.want)
+		}
+	}
+}
+
+func TestTransientError(t *testing.T) {
+	// net/http wraps what the transport returns in *url.Error
+	wrap := func(err error) error {
+		return &url.Error{Op: "Get", URL: "http://example.com", Err: err}
+	}
+	dialErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"timeout", wrap(&net.DNSError{Err: "i/o timeout", IsTimeout: true}), true},
+		{"refused", wrap(dialErr(syscall.ECONNREFUSED)), true},
+		{"reset", wrap(dialErr(syscall.ECONNRESET)), true},
+		{"cut short", wrap(io.ErrUnexpectedEOF), true},
+		{"tls", wrap(x509.UnknownAuthorityError{}), false},
+		{"scheme", wrap(errors.New("unsupported protocol scheme \"ftp\"")), false},
+		{"redirects", wrap(errors.New("stopped after 10 redirects")), false},
+		{"dns", wrap(&net.DNSError{Err: "no such host", IsNotFound: true}), false},
+	}
+	for _, tt := range tests {
+		if got := transientError(tt.err); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
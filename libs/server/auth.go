@@ -0,0 +1,67 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type basicAuthConfig struct {
+	users map[string]string
+	realm string
+}
+
+var errUnauthorized = errors.New("unauthorized")
+
+// BasicAuth builds a middleware that requires HTTP basic credentials from
+// the users table, for use with app.use. The user name is stored as "user".
+func (s *Server) BasicAuth(L *lua.LState) int {
+	cfg := basicAuthConfig{realm: "Restricted"}
+	lopt := L.CheckTable(1)
+
+	lopt.ForEach(func(k, v lua.LValue) {
+		key := k.String()
+		switch key {
+		case "users":
+			if val, ok := util.CheckTableMap(L, key, v); ok {
+				cfg.users = val
+			}
+		case "realm":
+			if val, ok := util.CheckString(L, key, v); ok {
+				cfg.realm = val
+			}
+		default:
+			L.ArgError(1, "unknown basicAuth field: "+key)
+		}
+	})
+	if len(cfg.users) == 0 {
+		L.ArgError(1, "users must not be empty")
+	}
+
+	challenge := `Basic realm="` + strings.ReplaceAll(cfg.realm, `"`, `\"`) + `", charset="UTF-8"`
+	handler := func(L *lua.LState, ctx *Context) *HttpStatus {
+		user, passwd, ok := ctx.Request.BasicAuth()
+		if !ok || !cfg.check(user, passwd) {
+			ctx.Writer.ResponseWriter.Header().Set("WWW-Authenticate", challenge)
+			return &HttpStatus{Code: http.StatusUnauthorized, Error: errUnauthorized}
+		}
+		ctx.mu.Lock()
+		ctx.data["user"] = lua.LString(user)
+		ctx.mu.Unlock()
+		return ctx.next(L, ctx)
+	}
+	return util.Push(L, &lua.LUserData{Value: Handler(handler)})
+}
+
+// check compares in constant time, unknown users cost as much as a wrong password.
+func (cfg *basicAuthConfig) check(user, passwd string) bool {
+	want, known := cfg.users[user]
+	got, expected := sha256.Sum256([]byte(passwd)), sha256.Sum256([]byte(want))
+	return subtle.ConstantTimeCompare(got[:], expected[:]) == 1 && known
+}
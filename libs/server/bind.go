@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// bindField is one entry of a bind schema such as { age = "integer?" }.
+type bindField struct {
+	name     string
+	kind     string
+	optional bool
+}
+
+var bindKinds = map[string]bool{
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"array":   true,
+	"object":  true,
+	"any":     true,
+}
+
+var errNotObject = errors.New("request body must be a JSON object")
+
+// bind decodes a JSON or form body and validates it against the optional
+// schema. It returns the declared fields and a table of messages keyed by
+// field name, or nil and a message if the body cannot be decoded.
+func (ctx *Context) bind(L *lua.LState) int {
+	fields := checkBindSchema(L, 1)
+	mediaType, _, _ := mime.ParseMediaType(ctx.Request.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		if err := ctx.parseForm(); err != nil {
+			return util.NilError(L, ctx.bodyError(err))
+		}
+		data, errs := bindForm(ctx.Request.PostForm, fields)
+		return pushBound(L, data, errs)
+	case mediaType == "multipart/form-data":
+		if err := ctx.parseMultipartForm(); err != nil {
+			return util.NilError(L, ctx.bodyError(err))
+		}
+		data, errs := bindForm(ctx.Request.MultipartForm.Value, fields)
+		return pushBound(L, data, errs)
+	case mediaType == "", mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+		return ctx.bindBody(L, fields)
+	}
+	return util.NilError(L, fmt.Errorf("unsupported content type: %s", mediaType))
+}
+
+// bindJSON is bind for a JSON body regardless of the Content-Type header.
+func (ctx *Context) bindJSON(L *lua.LState) int {
+	return ctx.bindBody(L, checkBindSchema(L, 1))
+}
+
+func (ctx *Context) bindBody(L *lua.LState, fields []bindField) int {
+	body, err := ctx.readBody()
+	if err != nil {
+		return util.NilError(L, ctx.bodyError(err))
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return util.NilError(L, err)
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return util.NilError(L, errNotObject)
+	}
+	data, errs := bindJSONObject(object, fields)
+	return pushBound(L, data, errs)
+}
+
+func pushBound(L *lua.LState, data map[string]interface{}, errs map[string]string) int {
+	if len(errs) == 0 {
+		return util.Push(L, util.ToLuaValue(data))
+	}
+	errTable := L.CreateTable(0, len(errs))
+	for name, msg := range errs {
+		errTable.RawSetString(name, lua.LString(msg))
+	}
+	return util.Push(L, util.ToLuaValue(data), errTable)
+}
+
+// checkBindSchema reads a schema of field = "type" pairs, a trailing "?"
+// marks the field optional. Without a schema every field is bound as is.
+func checkBindSchema(L *lua.LState, n int) []bindField {
+	if L.Get(n) == lua.LNil {
+		return nil
+	}
+	fields := []bindField{}
+	L.CheckTable(n).ForEach(func(k, v lua.LValue) {
+		name, ok := k.(lua.LString)
+		if !ok {
+			L.ArgError(n, "bind field names must be strings")
+		}
+		spec, ok := v.(lua.LString)
+		if !ok {
+			L.ArgError(n, "bind field "+string(name)+" must be a type name")
+		}
+		kind, optional := strings.CutSuffix(string(spec), "?")
+		if !bindKinds[kind] {
+			L.ArgError(n, "unknown bind type: "+kind)
+		}
+		fields = append(fields, bindField{name: string(name), kind: kind, optional: optional})
+	})
+	return fields
+}
+
+func bindJSONObject(object map[string]interface{}, fields []bindField) (map[string]interface{}, map[string]string) {
+	if fields == nil {
+		return object, nil
+	}
+	data := make(map[string]interface{}, len(fields))
+	errs := map[string]string{}
+	for _, field := range fields {
+		value, ok := object[field.name]
+		if !ok || value == nil {
+			if !field.optional {
+				errs[field.name] = "is required"
+			}
+			continue
+		}
+		if !jsonKindOf(value, field.kind) {
+			errs[field.name] = "must be " + kindArticle(field.kind)
+			continue
+		}
+		data[field.name] = value
+	}
+	return data, errs
+}
+
+func jsonKindOf(value interface{}, kind string) bool {
+	switch v := value.(type) {
+	case string:
+		return kind == "string" || kind == "any"
+	case float64:
+		return kind == "number" || kind == "any" || kind == "integer" && v == math.Trunc(v)
+	case bool:
+		return kind == "boolean" || kind == "any"
+	case []interface{}:
+		return kind == "array" || kind == "any"
+	case map[string]interface{}:
+		return kind == "object" || kind == "any"
+	}
+	return false
+}
+
+// bindForm converts form values to the declared types. Empty values count as
+// missing, arrays take every value of the field and other types the first.
+func bindForm(form url.Values, fields []bindField) (map[string]interface{}, map[string]string) {
+	if fields == nil {
+		data := make(map[string]interface{}, len(form))
+		for name := range form {
+			data[name] = form.Get(name)
+		}
+		return data, nil
+	}
+	data := make(map[string]interface{}, len(fields))
+	errs := map[string]string{}
+	for _, field := range fields {
+		values := form[field.name]
+		if len(values) == 0 || values[0] == "" {
+			if !field.optional {
+				errs[field.name] = "is required"
+			}
+			continue
+		}
+		value, err := formValue(values, field.kind)
+		if err != nil {
+			errs[field.name] = "must be " + kindArticle(field.kind)
+			continue
+		}
+		data[field.name] = value
+	}
+	return data, errs
+}
+
+func formValue(values []string, kind string) (interface{}, error) {
+	switch kind {
+	case "number":
+		return strconv.ParseFloat(values[0], 64)
+	case "integer":
+		return strconv.ParseInt(values[0], 10, 64)
+	case "boolean":
+		return strconv.ParseBool(values[0])
+	case "array":
+		array := make([]interface{}, len(values))
+		for i, value := range values {
+			array[i] = value
+		}
+		return array, nil
+	case "object":
+		return nil, errNotObject
+	}
+	return values[0], nil
+}
+
+func kindArticle(kind string) string {
+	switch kind {
+	case "integer", "array", "object":
+		return "an " + kind
+	}
+	return "a " + kind
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressWriter transparently gzip/deflate encodes a response. The body is
+// buffered until compressMinSize bytes are seen, so small responses and
+// streams that flush early go out untouched.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	minSize     int
+	statusCode  int
+	buf         []byte
+	encoder     io.WriteCloser
+	wroteHeader bool
+	decided     bool
+	hijacked    bool
+}
+
+var (
+	gzipPool = sync.Pool{New: func() interface{} {
+		gz, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+		return gz
+	}}
+	// HTTP "deflate" is the zlib format, not a raw deflate stream
+	zlibPool = sync.Pool{New: func() interface{} {
+		zw, _ := zlib.NewWriterLevel(io.Discard, zlib.DefaultCompression)
+		return zw
+	}}
+)
+
+// content types that are already compressed or must not be buffered
+var incompressibleTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/zstd":             true,
+	"application/x-bzip2":          true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/octet-stream":     true,
+	"application/pdf":              true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+	"text/event-stream":            true,
+}
+
+func newCompressWriter(w http.ResponseWriter, r *http.Request, minSize int) (*compressWriter, bool) {
+	if r.Method == http.MethodHead {
+		return nil, false
+	}
+	encoding := acceptEncoding(r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return nil, false
+	}
+	return &compressWriter{
+		ResponseWriter: w,
+		encoding:       encoding,
+		minSize:        minSize,
+		statusCode:     http.StatusOK,
+	}, true
+}
+
+func (cw *compressWriter) WriteHeader(statusCode int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.statusCode = statusCode
+	// Informational responses are sent straight through.
+	if statusCode < 200 {
+		cw.wroteHeader = false
+		cw.ResponseWriter.WriteHeader(statusCode)
+	}
+}
+
+func (cw *compressWriter) Write(body []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.encoder != nil {
+			return cw.encoder.Write(body)
+		}
+		return cw.ResponseWriter.Write(body)
+	}
+
+	cw.buf = append(cw.buf, body...)
+	if len(cw.buf) < cw.minSize {
+		return len(body), nil
+	}
+	if err := cw.decide(true); err != nil {
+		return 0, err
+	}
+	return len(body), nil
+}
+
+// decide commits the response headers, enabling compression only when the
+// response qualifies, and writes out whatever was buffered so far.
+func (cw *compressWriter) decide(large bool) error {
+	cw.decided = true
+	header := cw.ResponseWriter.Header()
+
+	if cw.compressible() {
+		header.Add("Vary", "Accept-Encoding")
+		if large {
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", cw.encoding)
+			cw.encoder = cw.acquireEncoder()
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.statusCode)
+
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	buf := cw.buf
+	cw.buf = nil
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (cw *compressWriter) compressible() bool {
+	switch cw.statusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	header := cw.ResponseWriter.Header()
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	switch {
+	case incompressibleTypes[mediaType]:
+		return false
+	case mediaType == "image/svg+xml":
+		return true
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"):
+		return false
+	}
+	return true
+}
+
+func (cw *compressWriter) acquireEncoder() io.WriteCloser {
+	if cw.encoding == "gzip" {
+		gz := gzipPool.Get().(*gzip.Writer)
+		gz.Reset(cw.ResponseWriter)
+		return gz
+	}
+	zw := zlibPool.Get().(*zlib.Writer)
+	zw.Reset(cw.ResponseWriter)
+	return zw
+}
+
+// Flush sends buffered data to the client. A response that is flushed before
+// reaching the size threshold is treated as a stream and left uncompressed.
+func (cw *compressWriter) Flush() {
+	if cw.hijacked {
+		return
+	}
+	if !cw.decided {
+		if !cw.wroteHeader {
+			cw.WriteHeader(http.StatusOK)
+		}
+		if err := cw.decide(false); err != nil {
+			return
+		}
+	}
+	switch encoder := cw.encoder.(type) {
+	case *gzip.Writer:
+		encoder.Flush()
+	case *zlib.Writer:
+		encoder.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection doesn't support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		cw.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Close finishes the compressed stream and returns the encoder to its pool.
+func (cw *compressWriter) Close() error {
+	if cw.hijacked {
+		return nil
+	}
+	if !cw.decided {
+		if !cw.wroteHeader {
+			return nil
+		}
+		if len(cw.buf) > 0 {
+			cw.ResponseWriter.Header().Set("Content-Length", strconv.Itoa(len(cw.buf)))
+		}
+		if err := cw.decide(false); err != nil {
+			return err
+		}
+	}
+	if cw.encoder == nil {
+		return nil
+	}
+
+	err := cw.encoder.Close()
+	switch encoder := cw.encoder.(type) {
+	case *gzip.Writer:
+		gzipPool.Put(encoder)
+	case *zlib.Writer:
+		zlibPool.Put(encoder)
+	}
+	cw.encoder = nil
+	return err
+}
+
+// acceptEncoding picks gzip or deflate from an Accept-Encoding header,
+// honouring q=0 exclusions. An empty result means no compression.
+func acceptEncoding(header string) string {
+	accepted := acceptedEncodings(header)
+	switch {
+	case accepted["gzip"]:
+		return "gzip"
+	case accepted["deflate"]:
+		return "deflate"
+	}
+	return ""
+}
+
+// acceptedEncodings lists the codings of an Accept-Encoding header that are
+// not excluded with q=0.
+func acceptedEncodings(header string) map[string]bool {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if val, err := strconv.ParseFloat(q, 64); err == nil && val == 0 {
+				continue
+			}
+		}
+		accepted[name] = true
+	}
+	return accepted
+}
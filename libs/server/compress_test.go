@@ -0,0 +1,54 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestCompressRoundTrip checks that each encoding decodes with the reader a
+// client would use for its Content-Encoding.
+func TestCompressRoundTrip(t *testing.T) {
+	body := strings.Repeat("compress me ", 512)
+	readers := map[string]func(io.Reader) (io.Reader, error){
+		"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	}
+	for encoding, newReader := range readers {
+		t.Run(encoding, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			rec := httptest.NewRecorder()
+			cw, ok := newCompressWriter(rec, req, 1024)
+			if !ok {
+				t.Fatal("compression not negotiated")
+			}
+			cw.Header().Set("Content-Type", "text/plain")
+			if _, err := io.WriteString(cw, body); err != nil {
+				t.Fatal(err)
+			}
+			if err := cw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := rec.Header().Get("Content-Encoding"); got != encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, encoding)
+			}
+			r, err := newReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != body {
+				t.Fatalf("decoded %d bytes, want %d", len(got), len(body))
+			}
+		})
+	}
+}
@@ -1,14 +1,22 @@
 package server
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"io/fs"
 	"lug/util"
+	"mime"
 	"net"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -32,7 +40,15 @@ type (
 		Route         *Route
 		next          Handler
 		startTime     time.Time
+		handlerTime   time.Duration
+		requestID     string
+		config        *ServerConfig
+		server        *Server
+		extend        func(time.Duration) // pushes processingTimeout out, set by ServeHTTP
+		detach        func()              // ends processingTimeout and frees the worker, set by ServeHTTP
 		ErrorTemplate string
+		body          []byte // request body once read by readBody
+		bodyRead      bool
 		mu            sync.RWMutex
 	}
 )
@@ -63,54 +79,94 @@ func (ctx *Context) Reset() {
 	ctx.Params = make(map[string]string)
 	ctx.Route = nil
 	ctx.next = nil
+	ctx.handlerTime = 0
+	ctx.requestID = ""
+	ctx.config = nil
+	ctx.server = nil
+	ctx.extend = nil
+	ctx.detach = nil
+	ctx.body = nil
+	ctx.bodyRead = false
 }
 
 func (ctx *Context) luaContext(L *lua.LState) *lua.LTable {
 	r := ctx.Request
 	api := util.Methods{
-		"params":         ctx.getParams(),
-		"method":         lua.LString(r.Method),
-		"host":           lua.LString(r.Host),
-		"proto":          lua.LString(r.Proto),
-		"path":           lua.LString(r.URL.Path),
-		"rawPath":        lua.LString(r.URL.RawPath),
-		"rawQuery":       lua.LString(r.URL.RawQuery),
-		"requestUri":     lua.LString(r.RequestURI),
-		"remoteAddr":     lua.LString(r.RemoteAddr),
-		"disableCache":   ctx.disableCache,
-		"remoteIP":       ctx.remoteIP,
-		"referer":        ctx.referer,
-		"query":          ctx.getQuery,
-		"port":           ctx.getPort,
-		"userAgent":      ctx.userAgent,
-		"basicAuth":      ctx.basicAuth,
-		"postForm":       ctx.postForm,
-		"body":           ctx.getBody,
-		"scheme":         ctx.getScheme,
-		"getData":        ctx.getData,
-		"setData":        ctx.setData,
-		"delData":        ctx.delData,
-		"getPath":        ctx.getPath,
-		"setPath":        ctx.setPath,
-		"setStatus":      ctx.setStatus,
-		"getHeader":      ctx.getHeader,
-		"setHeader":      ctx.setHeader,
-		"delHeader":      ctx.delHeader,
-		"getCookie":      ctx.getCookie,
-		"getCookies":     ctx.getCookies,
-		"setCookie":      ctx.setCookie,
-		"delCookie":      ctx.delCookie,
-		"since":          ctx.since,
-		"route":          ctx.getRoute,
-		"cors":           ctx.cors,
-		"write":          ctx.write,
-		"flush":          ctx.flush,
-		"redirect":       ctx.redirect,
-		"hijack":         ctx.hijack,
-		"serveFile":      ctx.serveFile,
-		"uploadFile":     ctx.uploadFile,
-		"attachmentFile": ctx.attachmentFile,
-		"error":          ctx.error,
+		"params":           ctx.getParams(),
+		"param":            ctx.param,
+		"paramInt":         ctx.paramInt,
+		"paramNumber":      ctx.paramNumber,
+		"method":           lua.LString(r.Method),
+		"host":             lua.LString(r.Host),
+		"proto":            lua.LString(r.Proto),
+		"path":             lua.LString(r.URL.Path),
+		"rawPath":          lua.LString(r.URL.RawPath),
+		"rawQuery":         lua.LString(r.URL.RawQuery),
+		"requestUri":       lua.LString(r.RequestURI),
+		"remoteAddr":       lua.LString(r.RemoteAddr),
+		"disableCache":     ctx.disableCache,
+		"remoteIP":         ctx.remoteIP,
+		"referer":          ctx.referer,
+		"query":            ctx.getQuery,
+		"queryAll":         ctx.queryAll,
+		"queries":          ctx.queries,
+		"port":             ctx.getPort,
+		"setReadDeadline":  ctx.setReadDeadline,
+		"setWriteDeadline": ctx.setWriteDeadline,
+		"userAgent":        ctx.userAgent,
+		"contentLength":    ctx.contentLength,
+		"contentType":      ctx.contentType,
+		"accepts":          ctx.accepts,
+		"acceptsLanguage":  ctx.acceptsLanguage,
+		"basicAuth":        ctx.basicAuth,
+		"bearer":           ctx.bearer,
+		"tls":              ctx.tlsInfo,
+		"postForm":         ctx.postForm,
+		"formAll":          ctx.formAll,
+		"body":             ctx.getBody,
+		"bodyJSON":         ctx.bodyJSON,
+		"bind":             ctx.bind,
+		"bindJSON":         ctx.bindJSON,
+		"verifySignature":  ctx.verifySignature,
+		"scheme":           ctx.getScheme,
+		"getData":          ctx.getData,
+		"setData":          ctx.setData,
+		"delData":          ctx.delData,
+		"getPath":          ctx.getPath,
+		"setPath":          ctx.setPath,
+		"setStatus":        ctx.setStatus,
+		"getHeader":        ctx.getHeader,
+		"getHeaders":       ctx.getHeaders,
+		"setHeader":        ctx.setHeader,
+		"delHeader":        ctx.delHeader,
+		"getCookie":        ctx.getCookie,
+		"getCookies":       ctx.getCookies,
+		"setCookie":        ctx.setCookie,
+		"delCookie":        ctx.delCookie,
+		"requestId":        ctx.getRequestID,
+		"log":              ctx.logMessage,
+		"since":            ctx.since,
+		"handlerTime":      ctx.getHandlerTime,
+		"route":            ctx.getRoute,
+		"cors":             ctx.cors,
+		"write":            ctx.write,
+		"writeRaw":         ctx.writeRaw,
+		"json":             ctx.json,
+		"render":           ctx.render,
+		"flush":            ctx.flush,
+		"redirect":         ctx.redirect,
+		"hijack":           ctx.hijack,
+		"websocket":        ctx.websocket,
+		"sse":              ctx.sse,
+		"serveFile":        ctx.serveFile,
+		"uploadFile":       ctx.uploadFile,
+		"multipart":        ctx.multipart,
+		"attachmentFile":   ctx.attachmentFile,
+		"isSuccess":        ctx.statusClass(2),
+		"isRedirect":       ctx.statusClass(3),
+		"isClientError":    ctx.statusClass(4),
+		"isServerError":    ctx.statusClass(5),
+		"error":            ctx.error,
 	}
 	return util.SetMethods(L, api)
 }
@@ -123,13 +179,69 @@ func (ctx *Context) getParams() *lua.LTable {
 	return lparams
 }
 
+// param returns a route parameter and whether the route has it.
+func (ctx *Context) param(L *lua.LState) int {
+	value, ok := ctx.Params[L.CheckString(1)]
+	if !ok {
+		return util.Push(L, lua.LNil, lua.LFalse)
+	}
+	return util.Push(L, lua.LString(value), lua.LTrue)
+}
+
+// paramInt parses a route parameter as an integer. A missing or malformed
+// value returns nil and a message, or raises an argument error when the
+// second argument is true.
+func (ctx *Context) paramInt(L *lua.LState) int {
+	return ctx.parseParam(L, func(value string) (lua.LNumber, error) {
+		n, err := strconv.ParseInt(value, 10, 64)
+		return lua.LNumber(n), err
+	})
+}
+
+func (ctx *Context) paramNumber(L *lua.LState) int {
+	return ctx.parseParam(L, func(value string) (lua.LNumber, error) {
+		n, err := strconv.ParseFloat(value, 64)
+		return lua.LNumber(n), err
+	})
+}
+
+func (ctx *Context) parseParam(L *lua.LState, parse func(string) (lua.LNumber, error)) int {
+	name, strict := L.CheckString(1), L.OptBool(2, false)
+	value, ok := ctx.Params[name]
+	var msg string
+	if !ok {
+		msg = "missing route parameter: " + name
+	} else if n, err := parse(value); err == nil {
+		return util.Push(L, n)
+	} else {
+		msg = fmt.Sprintf("invalid route parameter %s: %q", name, value)
+	}
+	if strict {
+		L.ArgError(1, msg)
+	}
+	return util.Push(L, lua.LNil, lua.LString(msg))
+}
+
 func (ctx *Context) since(L *lua.LState) int {
 	return util.Push(L, lua.LNumber(ctx.Since()))
 }
 
 func (ctx *Context) Since() float64 {
-	elapsed := time.Since(ctx.startTime)
-	microseconds := float64(elapsed.Nanoseconds()) / 1000
+	return durationToMillis(time.Since(ctx.startTime))
+}
+
+func (ctx *Context) getHandlerTime(L *lua.LState) int {
+	return util.Push(L, lua.LNumber(ctx.HandlerTime()))
+}
+
+// HandlerTime returns the time spent in the route handler chain in
+// milliseconds, excluding routing and response logging.
+func (ctx *Context) HandlerTime() float64 {
+	return durationToMillis(ctx.handlerTime)
+}
+
+func durationToMillis(d time.Duration) float64 {
+	microseconds := float64(d.Nanoseconds()) / 1000
 	milliseconds := microseconds / 1000
 	return milliseconds
 }
@@ -142,6 +254,29 @@ func (req *Context) userAgent(L *lua.LState) int {
 	return util.Push(L, lua.LString(req.Request.UserAgent()))
 }
 
+// contentLength returns the declared body size, -1 when unknown.
+func (ctx *Context) contentLength(L *lua.LState) int {
+	return util.Push(L, lua.LNumber(ctx.Request.ContentLength))
+}
+
+// contentType returns the declared media type without parameters, and the
+// parameters (such as charset or boundary) as a table.
+func (ctx *Context) contentType(L *lua.LState) int {
+	header := ctx.Request.Header.Get("Content-Type")
+	if header == "" {
+		return util.Push(L, lua.LString(""), L.NewTable())
+	}
+	mediaType, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	lparams := L.NewTable()
+	for k, v := range params {
+		lparams.RawSetString(k, lua.LString(v))
+	}
+	return util.Push(L, lua.LString(mediaType), lparams)
+}
+
 func (ctx *Context) setData(L *lua.LState) int {
 	key, val := L.CheckString(1), L.CheckAny(2)
 	if strings.TrimSpace(key) == "" {
@@ -180,6 +315,20 @@ func (ctx *Context) getHeader(L *lua.LState) int {
 	return util.Push(L, lua.LString(header))
 }
 
+func (ctx *Context) getHeaders(L *lua.LState) int {
+	values := ctx.Request.Header.Values(L.CheckString(1))
+	return util.Push(L, stringsTable(L, values))
+}
+
+// stringsTable converts a list of values into a Lua array.
+func stringsTable(L *lua.LState, values []string) *lua.LTable {
+	lvalues := L.CreateTable(len(values), 0)
+	for _, value := range values {
+		lvalues.Append(lua.LString(value))
+	}
+	return lvalues
+}
+
 func (ctx *Context) getPath(L *lua.LState) int {
 	return util.Push(L, lua.LString(ctx.Request.URL.Path))
 }
@@ -190,6 +339,9 @@ func (ctx *Context) setPath(L *lua.LState) int {
 }
 
 func (ctx *Context) getRoute(L *lua.LState) int {
+	if ctx.Route == nil {
+		return util.Push(L, lua.LNil)
+	}
 	route := util.SetMethods(L, util.Methods{
 		"host":        lua.LString(ctx.Route.host),
 		"pattern":     lua.LString(ctx.Route.pattern),
@@ -206,6 +358,78 @@ func (ctx *Context) getQuery(L *lua.LState) int {
 	return util.Push(L, lua.LString(query))
 }
 
+func (ctx *Context) queryAll(L *lua.LState) int {
+	values := ctx.Request.URL.Query()[L.CheckString(1)]
+	return util.Push(L, stringsTable(L, values))
+}
+
+// queries returns every query parameter as a table of value arrays.
+func (ctx *Context) queries(L *lua.LState) int {
+	query := ctx.Request.URL.Query()
+	lquery := L.CreateTable(0, len(query))
+	for key, values := range query {
+		lquery.RawSetString(key, stringsTable(L, values))
+	}
+	return util.Push(L, lquery)
+}
+
+func (ctx *Context) setReadDeadline(L *lua.LState) int {
+	if err := ctx.SetReadDeadline(seconds(L.CheckNumber(1))); err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, lua.LTrue)
+}
+
+func (ctx *Context) setWriteDeadline(L *lua.LState) int {
+	if err := ctx.SetWriteDeadline(seconds(L.CheckNumber(1))); err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, lua.LTrue)
+}
+
+// SetReadDeadline moves the read deadline of the connection to d from now,
+// so a slow upload can outlast the server readTimeout. Zero removes it.
+func (ctx *Context) SetReadDeadline(d time.Duration) error {
+	ctx.extendProcessing(d)
+	rc := http.NewResponseController(ctx.Writer.ResponseWriter)
+	return rc.SetReadDeadline(deadlineAfter(d))
+}
+
+// SetWriteDeadline moves the write deadline of the connection to d from now,
+// so a long response can outlast the server writeTimeout. Zero removes it.
+func (ctx *Context) SetWriteDeadline(d time.Duration) error {
+	ctx.extendProcessing(d)
+	rc := http.NewResponseController(ctx.Writer.ResponseWriter)
+	return rc.SetWriteDeadline(deadlineAfter(d))
+}
+
+// extendProcessing keeps processingTimeout from firing within d from now, so
+// a raised connection deadline is not cut short by it. It never shortens it.
+func (ctx *Context) extendProcessing(d time.Duration) {
+	if ctx.extend != nil && d > 0 {
+		ctx.extend(d)
+	}
+}
+
+// detachProcessing stops processingTimeout and frees the worker slot of a
+// request whose connection the handler took over.
+func (ctx *Context) detachProcessing() {
+	if ctx.detach != nil {
+		ctx.detach()
+	}
+}
+
+func deadlineAfter(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+func seconds(n lua.LNumber) time.Duration {
+	return time.Duration(float64(n) * float64(time.Second))
+}
+
 func (ctx *Context) getPort(L *lua.LState) int {
 	_, port, err := net.SplitHostPort(ctx.Request.Host)
 	if err != nil {
@@ -225,18 +449,100 @@ func (ctx *Context) basicAuth(L *lua.LState) int {
 }
 
 func (ctx *Context) getBody(L *lua.LState) int {
-	body, err := io.ReadAll(ctx.Request.Body)
+	body, err := ctx.readBody()
 	if err != nil {
+		return util.NilError(L, ctx.bodyError(err))
+	}
+	return util.Push(L, lua.LString(body))
+}
+
+func (ctx *Context) bodyJSON(L *lua.LState) int {
+	body, err := ctx.readBody()
+	if err != nil {
+		return util.NilError(L, ctx.bodyError(err))
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
 		return util.NilError(L, err)
 	}
-	defer ctx.Request.Body.Close()
+	return util.Push(L, util.ToLuaValue(value))
+}
 
-	return util.Push(L, lua.LString(body))
+// readBody reads the whole request body once and keeps it, so the body,
+// bodyJSON and postForm calls of handlers and middlewares can all see it.
+// Request.Body is replaced by a reader over the copy.
+func (ctx *Context) readBody() ([]byte, error) {
+	if ctx.bodyRead {
+		return ctx.body, nil
+	}
+	r := ctx.Request
+	if r.Body == nil || r.Body == http.NoBody {
+		ctx.bodyRead = true
+		return nil, nil
+	}
+	if r.MultipartForm != nil {
+		return nil, errBodyConsumed
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	ctx.body, ctx.bodyRead = body, true
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// verifySignature checks an HMAC of the raw body sent in a header, as used by
+// webhooks: ctx.verifySignature(header, secret, [algo]). The digest may be
+// hex or base64 and prefixed with "algo=", algo defaults to sha256.
+func (ctx *Context) verifySignature(L *lua.LState) int {
+	header, secret := L.CheckString(1), L.CheckString(2)
+	algo := L.OptString(3, "sha256")
+	newHash, ok := util.HashFunc(algo)
+	if !ok {
+		L.ArgError(3, "unsupported hash algorithm: "+algo)
+	}
+
+	signature := strings.TrimSpace(ctx.Request.Header.Get(header))
+	signature = strings.TrimPrefix(signature, algo+"=")
+	if signature == "" {
+		return util.Push(L, lua.LFalse)
+	}
+
+	body, err := ctx.readBody()
+	if err != nil {
+		return util.NilError(L, ctx.bodyError(err))
+	}
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	return util.Push(L, lua.LBool(signatureMatches(signature, mac.Sum(nil))))
+}
+
+func signatureMatches(signature string, expected []byte) bool {
+	if got, err := hex.DecodeString(signature); err == nil && hmac.Equal(got, expected) {
+		return true
+	}
+	got, err := base64.StdEncoding.DecodeString(signature)
+	return err == nil && hmac.Equal(got, expected)
+}
+
+// bodyError answers 413 when reading the body hit a size or form limit.
+func (ctx *Context) bodyError(err error) error {
+	var maxErr *http.MaxBytesError
+	tooLarge := errors.As(err, &maxErr) ||
+		errors.Is(err, errFormTooLarge) ||
+		errors.Is(err, errTooManyFormFields)
+	if tooLarge && ctx.Writer.Written() == nil {
+		ctx.Error(http.StatusRequestEntityTooLarge, err)
+	}
+	return err
 }
 
 func (ctx *Context) postForm(L *lua.LState) int {
-	if err := ctx.Request.ParseForm(); err != nil {
-		return util.NilError(L, err)
+	if err := ctx.parseForm(); err != nil {
+		return util.NilError(L, ctx.bodyError(err))
 	}
 
 	form := make(map[string]string, 0)
@@ -253,21 +559,75 @@ func (ctx *Context) postForm(L *lua.LState) int {
 	return util.Push(L, lform)
 }
 
+func (ctx *Context) formAll(L *lua.LState) int {
+	key := L.CheckString(1)
+	if err := ctx.parseForm(); err != nil {
+		return util.NilError(L, ctx.bodyError(err))
+	}
+	return util.Push(L, stringsTable(L, ctx.Request.PostForm[key]))
+}
+
 func (ctx *Context) remoteIP(L *lua.LState) int {
 	return util.Push(L, lua.LString(ctx.RemoteIP()))
 }
 
+// RemoteIP returns the client address. Forwarding headers are only honoured
+// when the peer is a trusted proxy; X-Forwarded-For is walked right to left
+// and the first hop that is not a trusted proxy is the client.
 func (ctx *Context) RemoteIP() string {
-	if ip := ctx.Request.Header.Get("X-Forwarded-For"); ip != "" {
-		return strings.TrimSpace(strings.Split(ip, ",")[0])
+	peer := addrHost(ctx.Request.RemoteAddr)
+	if !ctx.trustedProxy(peer) {
+		return peer
+	}
+
+	if values := ctx.Request.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		hops := strings.Split(strings.Join(values, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := addrHost(strings.TrimSpace(hops[i]))
+			if hop == "" {
+				continue
+			}
+			if i == 0 || !ctx.trustedProxy(hop) {
+				return hop
+			}
+		}
 	}
 	if ip := ctx.Request.Header.Get("X-Real-IP"); ip != "" {
-		return ip
+		return addrHost(strings.TrimSpace(ip))
+	}
+	return peer
+}
+
+// addrHost reduces an address to its host. It accepts "ip:port", "[ipv6]:port",
+// "[ipv6]" and bare IPs. Unix socket peers carry no address ("@" or empty) and
+// are reported as "unix".
+func addrHost(addr string) string {
+	if addr == "" || addr == "@" {
+		return "unix"
 	}
-	if host, _, err := net.SplitHostPort(ctx.Request.RemoteAddr); err == nil {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
 		return host
 	}
-	return ctx.Request.RemoteAddr
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		return addr[1 : len(addr)-1]
+	}
+	return addr
+}
+
+func (ctx *Context) trustedProxy(addr string) bool {
+	if ctx.config == nil || len(ctx.config.trustedProxies) == 0 {
+		return false
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range ctx.config.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func (ctx *Context) getScheme(L *lua.LState) int {
@@ -309,6 +669,13 @@ func (ctx *Context) SetStatus(statusCode int) error {
 	return nil
 }
 
+// statusClass reports whether the current status code is in the given class.
+func (ctx *Context) statusClass(class int) lua.LGFunction {
+	return func(L *lua.LState) int {
+		return util.Push(L, lua.LBool(util.StatusClass(ctx.Status.Code) == class))
+	}
+}
+
 func (ctx *Context) setHeader(L *lua.LState) int {
 	key, val := L.CheckString(1), L.CheckString(2)
 	ctx.Writer.ResponseWriter.Header().Set(key, val)
@@ -332,6 +699,58 @@ func (ctx *Context) write(L *lua.LState) int {
 	body := []byte(L.CheckString(1))
 	length, err := ctx.Writer.Write(body)
 	if err != nil {
+		// A vanished client is not a handler error, report nothing written.
+		if errors.Is(err, errClientGone) {
+			return util.Push(L, lua.LNumber(0))
+		}
+		return util.Error(L, err)
+	}
+
+	ctx.Status.Length += length
+	return util.Push(L, lua.LNumber(length))
+}
+
+// writeRaw sends data straight to the client and flushes it, so stream
+// chunks are neither copied again nor held back by the compression buffer.
+func (ctx *Context) writeRaw(L *lua.LState) int {
+	length, err := ctx.Writer.WriteString(L.CheckString(1))
+	if err == nil {
+		err = ctx.Writer.Flush()
+	}
+	if err != nil {
+		if errors.Is(err, errClientGone) {
+			return util.Push(L, lua.LNumber(0))
+		}
+		return util.Error(L, err)
+	}
+
+	ctx.Status.Length += length
+	return util.Push(L, lua.LNumber(length))
+}
+
+func (ctx *Context) json(L *lua.LState) int {
+	value, err := util.ToJSONValue(L.CheckAny(1))
+	if err != nil {
+		return util.Error(L, err)
+	}
+	body, err := json.Marshal(value)
+	if err != nil {
+		return util.Error(L, err)
+	}
+
+	ctx.Writer.ResponseWriter.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if L.GetTop() >= 2 {
+		if err := ctx.SetStatus(L.CheckInt(2)); err != nil {
+			return util.Error(L, err)
+		}
+	}
+
+	length, err := ctx.Writer.Write(body)
+	if err != nil {
+		// A vanished client is not a handler error, report nothing written.
+		if errors.Is(err, errClientGone) {
+			return util.Push(L, lua.LNumber(0))
+		}
 		return util.Error(L, err)
 	}
 
@@ -366,6 +785,7 @@ func (ctx *Context) Redirect(url string, codes ...int) error {
 	ctx.Status.Code = statusCode
 	ctx.Status.Text = http.StatusText(statusCode)
 	ctx.Writer.written = true
+	ctx.Writer.sent = true
 
 	http.Redirect(ctx.Writer.ResponseWriter, ctx.Request, url, statusCode)
 	return nil
@@ -391,9 +811,23 @@ func (ctx *Context) error(L *lua.LState) int {
 }
 
 func (ctx *Context) Error(statusCode int, err error) error {
+	// Nobody is listening anymore, only record the status for the log.
+	if ctx.Writer.Disconnected() {
+		ctx.Status.Code = statusCode
+		ctx.Status.Text = http.StatusText(statusCode)
+		ctx.Status.Error = err
+		return nil
+	}
+
+	if ctx.Writer.sent {
+		return errResponseSent
+	}
+
 	if e := ctx.SetStatus(statusCode); e != nil {
 		return e
 	}
+	// Whatever happens below, the body belongs to the error page now.
+	defer func() { ctx.Writer.sent = true }()
 
 	if statusCode < 400 || statusCode > 599 {
 		return errors.New("invalid error status code (range 400–599)")
@@ -405,9 +839,12 @@ func (ctx *Context) Error(statusCode int, err error) error {
 	var tplErr error
 
 	if ctx.ErrorTemplate == "" {
-		tpl, tplErr = util.ParseTemplateString(errorTemplate, "LUG_TPL_ERRORPAGE")
+		tpl, tplErr = ctx.templates().ParseString(errorTemplate, "LUG_TPL_ERRORPAGE")
 	} else {
-		tpl, tplErr = util.ParseTemplateFiles(ctx.ErrorTemplate)
+		tpl, tplErr = ctx.templates().ParseFiles(ctx.ErrorTemplate)
+	}
+	if tplErr == nil {
+		tpl, tplErr = ctx.templateInstance(nil, tpl)
 	}
 
 	if tplErr != nil {
@@ -421,7 +858,10 @@ func (ctx *Context) Error(statusCode int, err error) error {
 		Error: err,
 	}
 
-	if execErr := tpl.Execute(ctx.Writer.ResponseWriter, status); execErr != nil {
+	if execErr := tpl.Execute(&ctx.Writer, status); execErr != nil {
+		if ctx.Writer.Disconnected() || ctx.Writer.TimedOut() {
+			return nil
+		}
 		http.Error(ctx.Writer.ResponseWriter, ctx.Status.Text, statusCode)
 		return execErr
 	}
@@ -434,7 +874,49 @@ func (ctx *Context) getCookie(L *lua.LState) int {
 	if err != nil {
 		return util.NilError(L, err)
 	}
-	return util.Push(L, transformCookie(L, cookie))
+
+	var signed, encrypted bool
+	lopt := L.OptTable(2, L.NewTable())
+	lopt.ForEach(func(key, v lua.LValue) {
+		k := key.String()
+		switch k {
+		case `signed`:
+			if val, ok := util.CheckBool(L, k, v); ok {
+				signed = val
+			}
+		case `encrypted`:
+			if val, ok := util.CheckBool(L, k, v); ok {
+				encrypted = val
+			}
+		default:
+			L.ArgError(2, "unknown cookie field: "+k)
+		}
+	})
+
+	if !signed && !encrypted {
+		return util.Push(L, transformCookie(L, cookie))
+	}
+
+	secret := ctx.cookieSecret()
+	if secret == "" {
+		return util.NilError(L, errCookieSecret)
+	}
+
+	// A tampered cookie keeps its metadata but loses its value.
+	var valid bool
+	if encrypted {
+		cookie.Value, valid = decryptCookieValue(secret, cookie.Name, cookie.Value)
+	} else {
+		cookie.Value, valid = verifyCookieValue(secret, cookie.Name, cookie.Value)
+	}
+	return util.Push(L, transformCookie(L, cookie), lua.LBool(!valid))
+}
+
+func (ctx *Context) cookieSecret() string {
+	if ctx.config == nil {
+		return ""
+	}
+	return ctx.config.cookieSecret
 }
 
 func (ctx *Context) getCookies(L *lua.LState) int {
@@ -449,6 +931,7 @@ func (ctx *Context) getCookies(L *lua.LState) int {
 func (ctx *Context) setCookie(L *lua.LState) int {
 	opts := L.CheckTable(1)
 	cookie := &http.Cookie{}
+	var signed, encrypted bool
 	opts.ForEach(func(key, v lua.LValue) {
 		k := key.String()
 		switch k {
@@ -490,12 +973,36 @@ func (ctx *Context) setCookie(L *lua.LState) int {
 				L.ArgError(1, err.Error())
 			}
 			cookie.SameSite = sameSite
+		case `signed`:
+			if val, ok := util.CheckBool(L, k, v); ok {
+				signed = val
+			}
+		case `encrypted`:
+			if val, ok := util.CheckBool(L, k, v); ok {
+				encrypted = val
+			}
 
 		default:
 			L.ArgError(1, "unknown cookie field: "+k)
 		}
 	})
 
+	if signed || encrypted {
+		secret := ctx.cookieSecret()
+		if secret == "" {
+			return util.Error(L, errCookieSecret)
+		}
+		if encrypted {
+			value, err := encryptCookieValue(secret, cookie.Name, cookie.Value)
+			if err != nil {
+				return util.Error(L, err)
+			}
+			cookie.Value = value
+		} else {
+			cookie.Value = signCookieValue(secret, cookie.Name, cookie.Value)
+		}
+	}
+
 	http.SetCookie(ctx.Writer.ResponseWriter, cookie)
 	return 0
 }
@@ -602,25 +1109,7 @@ func (ctx *Context) serveFile(L *lua.LState) int {
 	cfg := defaultFileConfig
 
 	lopt.ForEach(func(k, v lua.LValue) {
-		key := k.String()
-		switch key {
-		case "ignoreBase":
-			if val, ok := util.CheckBool(L, key, v); ok {
-				cfg.ignoreBase = val
-			}
-		case "autoIndex":
-			if val, ok := util.CheckBool(L, key, v); ok {
-				cfg.autoIndex = val
-			}
-		case "index":
-			if val, ok := util.CheckTable(L, key, v); ok {
-				cfg.index = val
-			}
-		case "prettyIndex":
-			if val, ok := util.CheckBool(L, key, v); ok {
-				cfg.prettyIndex = val
-			}
-		}
+		setFileConfig(L, &cfg, k.String(), v, 2)
 	})
 
 	fileinfo, status := ctx.ServeFile(filePath, &cfg)
@@ -666,6 +1155,9 @@ func (ctx *Context) ServeFile(filePath string, cfg *FileConfig) (*FileInfo, Http
 	}
 
 	ctx.Status.Length = status.Length
+	ctx.Status.Code = status.Code
+	ctx.Status.Text = http.StatusText(status.Code)
+	ctx.Writer.written = true
 	return info, status
 }
 
@@ -776,19 +1268,101 @@ func (ctx *Context) AttachmentFile(filePath, fileName string) (*FileInfo, HttpSt
 
 	ctx.Status.Length = status.Length
 	ctx.Status.Code = status.Code
+	ctx.Status.Text = http.StatusText(status.Code)
+	ctx.Writer.written = true
 
 	return fileinfo, status
 }
 
+// uploadFile(field, dst, [mode | {mode, maxSize, extensions, types}])
 func (ctx *Context) uploadFile(L *lua.LState) int {
 	fieldName, dst := L.CheckString(1), L.CheckString(2)
-	mode := fs.FileMode(L.OptInt(3, 0o750))
-	if err := ctx.UploadFile(fieldName, dst, mode); err != nil {
-		return util.Error(L, err)
+	cfg := defaultUploadConfig
+	cfg.Mode = 0o750
+
+	switch v := L.Get(3).(type) {
+	case lua.LNumber:
+		cfg.Mode = fs.FileMode(v)
+	case *lua.LTable:
+		v.ForEach(func(k, v lua.LValue) {
+			key := k.String()
+			switch key {
+			case "mode":
+				if val, ok := util.CheckInt(L, key, v, 3); ok {
+					cfg.Mode = fs.FileMode(val)
+				}
+			case "maxSize":
+				if val, ok := util.CheckInt64(L, key, v, 3); ok {
+					cfg.MaxSize = val
+				}
+			case "extensions":
+				if val, ok := util.CheckTable(L, key, v, 3); ok {
+					cfg.Extensions = val
+				}
+			case "types":
+				if val, ok := util.CheckTable(L, key, v, 3); ok {
+					cfg.Types = val
+				}
+			default:
+				L.ArgError(3, "unknown upload field: "+key)
+			}
+		})
+	case *lua.LNilType:
+	default:
+		L.ArgError(3, "must be a file mode or an options table")
 	}
-	return 0
+
+	files, err := ctx.UploadFile(fieldName, dst, &cfg)
+	if err != nil {
+		return util.NilError(L, err)
+	}
+
+	list := L.NewTable()
+	for _, file := range files {
+		list.Append(util.SetMethods(L, util.Methods{
+			"path":        file.Path,
+			"filename":    file.Filename,
+			"size":        file.Size,
+			"contentType": file.ContentType,
+		}))
+	}
+	return util.Push(L, list)
 }
 
-func (ctx *Context) UploadFile(fieldName, dst string, modes ...fs.FileMode) error {
-	return uploadFile(ctx.Request, fieldName, dst, modes...)
+// multipart returns the value fields and the file metadata of a multipart
+// body without saving anything, so a handler can check an upload first.
+func (ctx *Context) multipart(L *lua.LState) int {
+	if err := ctx.parseMultipartForm(); err != nil {
+		return util.NilError(L, ctx.bodyError(err))
+	}
+	form := ctx.Request.MultipartForm
+
+	lfields := L.CreateTable(0, len(form.Value))
+	for key, values := range form.Value {
+		lfields.RawSetString(key, stringsTable(L, values))
+	}
+	lfiles := L.CreateTable(0, len(form.File))
+	for key, headers := range form.File {
+		list := L.CreateTable(len(headers), 0)
+		for _, fh := range headers {
+			list.Append(util.SetMethods(L, util.Methods{
+				"filename":    fh.Filename,
+				"size":        fh.Size,
+				"contentType": fh.Header.Get("Content-Type"),
+			}))
+		}
+		lfiles.RawSetString(key, list)
+	}
+	return util.Push(L, util.SetMethods(L, util.Methods{
+		"fields": lfields,
+		"files":  lfiles,
+	}))
+}
+
+func (ctx *Context) UploadFile(fieldName, dst string, cfg *UploadConfig) ([]UploadedFile, error) {
+	if err := ctx.parseMultipartForm(); err != nil {
+		return nil, ctx.bodyError(err)
+	}
+	files, err := uploadFile(ctx.Request, fieldName, dst, cfg)
+	return files, ctx.bodyError(err)
 }
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestRemoteIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "fd00::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"ipv4", "192.0.2.1:5000", nil, "192.0.2.1"},
+		{"ipv6", "[2001:db8::1]:5000", nil, "2001:db8::1"},
+		{"ipv6 zone", "[fe80::1%eth0]:5000", nil, "fe80::1%eth0"},
+		{"unix abstract", "@", nil, "unix"},
+		{"unix unnamed", "", nil, "unix"},
+		{"untrusted peer", "192.0.2.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "192.0.2.1"},
+		{"unix ignores headers", "@", map[string]string{"X-Real-IP": "198.51.100.7"}, "unix"},
+		{"trusted ipv4 proxy", "10.1.2.3:5000", map[string]string{"X-Forwarded-For": "198.51.100.7, 10.9.9.9"}, "198.51.100.7"},
+		{"trusted ipv6 proxy", "[fd00::1]:5000", map[string]string{"X-Forwarded-For": "[2001:db8::7]:4711"}, "2001:db8::7"},
+		{"real ip", "10.1.2.3:5000", map[string]string{"X-Real-IP": " 2001:db8::9 "}, "2001:db8::9"},
+		{"only proxies", "10.1.2.3:5000", map[string]string{"X-Forwarded-For": "10.5.5.5"}, "10.5.5.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			ctx := newContext(httptest.NewRecorder(), r)
+			defer ctx.Release()
+			ctx.config = &ServerConfig{trustedProxies: proxies}
+			if got := ctx.RemoteIP(); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetPort(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	tests := []struct {
+		host string
+		tls  bool
+		want string
+	}{
+		{"example.com:8080", false, "8080"},
+		{"127.0.0.1:3000", false, "3000"},
+		{"[::1]:9000", false, "9000"},
+		{"example.com", false, "80"},
+		{"example.com", true, "443"},
+		{"[::1]", false, "80"},
+		{"unix", false, "80"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = tt.host
+		if tt.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		ctx := newContext(httptest.NewRecorder(), r)
+		if err := L.CallByParam(lua.P{Fn: L.NewFunction(ctx.getPort), NRet: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if got := L.Get(-1).String(); got != tt.want {
+			t.Errorf("host %q (tls %v): got port %q, want %q", tt.host, tt.tls, got, tt.want)
+		}
+		L.Pop(1)
+		ctx.Release()
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+var errCookieSecret = errors.New("cookieSecret is not configured on the server")
+
+// signCookieValue appends an HMAC-SHA256 of the cookie name and value.
+// The name is part of the MAC so a signed value cannot be moved to another cookie.
+func signCookieValue(secret, name, value string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(value))
+	return payload + "." + cookieMAC(secret, name, payload)
+}
+
+// verifyCookieValue returns the original value and whether the signature matched.
+func verifyCookieValue(secret, name, signed string) (string, bool) {
+	payload, mac, ok := strings.Cut(signed, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(cookieMAC(secret, name, payload))) {
+		return "", false
+	}
+	value, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
+
+func cookieMAC(secret, name, payload string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(name + "|" + payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// encryptCookieValue seals the value with AES-256-GCM keyed by sha256(secret).
+func encryptCookieValue(secret, name, value string) (string, error) {
+	gcm, err := cookieCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decryptCookieValue opens an encrypted value, reporting false if it was altered.
+func decryptCookieValue(secret, name, encrypted string) (string, bool) {
+	gcm, err := cookieCipher(secret)
+	if err != nil {
+		return "", false
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", false
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	value, err := gcm.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
+
+func cookieCipher(secret string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
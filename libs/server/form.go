@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+)
+
+var (
+	errFormTooLarge      = errors.New("form exceeds maxFormSize")
+	errTooManyFormFields = errors.New("form exceeds maxFormFields")
+	errBodyConsumed      = errors.New("request body was consumed by multipart parsing")
+)
+
+// parseForm parses an url-encoded body within the maxFormSize and
+// maxFormFields limits before the values are expanded into maps.
+func (ctx *Context) parseForm() error {
+	r := ctx.Request
+	if r.PostForm != nil {
+		return nil
+	}
+	maxSize, maxFields := ctx.formLimits()
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" && r.Body != nil {
+		body := ctx.body
+		if !ctx.bodyRead {
+			reader := io.Reader(r.Body)
+			if maxSize > 0 {
+				reader = io.LimitReader(r.Body, maxSize+1)
+			}
+			var err error
+			if body, err = io.ReadAll(reader); err != nil {
+				return err
+			}
+		}
+		if maxSize > 0 && int64(len(body)) > maxSize {
+			return errFormTooLarge
+		}
+		if maxFields > 0 && countFormFields(body) > maxFields {
+			return errTooManyFormFields
+		}
+		// keep the body for body() and bodyJSON, ParseForm consumes the reader
+		ctx.body, ctx.bodyRead = body, true
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return r.ParseForm()
+}
+
+// parseMultipartForm parses a multipart body. The non-file values are held
+// to the limits while the body streams in, so an oversized form is cut off
+// before the rest of it is spooled to disk. Unlike other bodies, multipart
+// uploads are streamed and not kept for body(), unless that was called first.
+func (ctx *Context) parseMultipartForm() error {
+	r := ctx.Request
+	if r.MultipartForm != nil {
+		return nil
+	}
+	maxSize, maxFields := ctx.formLimits()
+	_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Body == nil || params["boundary"] == "" || maxSize <= 0 && maxFields <= 0 {
+		return r.ParseMultipartForm(defaultMultipartMemory)
+	}
+
+	limits := newFormLimitReader(r.Body, params["boundary"], maxSize, maxFields)
+	r.Body = limits
+	err := r.ParseMultipartForm(defaultMultipartMemory)
+	if limitErr := limits.wait(); limitErr != nil {
+		if r.MultipartForm != nil {
+			r.MultipartForm.RemoveAll()
+			r.MultipartForm = nil
+		}
+		return limitErr
+	}
+	return err
+}
+
+// formLimitReader tees a multipart body into a second multipart reader that
+// counts the parts and value bytes. Once a limit is exceeded the tee fails,
+// which aborts the parse reading from it.
+type formLimitReader struct {
+	io.Reader
+	body io.Closer
+	pipe *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+func newFormLimitReader(body io.ReadCloser, boundary string, maxSize int64, maxFields int) *formLimitReader {
+	pr, pw := io.Pipe()
+	l := &formLimitReader{
+		Reader: io.TeeReader(body, pw),
+		body:   body,
+		pipe:   pw,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(l.done)
+		if l.err = checkFormParts(multipart.NewReader(pr, boundary), maxSize, maxFields); l.err != nil {
+			pr.CloseWithError(l.err)
+			return
+		}
+		// keep accepting the epilogue the parser may still read ahead
+		io.Copy(io.Discard, pr)
+	}()
+	return l
+}
+
+func (l *formLimitReader) Close() error {
+	return l.body.Close()
+}
+
+// wait ends the check once the parse is done and returns the limit it hit.
+func (l *formLimitReader) wait() error {
+	l.pipe.Close()
+	<-l.done
+	return l.err
+}
+
+// checkFormParts counts named parts against maxFields and the names and
+// values of non-file parts against maxSize. Malformed bodies are left to the
+// parser to report.
+func checkFormParts(mr *multipart.Reader, maxSize int64, maxFields int) error {
+	var size int64
+	fields := 0
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return nil
+		}
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+		if fields++; maxFields > 0 && fields > maxFields {
+			return errTooManyFormFields
+		}
+		if part.FileName() != "" {
+			if _, err := io.Copy(io.Discard, part); err != nil {
+				return nil
+			}
+			continue
+		}
+		size += int64(len(name))
+		reader := io.Reader(part)
+		if maxSize > 0 {
+			reader = io.LimitReader(part, maxSize-size+1)
+		}
+		n, err := io.Copy(io.Discard, reader)
+		if size += n; maxSize > 0 && size > maxSize {
+			return errFormTooLarge
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// formLimits returns maxFormSize (10 MB by default) and maxFormFields (1000
+// by default); zero disables a limit.
+func (ctx *Context) formLimits() (int64, int) {
+	if ctx.config == nil {
+		return 0, 0
+	}
+	return ctx.config.maxFormSize, ctx.config.maxFormFields
+}
+
+func countFormFields(body []byte) int {
+	n := 0
+	for _, pair := range bytes.Split(body, []byte("&")) {
+		if len(pair) > 0 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// countingReader records how much of the body the parser consumed.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// multipartBody writes the values in order, then a file of fileSize bytes.
+func multipartBody(t *testing.T, values [][2]string, fileSize int) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, kv := range values {
+		if err := mw.WriteField(kv[0], kv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file, err := mw.CreateFormFile("upload", "data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(bytes.Repeat([]byte("x"), fileSize))
+	mw.Close()
+	return &body, mw.FormDataContentType()
+}
+
+func TestMultipartFormLimits(t *testing.T) {
+	const fileSize = 4 << 20
+	tests := []struct {
+		name      string
+		values    [][2]string
+		maxSize   int64
+		maxFields int
+		err       error
+	}{
+		{"within limits", [][2]string{{"a", "1"}, {"b", "2"}}, 64, 3, nil},
+		{"too many fields", [][2]string{{"a", "1"}, {"b", "2"}, {"c", "3"}}, 64, 2, errTooManyFormFields},
+		{"value too large", [][2]string{{"a", strings.Repeat("v", 100)}}, 64, 10, errFormTooLarge},
+		{"names count", [][2]string{{strings.Repeat("n", 40), strings.Repeat("v", 30)}}, 64, 10, errFormTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := multipartBody(t, tt.values, fileSize)
+			total := int64(body.Len())
+			counter := &countingReader{Reader: body}
+			r := httptest.NewRequest(http.MethodPost, "/", counter)
+			r.Header.Set("Content-Type", contentType)
+			ctx := newContext(httptest.NewRecorder(), r)
+			defer ctx.Release()
+			ctx.config = &ServerConfig{maxFormSize: tt.maxSize, maxFormFields: tt.maxFields}
+
+			err := ctx.parseMultipartForm()
+			if tt.err == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := r.MultipartForm.Value["a"]; len(got) != 1 || got[0] != "1" {
+					t.Fatalf("got values %v", r.MultipartForm.Value)
+				}
+				if files := r.MultipartForm.File["upload"]; len(files) != 1 || files[0].Size != fileSize {
+					t.Fatalf("upload missing or truncated: %v", files)
+				}
+				r.MultipartForm.RemoveAll()
+				return
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if r.MultipartForm != nil {
+				t.Fatal("a rejected form must not stay parsed")
+			}
+			if counter.n >= total/2 {
+				t.Fatalf("read %d of %d bytes, the limit was enforced too late", counter.n, total)
+			}
+		})
+	}
+}
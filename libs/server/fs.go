@@ -13,7 +13,10 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -25,10 +28,21 @@ type (
 		r      *http.Request
 	}
 	FileConfig struct {
-		ignoreBase  bool
-		autoIndex   bool
-		index       []string
-		prettyIndex bool
+		ignoreBase    bool
+		autoIndex     bool
+		index         []string
+		prettyIndex   bool
+		maxAge        time.Duration
+		immutable     bool
+		cacheControl  string // sent verbatim, overrides maxAge and immutable
+		precompressed bool   // serve file.br / file.gz siblings to clients accepting them
+	}
+	// statusRecorder captures what http.ServeContent actually sent, which
+	// differs from the file size for HEAD, Range and conditional requests
+	statusRecorder struct {
+		http.ResponseWriter
+		code   int
+		length int
 	}
 	FileInfo struct {
 		Size    int
@@ -44,10 +58,11 @@ const defaultMultipartMemory = 32 << 20 // 32 MB
 
 var (
 	defaultFileConfig = FileConfig{
-		ignoreBase:  false,
-		autoIndex:   true,
-		prettyIndex: true,
-		index:       defaultIndexes,
+		ignoreBase:    false,
+		autoIndex:     true,
+		prettyIndex:   true,
+		index:         defaultIndexes,
+		precompressed: false,
 	}
 	defaultIndexes = []string{
 		"index.html",
@@ -131,27 +146,115 @@ func (fs *FileServer) ServeFile(filePath string, fileNames ...string) (*FileInfo
 func (fs *FileServer) serveContent(file http.File, info *FileInfo) (*FileInfo, HttpStatus) {
 
 	filename, modTime := info.Name, info.ModTime
-	contentType := mime.TypeByExtension(filepath.Ext(filename))
+	contentType := mime.TypeByExtension(filepath.Ext(info.Path))
 
 	if contentType == "" {
-		// Read a small chunk to detect content type if extension is unknown
+		// Read a small chunk to detect content type if extension is unknown,
+		// then rewind so ServeContent computes sizes and ranges from offset 0
 		buf := make([]byte, 512)
-		n, err := io.ReadAtLeast(file, buf, 0)
-		if (err == nil || errors.Is(err, io.EOF)) && n > 0 {
+		n, err := io.ReadFull(file, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, HttpStatus{Code: http.StatusInternalServerError, Error: err}
+		}
+		contentType = "application/octet-stream"
+		if n > 0 {
 			contentType = http.DetectContentType(buf[:n])
-			if seeker, ok := file.(io.Seeker); ok {
-				_, _ = seeker.Seek(0, io.SeekStart)
-			}
-		} else {
-			contentType = "application/octet-stream"
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, HttpStatus{Code: http.StatusInternalServerError, Error: err}
+		}
+	}
+
+	etag := fileETag(info)
+	if fs.config.precompressed {
+		if encoded, encInfo, encoding := fs.precompressedFile(info.Path); encoded != nil {
+			defer encoded.Close()
+			file, modTime = encoded, encInfo.ModTime()
+			fs.w.Header().Set("Content-Encoding", encoding)
+			etag = strings.TrimSuffix(fileETag(newFileInfo(encInfo, "", "")), `"`) + "-" + encoding + `"`
 		}
 	}
 
 	fs.w.Header().Set("Content-Type", contentType)
-	http.ServeContent(fs.w, fs.r, filename, modTime, file)
-	length := int(info.Size)
+	if cacheControl := fs.config.cacheHeader(); cacheControl != "" {
+		fs.w.Header().Set("Cache-Control", cacheControl)
+	}
+	// ServeContent answers If-None-Match / If-Match from the ETag header
+	if fs.w.Header().Get("Etag") == "" {
+		fs.w.Header().Set("Etag", etag)
+	}
+	rec := &statusRecorder{ResponseWriter: fs.w, code: http.StatusOK}
+	http.ServeContent(rec, fs.r, filename, modTime, file)
+
+	return info, HttpStatus{Length: rec.length, Code: rec.code, Error: nil}
+}
+
+// precompressedEncodings are tried in order of preference
+var precompressedEncodings = []struct{ encoding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// precompressedFile opens the best sibling variant of filePath the client
+// accepts. Vary is set whenever a variant exists so caches keep them apart.
+func (fs *FileServer) precompressedFile(filePath string) (http.File, fs.FileInfo, string) {
+	accepted := acceptedEncodings(fs.r.Header.Get("Accept-Encoding"))
+	vary := false
+	for _, variant := range precompressedEncodings {
+		file, err := httpOpen(filePath + variant.ext)
+		if err != nil {
+			continue
+		}
+		info, err := file.Stat()
+		if err != nil || info.IsDir() {
+			file.Close()
+			continue
+		}
+		vary = true
+		if !accepted[variant.encoding] {
+			file.Close()
+			continue
+		}
+		fs.w.Header().Add("Vary", "Accept-Encoding")
+		return file, info, variant.encoding
+	}
+	if vary {
+		fs.w.Header().Add("Vary", "Accept-Encoding")
+	}
+	return nil, nil, ""
+}
 
-	return info, HttpStatus{Length: length, Code: http.StatusOK, Error: nil}
+// cacheHeader builds the Cache-Control value for served files, empty means
+// clients revalidate with Last-Modified and ETag.
+func (c *FileConfig) cacheHeader() string {
+	if c.cacheControl != "" {
+		return c.cacheControl
+	}
+	if c.maxAge <= 0 {
+		return ""
+	}
+	value := "public, max-age=" + strconv.Itoa(int(c.maxAge.Seconds()))
+	if c.immutable {
+		value += ", immutable"
+	}
+	return value
+}
+
+// fileETag derives a validator from size and modification time, which is
+// cheap to compute and changes whenever the file is rewritten.
+func fileETag(info *FileInfo) string {
+	return `"` + strconv.FormatInt(info.ModTime.UnixNano(), 36) + "-" + strconv.FormatInt(int64(info.Size), 36) + `"`
+}
+
+func (rec *statusRecorder) WriteHeader(statusCode int) {
+	rec.code = statusCode
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *statusRecorder) Write(body []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(body)
+	rec.length += n
+	return n, err
 }
 
 func (fs *FileServer) handleDirectory(file http.File, info *FileInfo) (*FileInfo, HttpStatus) {
@@ -191,14 +294,16 @@ func (fs *FileServer) dirList(file http.File, info *FileInfo) (*FileInfo, HttpSt
 		}
 	}
 
-	// Sort files: directories first, then by name
-	sort.SliceStable(infos, func(i, j int) bool {
-		a, b := infos[i], infos[j]
-		if a.IsDir() != b.IsDir() {
-			return a.IsDir()
-		}
-		return a.Name() < b.Name()
-	})
+	listing := &dirListing{FileInfo: info, Sort: "name", Order: "asc"}
+	query := fs.r.URL.Query()
+	switch by := query.Get("sort"); by {
+	case "name", "size", "date":
+		listing.Sort = by
+	}
+	if query.Get("order") == "desc" {
+		listing.Order = "desc"
+	}
+	sortDirEntries(infos, listing.Sort, listing.Order == "desc")
 
 	info.List = make([]FileInfo, len(infos))
 	for i, f := range infos {
@@ -220,7 +325,7 @@ func (fs *FileServer) dirList(file http.File, info *FileInfo) (*FileInfo, HttpSt
 		}
 	}
 
-	if err := tpl.Execute(&buf, info); err != nil {
+	if err := tpl.Execute(&buf, listing); err != nil {
 		return nil, HttpStatus{
 			Code:  http.StatusInternalServerError,
 			Error: err,
@@ -242,6 +347,53 @@ func (fs *FileServer) dirList(file http.File, info *FileInfo) (*FileInfo, HttpSt
 	}
 }
 
+// dirListing is the directory template data, the current sort is kept so
+// the column headers can link to the opposite order.
+type dirListing struct {
+	*FileInfo
+	Sort  string
+	Order string
+}
+
+// SortLink returns the query string that sorts by key, toggling the order
+// when the listing is already sorted by it.
+func (l *dirListing) SortLink(key string) string {
+	order := "asc"
+	if l.Sort == key && l.Order == "asc" {
+		order = "desc"
+	}
+	return "?sort=" + key + "&order=" + order
+}
+
+// sortDirEntries orders entries by name, size or date, keeping directories first.
+func sortDirEntries(infos []fs.FileInfo, by string, desc bool) {
+	sort.SliceStable(infos, func(i, j int) bool {
+		a, b := infos[i], infos[j]
+		if a.IsDir() != b.IsDir() {
+			return a.IsDir()
+		}
+		if desc {
+			a, b = b, a
+		}
+		switch by {
+		case "size":
+			if a.Size() != b.Size() {
+				return a.Size() < b.Size()
+			}
+		case "date":
+			if !a.ModTime().Equal(b.ModTime()) {
+				return a.ModTime().Before(b.ModTime())
+			}
+		}
+		return a.Name() < b.Name()
+	})
+}
+
+// HumanSize formats the size with binary units, e.g. "1.50KB".
+func (f FileInfo) HumanSize() string {
+	return util.FormatBytes(int64(f.Size))
+}
+
 func (fs *FileServer) attachment(filePath, fileName string) (*FileInfo, HttpStatus) {
 
 	// Check if the target is a file
@@ -301,46 +453,86 @@ func handleFileError(err error) (int, error) {
 	return http.StatusInternalServerError, err
 }
 
-func isPathSafe(root, target string) bool {
-	root = filepath.Clean(root)
-	target = filepath.Clean(target)
+// caseInsensitivePaths is set where the default filesystems ignore case, so
+// "/srv/WWW/a" is inside "/srv/www".
+var caseInsensitivePaths = runtime.GOOS == "windows" || runtime.GOOS == "darwin"
 
-	absRoot, err := filepath.Abs(root)
+// isPathSafe reports whether target stays inside root. Both paths are made
+// absolute with symlinks resolved before comparing, so siblings sharing a name
+// prefix ("/srv/www-evil" for "/srv/www") and links leading out of root fail.
+func isPathSafe(root, target string) bool {
+	absRoot, err := resolvePath(root)
 	if err != nil {
 		return false
 	}
-	absTarget, err := filepath.Abs(target)
+	absTarget, err := resolvePath(target)
 	if err != nil {
 		return false
 	}
-
-	if !strings.HasPrefix(absTarget, absRoot) {
-		return false
+	if caseInsensitivePaths {
+		absRoot, absTarget = strings.ToLower(absRoot), strings.ToLower(absTarget)
 	}
 
-	suffix := absTarget[len(absRoot):]
-	if len(suffix) > 0 && suffix[0] != os.PathSeparator {
+	rel, err := filepath.Rel(absRoot, absTarget)
+	if err != nil {
 		return false
 	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)))
+}
 
-	rel, err := filepath.Rel(root, target)
+// resolvePath returns the absolute, symlink free form of path. Trailing parts
+// that do not exist yet, such as upload destinations, are kept as they are.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
 	if err != nil {
-		return false
+		return "", err
 	}
-	return rel == "." || (len(rel) > 0 && !strings.HasPrefix(rel, "..") && rel != "..")
+	var missing []string
+	for {
+		resolved, err := filepath.EvalSymlinks(abs)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(abs)
+		if parent == abs {
+			return filepath.Join(append([]string{abs}, missing...)...), nil
+		}
+		missing = append([]string{filepath.Base(abs)}, missing...)
+		abs = parent
+	}
+}
+
+// UploadConfig restricts what UploadFile accepts. Zero values mean no limit,
+// a zero Mode writes the files 0640.
+type UploadConfig struct {
+	Mode       fs.FileMode
+	MaxSize    int64
+	Extensions []string // "png" or ".png", matched case-insensitively
+	Types      []string // media types, "image/*" matches a whole family
 }
 
-func uploadFile(r *http.Request, fieldName, dst string, modes ...fs.FileMode) error {
+// UploadedFile describes a file written by uploadFile.
+type UploadedFile struct {
+	Path        string
+	Filename    string
+	Size        int64
+	ContentType string
+}
+
+var defaultUploadConfig = UploadConfig{Mode: 0o640}
+
+func uploadFile(r *http.Request, fieldName, dst string, cfg *UploadConfig) ([]UploadedFile, error) {
 
-	// Standard file permissions
-	var mode os.FileMode = 0o640
-	if len(modes) > 0 {
-		mode = modes[0]
+	if cfg == nil {
+		cfg = &defaultUploadConfig
 	}
 
 	// Parse the multipart form
 	if err := r.ParseMultipartForm(defaultMultipartMemory); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Get file headers from the form
@@ -348,31 +540,112 @@ func uploadFile(r *http.Request, fieldName, dst string, modes ...fs.FileMode) er
 	if !ok || len(fhs) == 0 {
 		f, fh, err := r.FormFile(fieldName)
 		if err != nil {
-			return fmt.Errorf("no files found for key '%s'", fieldName)
+			return nil, fmt.Errorf("no files found for key '%s'", fieldName)
 		}
 		defer f.Close()
 		fhs = []*multipart.FileHeader{fh}
 	}
 
-	// Process each uploaded file
-	for _, fh := range fhs {
+	// Validate every file first so a rejected one leaves nothing behind
+	files := make([]UploadedFile, len(fhs))
+	for i, fh := range fhs {
 		filename := filepath.Clean(fh.Filename)
 		if strings.HasPrefix(filename, "..") {
-			return fmt.Errorf("invalid filename '%s' detected", filename)
+			return nil, fmt.Errorf("invalid filename '%s' detected", filename)
 		}
 		dstPath := filepath.Join(dst, filename)
 
 		// Ensure the destination path is within the base directory 'dst'
 		if !isPathSafe(dst, dstPath) {
-			return fmt.Errorf("potential path traversal detected for file '%s'", fh.Filename)
+			return nil, fmt.Errorf("potential path traversal detected for file '%s'", fh.Filename)
+		}
+		contentType, err := validateUpload(fh, cfg)
+		if err != nil {
+			return nil, err
+		}
+		files[i] = UploadedFile{
+			Path:        dstPath,
+			Filename:    fh.Filename,
+			Size:        fh.Size,
+			ContentType: contentType,
+		}
+	}
+
+	// Process each uploaded file
+	mode := cfg.Mode
+	if mode == 0 {
+		mode = defaultUploadConfig.Mode
+	}
+	for i, fh := range fhs {
+		if err := saveFile(fh, files[i].Path, mode); err != nil {
+			// all or nothing: remove the files saved before this one
+			for _, saved := range files[:i] {
+				os.Remove(saved.Path)
+			}
+			return nil, fmt.Errorf("failed to save file '%s': %w", fh.Filename, err)
 		}
+	}
+
+	return files, nil
+}
+
+// validateUpload checks size, extension and sniffed content type, the type
+// the client declared is not trusted. It returns the detected content type.
+func validateUpload(fh *multipart.FileHeader, cfg *UploadConfig) (string, error) {
+	if cfg.MaxSize > 0 && fh.Size > cfg.MaxSize {
+		return "", fmt.Errorf("file '%s' is %d bytes, over the %d bytes limit", fh.Filename, fh.Size, cfg.MaxSize)
+	}
 
-		if err := saveFile(fh, dstPath, mode); err != nil {
-			return fmt.Errorf("failed to save file '%s': %w", fh.Filename, err)
+	if len(cfg.Extensions) > 0 {
+		ext := filepath.Ext(fh.Filename)
+		allowed := ext != "" && slices.ContainsFunc(cfg.Extensions, func(allowed string) bool {
+			return strings.EqualFold(strings.TrimPrefix(allowed, "."), ext[1:])
+		})
+		if !allowed {
+			return "", fmt.Errorf("file '%s' has extension '%s', allowed: %s", fh.Filename, ext, strings.Join(cfg.Extensions, ", "))
 		}
 	}
 
-	return nil
+	contentType, err := sniffUpload(fh)
+	if err != nil {
+		return "", err
+	}
+	if len(cfg.Types) > 0 && !matchMediaType(cfg.Types, contentType) {
+		return "", fmt.Errorf("file '%s' has content type '%s', allowed: %s", fh.Filename, contentType, strings.Join(cfg.Types, ", "))
+	}
+	return contentType, nil
+}
+
+func sniffUpload(fh *multipart.FileHeader) (string, error) {
+	src, err := fh.Open()
+	if err != nil {
+		return "", fmt.Errorf("failed to open uploaded file: %w", err)
+	}
+	defer src.Close()
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(src, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+func matchMediaType(allowed []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range allowed {
+		if family, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, family+"/") {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+	return false
 }
 
 func saveFile(fh *multipart.FileHeader, dst string, mode fs.FileMode) error {
@@ -399,10 +672,15 @@ func saveFile(fh *multipart.FileHeader, dst string, mode fs.FileMode) error {
 	if err != nil {
 		return err
 	}
-	defer out.Close()
 
-	// Copy the uploaded file content to the destination file
+	// Copy the uploaded file content, removing what was written on failure
 	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
 		return err
 	}
 
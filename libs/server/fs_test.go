@@ -0,0 +1,113 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsPathSafe(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "www")
+	for _, dir := range []string{"www/sub", "www-evil", "outside"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"www/in":     filepath.Join(root, "sub"),
+		"www/out":    filepath.Join(base, "outside"),
+		"www/relout": "../outside",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		safe   bool
+	}{
+		{"root itself", root, true},
+		{"file in root", filepath.Join(root, "index.html"), true},
+		{"missing nested parts", filepath.Join(root, "sub", "new", "file.txt"), true},
+		{"dot dot back inside", filepath.Join(root, "sub", "..", "a.txt"), true},
+		{"dot dot out of root", root + "/../outside/a.txt", false},
+		{"dot dot to parent", root + "/..", false},
+		{"sibling sharing the prefix", filepath.Join(base, "www-evil", "a.txt"), false},
+		{"absolute target elsewhere", "/etc/passwd", false},
+		{"symlink inside root", filepath.Join(root, "in", "a.txt"), true},
+		{"symlink leaving root", filepath.Join(root, "out", "a.txt"), false},
+		{"relative symlink leaving root", filepath.Join(root, "relout", "a.txt"), false},
+		{"missing parts below a leaving symlink", filepath.Join(root, "out", "x", "y"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPathSafe(root, tt.target); got != tt.safe {
+				t.Errorf("isPathSafe(%q, %q) = %v, want %v", root, tt.target, got, tt.safe)
+			}
+		})
+	}
+}
+
+func TestIsPathSafeCase(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "www")
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(v bool) { caseInsensitivePaths = v }(caseInsensitivePaths)
+
+	tests := []struct {
+		name        string
+		insensitive bool
+		target      string
+		safe        bool
+	}{
+		{"other case is another directory", false, filepath.Join(base, "WWW", "a.txt"), false},
+		{"other case is the same directory", true, filepath.Join(base, "WWW", "a.txt"), true},
+		{"other case of a sibling", true, filepath.Join(base, "WWW-evil", "a.txt"), false},
+		{"other case after dot dot", true, filepath.Join(root, "..", "Www", "a.txt"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caseInsensitivePaths = tt.insensitive
+			if got := isPathSafe(root, tt.target); got != tt.safe {
+				t.Errorf("isPathSafe(%q, %q) = %v, want %v", root, tt.target, got, tt.safe)
+			}
+		})
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(base, "real"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(base, "real"), filepath.Join(base, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path, want string
+	}{
+		{filepath.Join(base, "real"), filepath.Join(base, "real")},
+		{filepath.Join(base, "link"), filepath.Join(base, "real")},
+		{filepath.Join(base, "link", "new", "file"), filepath.Join(base, "real", "new", "file")},
+		{filepath.Join(base, "real", "..", "link"), filepath.Join(base, "real")},
+	}
+	for _, tt := range tests {
+		got, err := resolvePath(tt.path)
+		if err != nil {
+			t.Fatalf("resolvePath(%q): %v", tt.path, err)
+		}
+		if got != tt.want {
+			t.Errorf("resolvePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type jwtConfig struct {
+	alg       string
+	secret    []byte
+	publicKey *rsa.PublicKey
+	leeway    time.Duration
+}
+
+var (
+	errMissingToken = errors.New("missing bearer token")
+	errInvalidToken = errors.New("invalid token")
+)
+
+// JWT builds a middleware that accepts only requests with a valid HS256 or
+// RS256 bearer token, for use with app.use. The claims are stored as "claims".
+// For RS256 the secret is the PEM encoded public key.
+func (s *Server) JWT(L *lua.LState) int {
+	cfg := jwtConfig{alg: "HS256"}
+	var secret string
+	lopt := L.CheckTable(1)
+
+	lopt.ForEach(func(k, v lua.LValue) {
+		key := k.String()
+		switch key {
+		case "secret":
+			if val, ok := util.CheckString(L, key, v); ok {
+				secret = val
+			}
+		case "alg":
+			if val, ok := util.CheckString(L, key, v); ok {
+				cfg.alg = strings.ToUpper(val)
+			}
+		case "leeway":
+			if val, ok := util.CheckDuration(L, key, v); ok {
+				cfg.leeway = val
+			}
+		default:
+			L.ArgError(1, "unknown jwt field: "+key)
+		}
+	})
+
+	if secret == "" {
+		L.ArgError(1, "secret is required")
+	}
+	switch cfg.alg {
+	case "HS256":
+		cfg.secret = []byte(secret)
+	case "RS256":
+		key, err := parseRSAPublicKey(secret)
+		if err != nil {
+			L.ArgError(1, err.Error())
+		}
+		cfg.publicKey = key
+	default:
+		L.ArgError(1, `alg must be "HS256" or "RS256"`)
+	}
+
+	handler := func(L *lua.LState, ctx *Context) *HttpStatus {
+		token, ok := ctx.Bearer()
+		if !ok {
+			ctx.Writer.ResponseWriter.Header().Set("WWW-Authenticate", "Bearer")
+			return &HttpStatus{Code: http.StatusUnauthorized, Error: errMissingToken}
+		}
+		claims, err := cfg.verify(token, time.Now())
+		if err != nil {
+			ctx.Writer.ResponseWriter.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			return &HttpStatus{Code: http.StatusUnauthorized, Error: err}
+		}
+		ctx.mu.Lock()
+		ctx.data["claims"] = claims
+		ctx.mu.Unlock()
+		return ctx.next(L, ctx)
+	}
+	return util.Push(L, &lua.LUserData{Value: Handler(handler)})
+}
+
+func (ctx *Context) bearer(L *lua.LState) int {
+	token, ok := ctx.Bearer()
+	if !ok {
+		return util.Push(L, lua.LNil)
+	}
+	return util.Push(L, lua.LString(token))
+}
+
+// Bearer returns the token of an "Authorization: Bearer" header.
+func (ctx *Context) Bearer() (string, bool) {
+	scheme, token, ok := strings.Cut(ctx.Request.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// verify checks the signature with the configured algorithm only, whatever
+// the token header claims, then the exp and nbf times.
+func (cfg *jwtConfig) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != cfg.alg {
+		return nil, errInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch cfg.alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, cfg.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errInvalidToken
+		}
+	case "RS256":
+		digest := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(cfg.publicKey, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errInvalidToken
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(unixTime(exp).Add(cfg.leeway)) {
+		return nil, fmt.Errorf("%w: expired", errInvalidToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(unixTime(nbf).Add(-cfg.leeway)) {
+		return nil, fmt.Errorf("%w: not valid yet", errInvalidToken)
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// parseRSAPublicKey reads a PKIX or PKCS #1 public key, or the key of a certificate.
+func parseRSAPublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("secret must be a PEM encoded RSA public key for RS256")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+	return rsaKey, nil
+}
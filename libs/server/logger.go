@@ -1,8 +1,12 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"time"
 
 	"lug/util"
 
@@ -23,6 +27,7 @@ func (s *Server) logger(L *lua.LState, logType string, args ...interface{}) {
 	var logMessage string
 	var hasMessage bool
 	var luaArgs []lua.LValue
+	var rawMessage bool
 
 	switch logType {
 	case "error":
@@ -69,16 +74,27 @@ func (s *Server) logger(L *lua.LState, logType string, args ...interface{}) {
 		callback = s.config.onRequest
 		luaArgs = []lua.LValue{ctx.luaContext(L)}
 
+		if s.config.logFormat != "text" {
+			logMessage = s.accessLog(ctx)
+			rawMessage = true
+			break
+		}
+
 		cip := ctx.RemoteIP()
-		tpl := "method: %s, code: %d, path: %s, time: %v, client: %s, server: %s"
+		tpl := "method: %s, code: %d, path: %s, time: %v, handler: %v, client: %s, server: %s"
 		data := []interface{}{
 			ctx.Request.Method,
 			ctx.Status.Code,
 			ctx.Request.URL.Path,
 			ctx.Since(),
+			ctx.HandlerTime(),
 			cip,
 			s.config.addr,
 		}
+		if ctx.requestID != "" {
+			tpl += ", id: %s"
+			data = append(data, ctx.requestID)
+		}
 
 		if ctx.Status.Error != nil {
 			if s.config.logLevel == "error" {
@@ -92,6 +108,19 @@ func (s *Server) logger(L *lua.LState, logType string, args ...interface{}) {
 			logMessage = fmt.Sprintf("[success] "+tpl, data...)
 		}
 
+	case "log":
+		entry, hasMessage := arg.(*handlerLog)
+		if !hasMessage || !entry.enabled() {
+			return
+		}
+		callback = s.config.onLog
+		var fields lua.LValue = lua.LNil
+		if entry.table != nil {
+			fields = entry.table
+		}
+		luaArgs = []lua.LValue{entry.ctx.luaContext(L), lua.LString(entry.level), lua.LString(entry.msg), fields}
+		logMessage, rawMessage = entry.format()
+
 	default:
 		log.Printf("logger: unknown log type: %s", logType)
 		return
@@ -100,7 +129,12 @@ func (s *Server) logger(L *lua.LState, logType string, args ...interface{}) {
 	if callback == nil {
 		// util.DebugPrintError(errors.New(logMessage))
 		// L.RaiseError(logMessage)
-		log.Println(logMessage)
+		if rawMessage {
+			// access log formats carry their own timestamp
+			log.New(log.Writer(), "", 0).Println(logMessage)
+		} else {
+			log.Println(logMessage)
+		}
 		return
 	}
 
@@ -108,3 +142,172 @@ func (s *Server) logger(L *lua.LState, logType string, args ...interface{}) {
 		log.Printf("logger: Lua callback error (%s): %v", logType, err)
 	}
 }
+
+// accessLog formats a request in the common, combined or json log format.
+func (s *Server) accessLog(ctx *Context) string {
+	r := ctx.Request
+	size := strconv.Itoa(ctx.Status.Length)
+
+	switch s.config.logFormat {
+	case "json":
+		entry := map[string]interface{}{
+			"time":     ctx.startTime.Format(time.RFC3339Nano),
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"uri":      r.RequestURI,
+			"proto":    r.Proto,
+			"status":   ctx.Status.Code,
+			"size":     ctx.Status.Length,
+			"duration": ctx.Since(),
+			"handler":  ctx.HandlerTime(),
+			"ip":       ctx.RemoteIP(),
+			"referer":  r.Referer(),
+			"agent":    r.UserAgent(),
+		}
+		if ctx.requestID != "" {
+			entry["requestId"] = ctx.requestID
+		}
+		if ctx.Status.Error != nil {
+			entry["error"] = ctx.Status.Error.Error()
+		}
+		return jsonLogLine(entry)
+
+	default:
+		if ctx.Status.Length == 0 {
+			size = "-"
+		}
+		user := "-"
+		if name, _, ok := r.BasicAuth(); ok && name != "" {
+			user = name
+		}
+		line := fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s`,
+			ctx.RemoteIP(),
+			user,
+			ctx.startTime.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method,
+			r.RequestURI,
+			r.Proto,
+			ctx.Status.Code,
+			size,
+		)
+		if s.config.logFormat == "combined" {
+			line += fmt.Sprintf(` %q %q`, orDash(r.Referer()), orDash(r.UserAgent()))
+		}
+		return line
+	}
+}
+
+// jsonLogLine renders one entry of the json log format.
+func jsonLogLine(entry map[string]interface{}) string {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Sprintf(`{"error":%q}`, err.Error())
+	}
+	return string(line)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// handlerLog is a message logged by a handler through ctx.log.
+type handlerLog struct {
+	ctx    *Context
+	level  string
+	msg    string
+	fields map[string]interface{}
+	table  *lua.LTable // fields as passed, for onLog
+}
+
+// enabled reports whether the level passes the logLevel of the route.
+func (e *handlerLog) enabled() bool {
+	logLevel := "info"
+	if e.ctx.config != nil {
+		logLevel = e.ctx.config.logLevel
+	}
+	threshold, ok := logLevels[logLevel]
+	switch {
+	case logLevel == "silent":
+		return false
+	case !ok:
+		threshold = logLevels["info"]
+	}
+	return logLevels[e.level] >= threshold
+}
+
+// format writes the message like the request log, tagged with the method,
+// path and request id. raw is set for json lines, which carry their own time.
+func (e *handlerLog) format() (line string, raw bool) {
+	ctx := e.ctx
+	if ctx.config != nil && ctx.config.logFormat == "json" {
+		entry := make(map[string]interface{}, len(e.fields)+6)
+		for key, val := range e.fields {
+			entry[key] = val
+		}
+		entry["time"] = time.Now().Format(time.RFC3339Nano)
+		entry["level"] = e.level
+		entry["msg"] = e.msg
+		entry["method"] = ctx.Request.Method
+		entry["path"] = ctx.Request.URL.Path
+		if ctx.requestID != "" {
+			entry["requestId"] = ctx.requestID
+		}
+		return jsonLogLine(entry), true
+	}
+
+	line = fmt.Sprintf("[%s] %s, method: %s, path: %s", e.level, e.msg, ctx.Request.Method, ctx.Request.URL.Path)
+	if ctx.requestID != "" {
+		line += ", id: " + ctx.requestID
+	}
+	keys := make([]string, 0, len(e.fields))
+	for key := range e.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		line += fmt.Sprintf(", %s: %v", key, e.fields[key])
+	}
+	return line, false
+}
+
+// logMessage is ctx.log(level, msg, fields). It goes through the server
+// logger, so it honours logLevel and logFormat, and reaches the onLog hook
+// instead of the log when one is set.
+func (ctx *Context) logMessage(L *lua.LState) int {
+	level, msg := L.CheckString(1), L.CheckString(2)
+	if _, ok := logLevels[level]; !ok {
+		L.ArgError(1, "level must be debug, info, warn or error")
+	}
+	entry := &handlerLog{ctx: ctx, level: level, msg: msg}
+	if tbl := L.OptTable(3, nil); tbl != nil {
+		entry.table = tbl
+		entry.fields, _ = util.ToGoValue(tbl, true).(map[string]interface{})
+	}
+
+	if ctx.server != nil {
+		ctx.server.logger(L, "log", entry)
+	} else if entry.enabled() {
+		line, raw := entry.format()
+		if raw {
+			log.New(log.Writer(), "", 0).Println(line)
+		} else {
+			log.Println(line)
+		}
+	}
+	return 0
+}
+
+// logError reports an error that is not tied to the response through the
+// server logger, or the standard log when no server handles the context.
+func (ctx *Context) logError(L *lua.LState, err error) {
+	if ctx.server != nil {
+		ctx.server.logger(L, "error", err)
+		return
+	}
+	log.Println(err)
+}
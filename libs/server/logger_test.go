@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// TestHandlerLogHooks checks that ctx.log reaches onLog only, leaving
+// onRequest and onError to the request log, and honours logLevel.
+func TestHandlerLogHooks(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	s := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.logLevel = "info"
+	})
+	s.vm.SetGlobal("record", s.vm.NewFunction(func(L *lua.LState) int {
+		parts := []string{}
+		for i := 1; i <= L.GetTop(); i++ {
+			if v := L.Get(i); v.Type() == lua.LTString {
+				parts = append(parts, v.String())
+			}
+		}
+		mu.Lock()
+		got = append(got, strings.Join(parts, " "))
+		mu.Unlock()
+		return 0
+	}))
+	if err := s.vm.DoString(`
+		onRequest = function(ctx, msg) record("request", msg) end
+		onError = function(msg) record("error", msg) end
+		onLog = function(ctx, level, msg, fields)
+			record("log", level, msg, fields and fields.user)
+		end
+	`); err != nil {
+		t.Fatal(err)
+	}
+	s.config.onRequest = s.vm.GetGlobal("onRequest").(*lua.LFunction)
+	s.config.onError = s.vm.GetGlobal("onError").(*lua.LFunction)
+	s.config.onLog = s.vm.GetGlobal("onLog").(*lua.LFunction)
+
+	results := s.handleLua(t, http.MethodGet, "/", `function(ctx)
+		ctx.log("debug", "hidden")
+		ctx.log("info", "hello", { user = "ann" })
+		ctx.log("error", "boom")
+		report()
+	end`)
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	<-results
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"log info hello ann", "log error boom", "request"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("hooks got %q, want %q", got, want)
+	}
+}
+
+func TestHandlerLogFormat(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/users", nil)
+	ctx := newContext(httptest.NewRecorder(), r)
+	defer ctx.Release()
+	ctx.requestID = "abc"
+	entry := &handlerLog{ctx: ctx, level: "warn", msg: "slow", fields: map[string]interface{}{"ms": 12, "db": "main"}}
+
+	ctx.config = &ServerConfig{logLevel: "info", logFormat: "text"}
+	line, raw := entry.format()
+	if want := "[warn] slow, method: GET, path: /users, id: abc, db: main, ms: 12"; line != want || raw {
+		t.Errorf("text: got %q (raw %v), want %q", line, raw, want)
+	}
+
+	ctx.config.logFormat = "json"
+	line, raw = entry.format()
+	for _, part := range []string{`"level":"warn"`, `"msg":"slow"`, `"requestId":"abc"`, `"ms":12`, `"path":"/users"`} {
+		if !strings.Contains(line, part) {
+			t.Errorf("json line %s lacks %s", line, part)
+		}
+	}
+	if !raw {
+		t.Error("json lines carry their own time and must be written raw")
+	}
+
+	ctx.config.logLevel = "error"
+	if entry.enabled() {
+		t.Error("warn passed logLevel error")
+	}
+	ctx.config.logLevel = "silent"
+	entry.level = "error"
+	if entry.enabled() {
+		t.Error("silent logged an error")
+	}
+}
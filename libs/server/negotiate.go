@@ -0,0 +1,136 @@
+package server
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type acceptRange struct {
+	value string
+	q     float64
+}
+
+// accepts returns the offered type the client prefers according to the
+// Accept header, or nil if none is acceptable. Offers may be shorthands
+// such as "json" or "html" and are returned as given.
+func (ctx *Context) accepts(L *lua.LState) int {
+	offers := checkOffers(L)
+	types := make([]string, len(offers))
+	for i, offer := range offers {
+		types[i] = offer
+		if !strings.Contains(offer, "/") {
+			if typ := mime.TypeByExtension("." + offer); typ != "" {
+				types[i], _, _ = strings.Cut(typ, ";")
+			}
+		}
+	}
+	best, ok := negotiate(ctx.Request.Header.Get("Accept"), types, matchMediaRange)
+	if !ok {
+		return util.Push(L, lua.LNil)
+	}
+	return util.Push(L, lua.LString(offers[best]))
+}
+
+// acceptsLanguage returns the offered language the client prefers according
+// to the Accept-Language header, or nil if none is acceptable.
+func (ctx *Context) acceptsLanguage(L *lua.LState) int {
+	offers := checkOffers(L)
+	best, ok := negotiate(ctx.Request.Header.Get("Accept-Language"), offers, matchLanguage)
+	if !ok {
+		return util.Push(L, lua.LNil)
+	}
+	return util.Push(L, lua.LString(offers[best]))
+}
+
+func checkOffers(L *lua.LState) []string {
+	top := L.GetTop()
+	if top == 0 {
+		L.ArgError(1, "at least one value expected")
+	}
+	offers := make([]string, top)
+	for i := range offers {
+		offers[i] = L.CheckString(i + 1)
+	}
+	return offers
+}
+
+// negotiate returns the index of the offer with the highest quality. The
+// most specific matching range decides an offer's quality, ties go to the
+// earlier offer. A missing header accepts the first offer.
+func negotiate(header string, offers []string, match func(rng, offer string) int) (int, bool) {
+	if strings.TrimSpace(header) == "" {
+		return 0, true
+	}
+	ranges := parseAcceptRanges(header)
+
+	best, bestQ := 0, 0.0
+	for i, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, rng := range ranges {
+			if s := match(rng.value, offer); s > specificity {
+				q, specificity = rng.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// parseAcceptRanges splits a header such as "text/html, */*;q=0.8".
+func parseAcceptRanges(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		value, params, _ := strings.Cut(part, ";")
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		ranges = append(ranges, acceptRange{value: value, q: q})
+	}
+	return ranges
+}
+
+// matchMediaRange returns how specific a media range matching the offer is,
+// or -1 if it does not match.
+func matchMediaRange(rng, offer string) int {
+	offer = strings.ToLower(offer)
+	switch {
+	case rng == offer:
+		return 2
+	case rng == "*/*":
+		return 0
+	}
+	if prefix, ok := strings.CutSuffix(rng, "/*"); ok && strings.HasPrefix(offer, prefix+"/") {
+		return 1
+	}
+	return -1
+}
+
+// matchLanguage matches language tags by prefix, so "en" covers "en-US".
+func matchLanguage(rng, offer string) int {
+	offer = strings.ToLower(offer)
+	switch {
+	case rng == offer:
+		return 2
+	case rng == "*":
+		return 0
+	case strings.HasPrefix(offer, rng+"-"), strings.HasPrefix(rng, offer+"-"):
+		return 1
+	}
+	return -1
+}
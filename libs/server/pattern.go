@@ -15,10 +15,11 @@ type pattern struct {
 }
 
 type segment struct {
-	name   string
-	param  bool
-	wild   bool
-	regexp string
+	name     string
+	param    bool
+	wild     bool
+	optional bool
+	regexp   string
 }
 
 func parsePattern(path string) (_ *pattern, err error) {
@@ -96,6 +97,13 @@ func parsePattern(path string) (_ *pattern, err error) {
 			regex = content[colon+1:]
 		}
 
+		// {name?} also matches the path without this segment
+		optional := false
+		if strings.HasSuffix(name, "?") {
+			optional = true
+			name = name[:len(name)-1]
+		}
+
 		switch {
 		// Validate name
 		case name == "":
@@ -110,15 +118,22 @@ func parsePattern(path string) (_ *pattern, err error) {
 		// Validate wildcard position
 		case wild && len(rest) > 0:
 			return nil, errors.New("{...} wildcard must be the last segment")
+
+		case optional && wild:
+			return nil, errors.New("{...} wildcard cannot be optional")
+
+		case optional && len(rest) > 0:
+			return nil, errors.New("{name?} optional segment must be the last segment")
 		}
 
 		seenNames[name] = true
 
 		p.segments = append(p.segments, segment{
-			name:   name,
-			param:  true,
-			wild:   wild,
-			regexp: regex,
+			name:     name,
+			param:    true,
+			wild:     wild,
+			optional: optional,
+			regexp:   regex,
 		})
 	}
 	return p, nil
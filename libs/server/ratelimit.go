@@ -0,0 +1,141 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+	"golang.org/x/time/rate"
+)
+
+type (
+	rateLimitConfig struct {
+		rps   float64
+		burst int
+		by    string
+		ttl   time.Duration
+	}
+	rateLimiter struct {
+		config    rateLimitConfig
+		visitors  map[string]*visitor
+		lastSweep time.Time
+		mu        sync.Mutex
+	}
+	visitor struct {
+		limiter  *rate.Limiter
+		lastSeen time.Time
+	}
+)
+
+var defaultRateLimitConfig = rateLimitConfig{
+	rps:   10,
+	burst: 20,
+	by:    "ip",
+	ttl:   3 * time.Minute,
+}
+
+// RateLimit builds a middleware that throttles clients, for use with app.use.
+func (s *Server) RateLimit(L *lua.LState) int {
+	cfg := defaultRateLimitConfig
+	lopt := L.OptTable(1, L.NewTable())
+
+	lopt.ForEach(func(k, v lua.LValue) {
+		key := k.String()
+		switch key {
+		case "rps":
+			if val, ok := v.(lua.LNumber); ok && val > 0 {
+				cfg.rps = float64(val)
+			} else {
+				L.ArgError(1, "rps must be a positive number")
+			}
+		case "burst":
+			if val, ok := util.CheckInt(L, key, v); ok && val >= 1 {
+				cfg.burst = val
+			} else if ok {
+				L.ArgError(1, "burst must be at least 1")
+			}
+		case "by":
+			if val, ok := util.CheckString(L, key, v); ok {
+				cfg.by = val
+			}
+		case "ttl":
+			if val, ok := util.CheckDuration(L, key, v); ok {
+				cfg.ttl = val
+			}
+		default:
+			L.ArgError(1, "unknown rateLimit field: "+key)
+		}
+	})
+
+	if cfg.by != "ip" && !strings.HasPrefix(cfg.by, "header:") {
+		L.ArgError(1, `by must be "ip" or "header:<name>"`)
+	}
+
+	limiter := &rateLimiter{
+		config:    cfg,
+		visitors:  make(map[string]*visitor),
+		lastSweep: time.Now(),
+	}
+	return util.Push(L, &lua.LUserData{Value: Handler(limiter.handle)})
+}
+
+func (rl *rateLimiter) handle(L *lua.LState, ctx *Context) *HttpStatus {
+	reservation := rl.limiter(rl.key(ctx)).Reserve()
+	// a reservation that can never be met has no Delay worth reporting
+	if !reservation.OK() {
+		return &HttpStatus{
+			Code:  http.StatusTooManyRequests,
+			Error: errors.New("rate limit exceeded"),
+		}
+	}
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		retryAfter := int(math.Ceil(delay.Seconds()))
+		ctx.Writer.ResponseWriter.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		return &HttpStatus{
+			Code:  http.StatusTooManyRequests,
+			Error: errors.New("rate limit exceeded"),
+		}
+	}
+	return ctx.next(L, ctx)
+}
+
+func (rl *rateLimiter) key(ctx *Context) string {
+	if name, ok := strings.CutPrefix(rl.config.by, "header:"); ok {
+		if val := ctx.Request.Header.Get(name); val != "" {
+			return val
+		}
+	}
+	return ctx.RemoteIP()
+}
+
+// limiter returns the limiter for a key, evicting visitors idle longer than ttl.
+func (rl *rateLimiter) limiter(key string) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.lastSweep) > rl.config.ttl {
+		for k, v := range rl.visitors {
+			if now.Sub(v.lastSeen) > rl.config.ttl {
+				delete(rl.visitors, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	v, ok := rl.visitors[key]
+	if !ok {
+		v = &visitor{limiter: rate.NewLimiter(rate.Limit(rl.config.rps), rl.config.burst)}
+		rl.visitors[key] = v
+	}
+	v.lastSeen = now
+	return v.limiter
+}
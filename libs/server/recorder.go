@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Test runs a synthetic request through the middlewares and routes without
+// binding a socket and returns the recorded status, headers and body.
+//
+//	local res = app.test("POST", "/users", {body = "{}", headers = {["Content-Type"] = "application/json"}})
+func (s *Server) Test(L *lua.LState) int {
+	method := strings.ToUpper(L.CheckString(1))
+	target := L.CheckString(2)
+	lopt := L.OptTable(3, L.NewTable())
+
+	var body, host, remoteAddr string
+	headers := map[string]string{}
+	lopt.ForEach(func(k, v lua.LValue) {
+		key := k.String()
+		switch key {
+		case "body":
+			if val, ok := util.CheckString(L, key, v, 3); ok {
+				body = val
+			}
+		case "headers":
+			if val, ok := util.CheckTableMap(L, key, v, 3); ok {
+				headers = val
+			}
+		case "host":
+			if val, ok := util.CheckString(L, key, v, 3); ok {
+				host = val
+			}
+		case "remoteAddr":
+			if val, ok := util.CheckString(L, key, v, 3); ok {
+				remoteAddr = val
+			}
+		default:
+			L.ArgError(3, "unknown test field: "+key)
+		}
+	})
+
+	if !strings.HasPrefix(target, "/") {
+		L.ArgError(2, "path must start with /")
+	}
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for key, val := range headers {
+		req.Header.Set(key, val)
+	}
+	if host != "" {
+		req.Host = host
+	}
+	if remoteAddr != "" {
+		req.RemoteAddr = remoteAddr
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return util.Push(L, recordedResponse(L, rec.Result().StatusCode, rec.Header(), rec.Body.String()))
+}
+
+func recordedResponse(L *lua.LState, code int, header http.Header, body string) *lua.LTable {
+	headers := L.NewTable()
+	for key, values := range header {
+		headers.RawSetString(key, lua.LString(strings.Join(values, ", ")))
+	}
+	return util.SetMethods(L, util.Methods{
+		"status":  lua.LNumber(code),
+		"headers": headers,
+		"body":    lua.LString(body),
+	})
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"html/template"
+	"strings"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func (ctx *Context) render(L *lua.LState) int {
+	path := L.CheckString(1)
+	var data interface{}
+	if L.GetTop() >= 2 && L.Get(2) != lua.LNil {
+		data = util.ToGoValue(L.CheckTable(2), false)
+	}
+	name := L.OptString(3, "")
+
+	length, err := ctx.renderOn(L, path, data, name)
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, lua.LNumber(length))
+}
+
+// Render executes a template file, or a glob of layout and partial files,
+// and writes the result as HTML. Parsed templates are cached by path.
+// With a glob, name selects the template to run; it defaults to the first file.
+func (ctx *Context) Render(path string, data interface{}, name string) (int, error) {
+	return ctx.renderOn(nil, path, data, name)
+}
+
+// renderOn is Render with the templateFuncs helpers running on L.
+func (ctx *Context) renderOn(L *lua.LState, path string, data interface{}, name string) (int, error) {
+	var tpl *template.Template
+	var err error
+	if strings.ContainsAny(path, "*?[") {
+		tpl, err = ctx.templates().ParseGlob(path)
+	} else {
+		tpl, err = ctx.templates().ParseFiles(path)
+	}
+	if err == nil {
+		tpl, err = ctx.templateInstance(L, tpl)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Render into a buffer first so a failing template leaves the response untouched.
+	var buf bytes.Buffer
+	if name != "" {
+		err = tpl.ExecuteTemplate(&buf, name, data)
+	} else {
+		err = tpl.Execute(&buf, data)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	ctx.Writer.ResponseWriter.Header().Set("Content-Type", "text/html; charset=utf-8")
+	length, err := ctx.Writer.Write(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	ctx.Status.Length += length
+	return length, nil
+}
+
+// templates returns the template scope of the server handling ctx.
+func (ctx *Context) templates() *util.TemplateScope {
+	if ctx.server != nil && ctx.server.templates != nil {
+		return ctx.server.templates
+	}
+	return util.DefaultTemplates
+}
+
+// templateInstance readies tpl, parsed in the scope of ctx, to run with the
+// templateFuncs helpers on L.
+func (ctx *Context) templateInstance(L *lua.LState, tpl *template.Template) (*template.Template, error) {
+	var funcs template.FuncMap
+	if ctx.server != nil && L != nil {
+		funcs = ctx.server.templateHelpers(L)
+	}
+	return ctx.templates().Instance(tpl, funcs)
+}
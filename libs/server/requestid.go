@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type requestIDConfig struct {
+	header        string
+	trustIncoming bool
+}
+
+var defaultRequestIDConfig = requestIDConfig{
+	header:        "X-Request-Id",
+	trustIncoming: true,
+}
+
+// RequestID builds a middleware that tags every request with an id, for use with app.use.
+func (s *Server) RequestID(L *lua.LState) int {
+	cfg := defaultRequestIDConfig
+	lopt := L.OptTable(1, L.NewTable())
+
+	lopt.ForEach(func(k, v lua.LValue) {
+		key := k.String()
+		switch key {
+		case "header":
+			if val, ok := util.CheckString(L, key, v); ok {
+				cfg.header = val
+			}
+		case "trustIncoming":
+			if val, ok := util.CheckBool(L, key, v); ok {
+				cfg.trustIncoming = val
+			}
+		default:
+			L.ArgError(1, "unknown requestId field: "+key)
+		}
+	})
+
+	handler := func(L *lua.LState, ctx *Context) *HttpStatus {
+		id := ""
+		if cfg.trustIncoming {
+			if incoming := ctx.Request.Header.Get(cfg.header); validRequestID(incoming) {
+				id = incoming
+			}
+		}
+		if id == "" {
+			id = newRequestID()
+		}
+
+		ctx.mu.Lock()
+		ctx.requestID = id
+		ctx.data["requestId"] = lua.LString(id)
+		ctx.mu.Unlock()
+		ctx.Writer.ResponseWriter.Header().Set(cfg.header, id)
+		return ctx.next(L, ctx)
+	}
+	return util.Push(L, &lua.LUserData{Value: Handler(handler)})
+}
+
+func (ctx *Context) getRequestID(L *lua.LState) int {
+	return util.Push(L, lua.LString(ctx.requestID))
+}
+
+// newRequestID returns a random version 4 UUID.
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	buf := make([]byte, 36)
+	hex.Encode(buf[0:8], b[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], b[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], b[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], b[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], b[10:])
+	return string(buf)
+}
+
+// validRequestID only accepts short, printable ids so clients cannot inject
+// arbitrary content into logs and response headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if c <= ' ' || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -6,33 +6,52 @@ import (
 	"net/http"
 	"path"
 	"regexp"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	lua "github.com/yuin/gopher-lua"
 )
 
-type Route struct {
-	host        string
-	pattern     string
-	methods     []string
-	rawPath     string
-	stripPath   string
-	stripPrefix string
-	paramName   string
-	paramNode   *Route
-	params      map[string]string
-	regex       *regexp.Regexp
-	handler     Handler
-	handlers    map[string]Handler
-	children    map[string]*Route
-	isWild      bool
-	isEnd       bool
-	mu          sync.RWMutex
-}
+type (
+	Route struct {
+		host        string
+		pattern     string
+		methods     []string
+		rawPath     string
+		stripPath   string
+		stripPrefix string
+		paramName   string
+		paramNode   *Route
+		params      map[string]string
+		regex       *regexp.Regexp
+		handler     Handler
+		handlers    map[string]Handler
+		defaults    map[string]bool
+		options     map[string]*RouteOptions
+		config      *RouteOptions
+		children    map[string]*Route
+		isWild      bool
+		isEnd       bool
+		mu          sync.RWMutex
+	}
+	// RouteOptions holds the settings registered along with a method handler
+	RouteOptions struct {
+		stripPrefix  string
+		recover      *lua.LFunction
+		maxBodySize  int64         // overrides the server limit, negative means unlimited
+		readTimeout  time.Duration // overrides the server readTimeout for this route
+		writeTimeout time.Duration // overrides the server writeTimeout for this route
+		server       *ServerConfig // config of the server or group the route was added to
+	}
+)
 
 var (
-	AllowMethods = []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodPost, http.MethodDelete}
+	AllowMethods = []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodPost, http.MethodDelete, http.MethodOptions}
+	// CONNECT and TRACE can be registered explicitly but are never implied by "*"
+	routeMethods = append([]string{http.MethodConnect, http.MethodTrace}, AllowMethods...)
 	regexCache   sync.Map
 	notFound     = "the requested path is not registered on the server"
 )
@@ -52,18 +71,29 @@ func NewRoute() *Route {
 	return &Route{
 		children: make(map[string]*Route),
 		handlers: make(map[string]Handler),
+		defaults: make(map[string]bool),
+		options:  make(map[string]*RouteOptions),
 	}
 }
 
 // add registers a route handler for the given method and pattern
 // Returns error for invalid inputs or route conflicts
-func (r *Route) Add(method, pattern, stripPrefix string, handler Handler) error {
+func (r *Route) Add(method, pattern string, opts *RouteOptions, handler Handler) error {
+	return r.add(method, pattern, opts, handler, false)
+}
+
+// AddDefault registers a handler only if the method has none yet. A later
+// Add for the same method replaces it instead of reporting a conflict.
+func (r *Route) AddDefault(method, pattern string, opts *RouteOptions, handler Handler) error {
+	return r.add(method, pattern, opts, handler, true)
+}
+
+func (r *Route) add(method, pattern string, opts *RouteOptions, handler Handler, isDefault bool) error {
 	if method == "" || pattern == "" || handler == nil {
 		return errors.New("http server Handle error")
 	}
 
-	allowMethods := strings.Join(AllowMethods, ",")
-	if method != "*" && !strings.Contains(allowMethods, method) {
+	if method != "*" && !slices.Contains(routeMethods, method) {
 		return fmt.Errorf("method not supported: %s", method)
 	}
 
@@ -72,11 +102,19 @@ func (r *Route) Add(method, pattern, stripPrefix string, handler Handler) error
 		return fmt.Errorf("parsing pattern %q: %w", pattern, err)
 	}
 
+	if opts == nil {
+		opts = &RouteOptions{}
+	}
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	current := r
+	var parent *Route // node before an optional last segment
 	for _, segment := range pat.segments {
+		if segment.optional {
+			parent = current
+		}
 		if segment.param {
 			if current.paramNode == nil {
 				paramNode := NewRoute()
@@ -98,26 +136,43 @@ func (r *Route) Add(method, pattern, stripPrefix string, handler Handler) error
 		}
 	}
 
-	if _, exists := current.handlers[method]; exists {
-		return fmt.Errorf("method conflict: %s %s", method, pattern)
+	nodes := []*Route{current}
+	if parent != nil {
+		nodes = append(nodes, parent)
+	}
+	for _, node := range nodes {
+		if _, exists := node.handlers[method]; exists && !isDefault && !node.defaults[method] {
+			return fmt.Errorf("method conflict: %s %s", method, pattern)
+		}
+	}
+	for _, node := range nodes {
+		if _, exists := node.handlers[method]; exists && isDefault {
+			continue
+		}
+		if node == current || !node.isEnd {
+			node.pattern = pattern
+		}
+		node.isEnd = true
+		node.host = pat.host
+		node.handlers[method] = handler
+		node.defaults[method] = isDefault
+		node.options[method] = opts
 	}
-
-	current.isEnd = true
-	current.host = pat.host
-	current.pattern = pattern
-	current.handlers[method] = handler
-	current.stripPrefix = stripPrefix
 
 	return nil
 }
 
 // find traverses the routing tree to match URL segments and collect parameters
-// Returns matched node or nil if no match found
+// Returns a per-request copy of the matched node, the shared tree is never mutated.
+// On 405 the copy has no handler but still carries the pattern and methods.
 func (r *Route) Find(req *http.Request) (*Route, int, error) {
+	return r.find(req.Method, req.Host, req.URL.Path)
+}
+
+func (r *Route) find(method, host, urlPath string) (*Route, int, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	urlPath, host, method := req.URL.Path, req.Host, req.Method
 	segments := strings.Split(urlPath, `/`)
 	params := make(map[string]string)
 	current := r
@@ -140,7 +195,7 @@ func (r *Route) Find(req *http.Request) (*Route, int, error) {
 		if paramNode := current.paramNode; paramNode != nil {
 			regex := paramNode.regex
 			if regex != nil && !regex.MatchString(segment) {
-				break
+				return nil, http.StatusNotFound, errors.New(notFound)
 			}
 
 			current = paramNode
@@ -166,41 +221,91 @@ func (r *Route) Find(req *http.Request) (*Route, int, error) {
 		return nil, http.StatusNotFound, err
 	}
 
-	handler := current.handlers[method]
-	if handler == nil {
-		if handler = current.handlers["*"]; handler == nil {
+	key := method
+	if current.handlers[key] == nil && method == http.MethodHead && current.handlers[http.MethodGet] != nil {
+		// HEAD runs the GET handler, net/http discards the body
+		key = http.MethodGet
+	}
+	if current.handlers[key] == nil {
+		if key = "*"; current.handlers[key] == nil {
 			err := fmt.Errorf("the requested HTTP method '%s' is not supported for this path", method)
-			return nil, http.StatusMethodNotAllowed, err
+			partial := &Route{
+				host:    current.host,
+				pattern: current.pattern,
+				methods: current.allowedMethods(),
+				params:  params,
+				config:  &RouteOptions{},
+			}
+			return partial, http.StatusMethodNotAllowed, err
 		}
 	}
+	opts := current.options[key]
+
+	match := &Route{
+		host:        current.host,
+		pattern:     current.pattern,
+		stripPrefix: opts.stripPrefix,
+		methods:     current.allowedMethods(),
+		params:      params,
+		handler:     current.handlers[key],
+		config:      opts,
+	}
+	return match, http.StatusOK, nil
+}
 
-	current.handler = handler
-	current.params = params
+// allowedMethods lists the methods registered on the node
+func (r *Route) allowedMethods() []string {
+	methods := make([]string, 0, len(r.handlers)+1)
+	for method := range r.handlers {
+		if method == "*" {
+			return AllowMethods
+		}
+		methods = append(methods, method)
+	}
+	if r.handlers[http.MethodGet] != nil && r.handlers[http.MethodHead] == nil {
+		methods = append(methods, http.MethodHead)
+	}
+	sort.Strings(methods)
+	return methods
+}
 
-	return current, http.StatusOK, nil
+// optionsHandler answers OPTIONS for routes that did not register one,
+// listing the methods of the matched path in the Allow header.
+func optionsHandler(L *lua.LState, ctx *Context) *HttpStatus {
+	ctx.Writer.ResponseWriter.Header().Set("Allow", strings.Join(ctx.Route.methods, ", "))
+	if err := ctx.SetStatus(http.StatusNoContent); err != nil {
+		return &HttpStatus{Code: http.StatusInternalServerError, Error: err}
+	}
+	return &HttpStatus{Code: http.StatusNoContent}
 }
 
 func (r *Route) ServeHTTP(L *lua.LState, ctx *Context) *HttpStatus {
 
 	route, statusCode, statusError := r.Find(ctx.Request)
 	if statusError != nil {
+		if route != nil {
+			// keep the attempted route for logging and error handlers
+			ctx.Route = route
+			ctx.Params = route.params
+			ctx.Writer.ResponseWriter.Header().Set("Allow", strings.Join(route.methods, ", "))
+		}
 		return &HttpStatus{Code: statusCode, Error: statusError}
 	}
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	methods := make([]string, 0)
-	for method := range route.handlers {
-		if method == "*" {
-			methods = AllowMethods
-			break
-		}
-		methods = append(methods, method)
+	if cfg := route.config.server; cfg != nil {
+		// locked, a timeout reads them from another goroutine
+		ctx.mu.Lock()
+		ctx.config = cfg
+		ctx.ErrorTemplate = cfg.errorTemplate
+		ctx.mu.Unlock()
 	}
-	route.methods = methods
 
 	urlPath := ctx.Request.URL.Path
+	if ctx.config != nil && ctx.config.redirectSlash {
+		if target, ok := canonicalSlash(urlPath, route.pattern); ok {
+			return redirectSlash(ctx, target)
+		}
+	}
 	route.rawPath = urlPath
 	prefix := route.stripPrefix
 
@@ -216,5 +321,61 @@ func (r *Route) ServeHTTP(L *lua.LState, ctx *Context) *HttpStatus {
 	ctx.Route = route
 	ctx.Params = route.params
 
-	return route.handler(L, ctx)
+	limit := route.config.maxBodySize
+	if limit == 0 && ctx.config != nil {
+		limit = ctx.config.maxBodySize
+	}
+	if limit > 0 {
+		ctx.Request.Body = http.MaxBytesReader(ctx.Writer.ResponseWriter, ctx.Request.Body, limit)
+	}
+
+	if route.config.readTimeout > 0 {
+		if err := ctx.SetReadDeadline(route.config.readTimeout); err != nil {
+			ctx.logError(L, fmt.Errorf("route %s: readTimeout: %w", route.pattern, err))
+		}
+	}
+	if route.config.writeTimeout > 0 {
+		if err := ctx.SetWriteDeadline(route.config.writeTimeout); err != nil {
+			ctx.logError(L, fmt.Errorf("route %s: writeTimeout: %w", route.pattern, err))
+		}
+	}
+
+	start := time.Now()
+	status := route.handler(L, ctx)
+	ctx.handlerTime = time.Since(start)
+	return status
+}
+
+// canonicalSlash returns the request path with its trailing slash matching the
+// registered pattern, and false if it already does. Wildcard routes accept both.
+func canonicalSlash(urlPath, pattern string) (string, bool) {
+	if urlPath == "/" || strings.HasSuffix(pattern, "...}") {
+		return "", false
+	}
+	want := strings.HasSuffix(pattern, "/")
+	if strings.HasSuffix(urlPath, "/") == want {
+		return "", false
+	}
+	// a single leading slash keeps "//host/" from becoming a foreign redirect
+	target := "/" + strings.Trim(urlPath, "/")
+	if want {
+		target += "/"
+	}
+	return target, true
+}
+
+// redirectSlash sends 301 for GET and HEAD and 308 otherwise so the method and
+// body survive the redirect.
+func redirectSlash(ctx *Context, target string) *HttpStatus {
+	code := http.StatusMovedPermanently
+	if method := ctx.Request.Method; method != http.MethodGet && method != http.MethodHead {
+		code = http.StatusPermanentRedirect
+	}
+	if query := ctx.Request.URL.RawQuery; query != "" {
+		target += "?" + query
+	}
+	if err := ctx.Redirect(target, code); err != nil {
+		return &HttpStatus{Code: http.StatusInternalServerError, Error: err}
+	}
+	return &HttpStatus{Code: code}
 }
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// secureHeader maps an option of secureHeaders to its header and default.
+type secureHeader struct {
+	option, header, value string
+}
+
+var defaultSecureHeaders = []secureHeader{
+	{"contentTypeOptions", "X-Content-Type-Options", "nosniff"},
+	{"frameOptions", "X-Frame-Options", "SAMEORIGIN"},
+	{"referrerPolicy", "Referrer-Policy", "strict-origin-when-cross-origin"},
+	{"hsts", "Strict-Transport-Security", "max-age=31536000; includeSubDomains"},
+	{"contentSecurityPolicy", "Content-Security-Policy", ""},
+}
+
+// SecureHeaders builds a middleware that sets common hardening headers, for
+// use with app.use. Each option replaces a header value, false drops it.
+// Content-Security-Policy is only sent when configured, HSTS only over https.
+func (s *Server) SecureHeaders(L *lua.LState) int {
+	headers := append([]secureHeader(nil), defaultSecureHeaders...)
+	lopt := L.OptTable(1, L.NewTable())
+
+	lopt.ForEach(func(k, v lua.LValue) {
+		key := k.String()
+		i := 0
+		for i < len(headers) && headers[i].option != key {
+			i++
+		}
+		if i == len(headers) {
+			L.ArgError(1, "unknown secureHeaders field: "+key)
+		}
+		switch val := v.(type) {
+		case lua.LString:
+			headers[i].value = string(val)
+		case lua.LBool:
+			if val {
+				L.ArgError(1, key+" must be a string or false")
+			}
+			headers[i].value = ""
+		default:
+			L.ArgError(1, key+" must be a string or false")
+		}
+	})
+
+	handler := func(L *lua.LState, ctx *Context) *HttpStatus {
+		header := ctx.Writer.ResponseWriter.Header()
+		for _, h := range headers {
+			if h.value == "" {
+				continue
+			}
+			if h.option == "hsts" && ctx.Request.TLS == nil && ctx.GetScheme() != "https" {
+				continue
+			}
+			header.Set(h.header, h.value)
+		}
+		return ctx.next(L, ctx)
+	}
+	return util.Push(L, &lua.LUserData{Value: Handler(handler)})
+}
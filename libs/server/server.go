@@ -5,13 +5,17 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"html/template"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,6 +23,8 @@ import (
 	"lug/util"
 
 	lua "github.com/yuin/gopher-lua"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/sync/semaphore"
 )
 
@@ -28,8 +34,13 @@ type (
 		prefix      string
 		route       *Route
 		middlewares []Handler
+		notFound    Handler
+		notAllowed  Handler
 		config      *ServerConfig
 		httpServer  *http.Server
+		redirector  *http.Server
+		stats       *serverStats
+		templates   *util.TemplateScope // parsed with the templateFuncs helpers
 		semaphore   *semaphore.Weighted
 		signalChan  chan os.Signal
 		signalOnce  sync.Once
@@ -38,21 +49,46 @@ type (
 		mu          sync.RWMutex
 	}
 	ServerConfig struct {
-		logLevel          string         // 日志等级
-		certFile          string         // 证书文件
-		keyFile           string         // 私钥文件
-		addr              string         // 监听地址
-		errorTemplate     string         // 错误模板
-		workers           int64          // 最大并发
-		readTimeout       time.Duration  // 读取超时
-		writeTimeout      time.Duration  // 写入超时
-		idleTimeout       time.Duration  // 空闲超时
-		processingTimeout time.Duration  // 处理超时
-		shutdownTimeout   time.Duration  // 关闭超时
-		onRequest         *lua.LFunction // 请求记录
-		onError           *lua.LFunction // 服务错误
-		onSuccess         *lua.LFunction // 服务成功
-		onShutdown        *lua.LFunction // 服务关闭
+		logLevel          string             // 日志等级
+		logFormat         string             // 日志格式
+		certFile          string             // 证书文件
+		keyFile           string             // 私钥文件
+		certPEM           string             // 证书内容
+		keyPEM            string             // 私钥内容
+		tlsMinVersion     uint16             // TLS 最低版本
+		tlsMaxVersion     uint16             // TLS 最高版本
+		tlsCipherSuites   []uint16           // TLS 加密套件
+		clientCAFile      string             // 客户端 CA 文件
+		clientAuth        tls.ClientAuthType // 客户端认证
+		addr              string             // 监听地址
+		errorTemplate     string             // 错误模板
+		cookieSecret      string             // Cookie 密钥
+		workers           int64              // 最大并发
+		compress          bool               // 响应压缩
+		http2             bool               // 启用 HTTP/2
+		h2c               bool               // 明文 HTTP/2
+		redirectHTTP      string             // HTTPS 跳转监听
+		redirectSlash     bool               // 斜杠重定向
+		compressMinSize   int                // 压缩阈值
+		maxBodySize       int64              // 请求体上限
+		maxFormSize       int64              // 表单上限
+		maxFormFields     int                // 表单字段数
+		readTimeout       time.Duration      // 读取超时
+		readHeaderTimeout time.Duration      // 请求头超时
+		writeTimeout      time.Duration      // 写入超时
+		idleTimeout       time.Duration      // 空闲超时
+		processingTimeout time.Duration      // 处理超时
+		queueTimeout      time.Duration      // 排队超时
+		shutdownTimeout   time.Duration      // 关闭超时
+		templateFuncs     *lua.LTable        // 模板函数
+		trustedProxies    []*net.IPNet       // 可信代理
+		onRequest         *lua.LFunction     // 请求记录
+		onLog             *lua.LFunction     // 处理器日志
+		onError           *lua.LFunction     // 服务错误
+		onSuccess         *lua.LFunction     // 服务成功
+		onShutdown        *lua.LFunction     // 服务关闭
+		onTimeout         *lua.LFunction     // 处理超时
+		onPanic           *lua.LFunction     // 处理崩溃
 	}
 )
 
@@ -69,6 +105,7 @@ func extendMethod(s *Server) util.Methods {
 		"post":    s.handle(http.MethodPost),
 		"put":     s.handle(http.MethodPut),
 		"trace":   s.handle(http.MethodTrace),
+		"static":  s.Static,
 	}
 }
 
@@ -79,9 +116,16 @@ func Loader(L *lua.LState) int {
 func newServer(L *lua.LState) int {
 	cfg := &ServerConfig{
 		logLevel:          "info",
+		logFormat:         "text",
 		addr:              ":3000",
 		workers:           100,
+		compressMinSize:   1024,
+		http2:             true,
+		tlsMinVersion:     tls.VersionTLS12,
+		maxFormSize:       10 << 20,
+		maxFormFields:     1000,
 		readTimeout:       15 * time.Second,
+		readHeaderTimeout: 10 * time.Second,
 		writeTimeout:      30 * time.Second,
 		idleTimeout:       120 * time.Second,
 		processingTimeout: 30 * time.Second,
@@ -97,30 +141,89 @@ func newServer(L *lua.LState) int {
 		route:      NewRoute(),
 		config:     cfg,
 		semaphore:  semaphore.NewWeighted(cfg.workers),
+		stats:      &serverStats{},
 		signalChan: make(chan os.Signal, 1),
 		vm:         L,
 	}
 	instance.initSignalHandling()
+	instance.templates = util.NewTemplateScope(instance.templateHelpers(nil))
 
 	methods := extendMethod(instance)
 	api := util.SetMethods(L, methods, util.Methods{
-		"group":    instance.Group,
-		"listen":   instance.Listen,
-		"shutdown": instance.Shutdown,
+		"group":            instance.Group,
+		"match":            instance.Match,
+		"rateLimit":        instance.RateLimit,
+		"requestId":        instance.RequestID,
+		"basicAuth":        instance.BasicAuth,
+		"notFound":         instance.NotFound,
+		"methodNotAllowed": instance.MethodNotAllowed,
+		"jwt":              instance.JWT,
+		"secureHeaders":    instance.SecureHeaders,
+		"templates":        instance.Templates,
+		"stats":            instance.Stats,
+		"test":             instance.Test,
+		"listen":           instance.Listen,
+		"shutdown":         instance.Shutdown,
 	})
 	instance.api = api
 	return util.Push(L, api)
 }
 
+// shutdownRequest is queued on signalChan by app.shutdown.
+type shutdownRequest struct{}
+
+func (shutdownRequest) String() string { return "shutdown" }
+func (shutdownRequest) Signal()        {}
+
 func (s *Server) initSignalHandling() {
 	s.signalOnce.Do(func() {
 		signal.Notify(s.signalChan, os.Interrupt, syscall.SIGTERM)
 	})
 }
 
+// templateHelpers makes the Lua functions from the templateFuncs config
+// callable from templates. They run on L, the state of the handler that
+// executes the template, or on a VM taken from the pool when L is nil.
+func (s *Server) templateHelpers(L *lua.LState) template.FuncMap {
+	funcs := template.FuncMap{}
+	if s.config.templateFuncs == nil {
+		return funcs
+	}
+	s.config.templateFuncs.ForEach(func(name, lv lua.LValue) {
+		fn := lv.(*lua.LFunction)
+		funcs[name.String()] = func(args ...interface{}) (interface{}, error) {
+			vm := L
+			if vm == nil {
+				vm = util.VmPool.Clone(s.vm)
+				defer util.VmPool.Put(vm)
+			}
+			top := vm.GetTop()
+			defer vm.SetTop(top)
+
+			largs := make([]lua.LValue, len(args))
+			for i, arg := range args {
+				largs[i] = util.ToLuaValue(arg)
+			}
+			if err := util.CallLua(vm, fn, largs...); err != nil {
+				return nil, err
+			}
+			if vm.GetTop() == top {
+				return nil, nil
+			}
+			return util.ToGoValue(vm.Get(top+1), true), nil
+		}
+	})
+	return funcs
+}
+
 // creates a new route group with a common prefix and inherits middlewares.
+// An optional table overrides server settings for the group's routes only.
 func (s *Server) Group(L *lua.LState) int {
 	pattern := L.CheckString(1)
+	cfg := s.config
+	if L.GetTop() >= 2 {
+		cfg = getGroupConfig(L, L.CheckTable(2), s.config)
+	}
 	s.mu.Lock()
 	middlewares := append([]Handler{}, s.middlewares...)
 	s.mu.Unlock()
@@ -128,12 +231,36 @@ func (s *Server) Group(L *lua.LState) int {
 		prefix:      s.pathJoin(pattern),
 		route:       s.route,
 		middlewares: middlewares,
-		config:      s.config,
+		config:      cfg,
 	}
 	group.api = util.SetMethods(L, extendMethod(group))
 	return util.Push(L, group.api)
 }
 
+// Match runs route matching for a synthetic request without executing the handler.
+func (s *Server) Match(L *lua.LState) int {
+	method := strings.ToUpper(L.CheckString(1))
+	urlPath, host := L.CheckString(2), L.OptString(3, "")
+
+	route, _, err := s.route.find(method, host, urlPath)
+	if err != nil {
+		return util.NilError(L, err)
+	}
+
+	params := L.NewTable()
+	for k, v := range route.params {
+		params.RawSetString(k, lua.LString(v))
+	}
+	match := util.SetMethods(L, util.Methods{
+		"host":        lua.LString(route.host),
+		"pattern":     lua.LString(route.pattern),
+		"stripPrefix": lua.LString(route.stripPrefix),
+		"methods":     route.methods,
+		"params":      params,
+	})
+	return util.Push(L, match)
+}
+
 // Use adds middleware handlers to the server.
 func (s *Server) Use(L *lua.LState) int {
 	n := L.GetTop()
@@ -142,8 +269,19 @@ func (s *Server) Use(L *lua.LState) int {
 	}
 	middlewares := make([]Handler, 0, n)
 	for i := 1; i <= n; i++ {
-		middleware := s.luaHandler(L.CheckFunction(i), true)
-		middlewares = append(middlewares, middleware)
+		switch v := L.CheckAny(i).(type) {
+		case *lua.LFunction:
+			middlewares = append(middlewares, s.luaHandler(v, true))
+		case *lua.LUserData:
+			// built-in middlewares such as rateLimit are Go handlers
+			middleware, ok := v.Value.(Handler)
+			if !ok {
+				L.ArgError(i, "userdata is not a middleware")
+			}
+			middlewares = append(middlewares, middleware)
+		default:
+			L.ArgError(i, "middleware must be a function")
+		}
 	}
 	s.mu.Lock()
 	s.middlewares = append(s.middlewares, middlewares...)
@@ -151,28 +289,59 @@ func (s *Server) Use(L *lua.LState) int {
 	return util.Push(L, s.api)
 }
 
+// NotFound registers the handler run for requests that match no route.
+func (s *Server) NotFound(L *lua.LState) int {
+	handler := s.applyMiddleware(s.luaHandler(L.CheckFunction(1), false))
+	s.mu.Lock()
+	s.notFound = handler
+	s.mu.Unlock()
+	return util.Push(L, s.api)
+}
+
+// MethodNotAllowed registers the handler run for requests whose path matches
+// a route that does not accept the method.
+func (s *Server) MethodNotAllowed(L *lua.LState) int {
+	handler := s.applyMiddleware(s.luaHandler(L.CheckFunction(1), false))
+	s.mu.Lock()
+	s.notAllowed = handler
+	s.mu.Unlock()
+	return util.Push(L, s.api)
+}
+
 // registers a handler for a specific HTTP method and path.
 func (s *Server) handle(method string) lua.LGFunction {
 	method = strings.ToUpper(method)
 	return func(L *lua.LState) int {
 		path := s.pathJoin(L.CheckString(1))
-		var stripPrefix string
+		opts := &RouteOptions{}
 		var handler *lua.LFunction
 
 		switch v := L.CheckAny(2).(type) {
 		case *lua.LFunction:
 			handler = v
 		case lua.LString:
-			stripPrefix = v.String()
+			opts.stripPrefix = v.String()
+			handler = L.CheckFunction(3)
+		case *lua.LTable:
+			opts = getRouteOptions(L, v)
 			handler = L.CheckFunction(3)
 		default:
-			L.ArgError(2, "must be a string or function")
+			L.ArgError(2, "must be a string, table or function")
 		}
 
+		opts.server = s.config
 		fn := s.applyMiddleware(s.luaHandler(handler, false))
-		if err := s.route.Add(method, path, stripPrefix, fn); err != nil {
+		if err := s.route.Add(method, path, opts, fn); err != nil {
 			L.RaiseError("failed to add route: %v", err)
 		}
+		// answer OPTIONS through the same middlewares, so CORS preflights work
+		if method != "*" && method != http.MethodOptions {
+			options := s.applyMiddleware(optionsHandler)
+			defaults := &RouteOptions{server: s.config}
+			if err := s.route.AddDefault(http.MethodOptions, path, defaults, options); err != nil {
+				L.RaiseError("failed to add route: %v", err)
+			}
+		}
 		return util.Push(L, s.api)
 	}
 }
@@ -214,65 +383,244 @@ func (s *Server) applyMiddleware(handler Handler) Handler {
 	return handler
 }
 
-// listen starts the HTTP server on the specified address.
+// listen starts the HTTP server on the given addresses. Every address gets
+// its own listener, they share the handler and are shut down together.
 func (s *Server) Listen(L *lua.LState) int {
 
-	addr := s.config.addr
-	if L.GetTop() > 0 {
-		addr = L.CheckString(1)
-		s.config.addr = addr
+	addrs := []string{s.config.addr}
+	if top := L.GetTop(); top > 0 {
+		addrs = make([]string, top)
+		for i := range addrs {
+			addrs[i] = L.CheckString(i + 1)
+		}
+		s.config.addr = strings.Join(addrs, ", ")
 	}
 
-	// start creates the listener and starts serving HTTP requests.
-	listener, err := s.getListener(addr)
-	if err != nil {
+	// start creates the listeners and starts serving HTTP requests.
+	listeners := make([]net.Listener, 0, len(addrs))
+	httpsPort := 0
+	for _, addr := range addrs {
+		listener, useTLS, err := s.getListener(addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			err = fmt.Errorf("server start error: %w", err)
+			s.logger(L, "error", err)
+			return util.Error(L, err)
+		}
+		if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok && useTLS && httpsPort == 0 {
+			httpsPort = tcpAddr.Port
+		}
+		listeners = append(listeners, listener)
+	}
+	if s.config.redirectHTTP != "" {
+		err := errors.New("redirectHTTP needs a TLS listener")
+		if httpsPort != 0 {
+			err = s.startRedirector(L, s.config.redirectHTTP, httpsPort)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			err = fmt.Errorf("server start error: %w", err)
+			s.logger(L, "error", err)
+			return util.Error(L, err)
+		}
+	}
+
+	s.httpServer = &http.Server{
+		Handler:           s,
+		Addr:              addrs[0],
+		ReadTimeout:       s.config.readTimeout,
+		ReadHeaderTimeout: s.config.readHeaderTimeout,
+		WriteTimeout:      s.config.writeTimeout,
+		IdleTimeout:       s.config.idleTimeout,
+		ConnState:         s.stats.trackConn,
+	}
+	if err := s.configureHTTP2(s.httpServer); err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		if s.redirector != nil {
+			s.redirector.Close()
+		}
 		err = fmt.Errorf("server start error: %w", err)
 		s.logger(L, "error", err)
 		return util.Error(L, err)
 	}
 
-	s.httpServer = &http.Server{
-		Handler:      s,
-		Addr:         addr,
-		ReadTimeout:  s.config.readTimeout,
-		WriteTimeout: s.config.writeTimeout,
-		IdleTimeout:  s.config.idleTimeout,
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			err := s.httpServer.Serve(listener)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				s.logger(L, "error", fmt.Errorf("server start error: %w", err))
+			}
+		}(listener)
 	}
 
+	s.logger(L, "success", fmt.Sprintf("server started on %v", s.config.addr))
+
+	// keep the server running until shutdown, Ctrl-C stops the server rather
+	// than interrupting the script
+	release := util.ClaimInterrupts()
+	defer release()
+	sig := <-s.signalChan
+	if _, ok := sig.(shutdownRequest); ok {
+		s.shutdown(L, "")
+	} else {
+		s.shutdown(L, sig.String())
+	}
+	return 0
+}
+
+// startRedirector serves addr with a plain HTTP server that sends every
+// request to the same host and path over https on the given port.
+func (s *Server) startRedirector(L *lua.LState, addr string, httpsPort int) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.redirector = &http.Server{
+		Handler:           http.HandlerFunc(httpsRedirect(httpsPort)),
+		ReadTimeout:       s.config.readTimeout,
+		ReadHeaderTimeout: s.config.readHeaderTimeout,
+		WriteTimeout:      s.config.writeTimeout,
+		IdleTimeout:       s.config.idleTimeout,
+	}
 	go func() {
-		err := s.httpServer.Serve(listener)
+		err := s.redirector.Serve(listener)
 		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			s.logger(L, "error", fmt.Errorf("server start error: %w", err))
+			s.logger(L, "error", fmt.Errorf("redirect server error: %w", err))
 		}
 	}()
+	return nil
+}
 
-	s.logger(L, "success", fmt.Sprintf("server started on %v", addr))
+func httpsRedirect(port int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			// an IPv6 literal without a port keeps its brackets
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	}
+}
 
-	// keep the server running until shutdown
-	sig := <-s.signalChan
-	s.shutdown(L, sig.String())
-	return 0
+// creates a net.Listener based on the server configuration (HTTP or HTTPS)
+// and reports whether it speaks TLS.
+func (s *Server) getListener(addr string) (net.Listener, bool, error) {
+	network := "tcp"
+	if socket, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", socket
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// http:// and https:// pick the protocol of one listener, a bare
+	// host:port uses TLS whenever a certificate is configured.
+	useTLS := s.config.useTLS()
+	if scheme, hostport, ok := strings.Cut(addr, "://"); ok && network == "tcp" {
+		switch scheme {
+		case "http":
+			addr, useTLS = hostport, false
+		case "https":
+			if !useTLS {
+				return nil, false, fmt.Errorf("%s needs certFile/keyFile or certPEM/keyPEM", addr)
+			}
+			addr = hostport
+		default:
+			return nil, false, fmt.Errorf("unsupported listen address scheme %q, use host:port, http://, https:// or unix:/path", scheme)
+		}
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, false, err
+	}
+	if network == "unix" {
+		// let a front proxy running as another user connect
+		if err := os.Chmod(addr, 0o666); err != nil {
+			listener.Close()
+			return nil, false, err
+		}
+	}
+
+	if !useTLS {
+		return listener, false, nil
+	}
+	config, err := s.tlsConfig()
+	if err != nil {
+		listener.Close()
+		return nil, false, err
+	}
+	return tls.NewListener(listener, config), true, nil
 }
 
-// creates a net.Listener based on the server configuration (HTTP or HTTPS).
-func (s *Server) getListener(addr string) (net.Listener, error) {
-	if s.config.certFile == "" || s.config.keyFile == "" {
-		return net.Listen("tcp", addr)
+// configureHTTP2 sets up HTTP/2 for TLS listeners, negotiated through ALPN,
+// and with h2c also for cleartext connections, which is what gRPC-web
+// backends behind a TLS terminating proxy expect.
+func (s *Server) configureHTTP2(srv *http.Server) error {
+	if !s.config.http2 {
+		// a non-nil empty map keeps net/http from enabling HTTP/2 itself
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return nil
+	}
+	h2s := &http2.Server{IdleTimeout: s.config.idleTimeout}
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return fmt.Errorf("http2: %w", err)
+	}
+	if s.config.h2c {
+		// TLS connections negotiate HTTP/2 themselves, h2c is for the others
+		handler, h2cHandler := srv.Handler, h2c.NewHandler(srv.Handler, h2s)
+		srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			h2cHandler.ServeHTTP(w, r)
+		})
+	}
+	return nil
+}
+
+// removeStaleSocket deletes a socket file left behind by a previous process,
+// but refuses to touch regular files or sockets that still accept connections.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
 	}
-	cert, err := tls.LoadX509KeyPair(s.config.certFile, s.config.keyFile)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	config := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12,
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
 	}
-	return tls.Listen("tcp", addr, config)
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	return os.Remove(path)
 }
 
 // Shutdown initiates the graceful shutdown of the server from Lua.
 func (s *Server) Shutdown(L *lua.LState) int {
-	s.shutdown(L, "")
+	// Hand the shutdown to the listen loop: draining from inside a handler
+	// would wait on the very request that asked for it.
+	select {
+	case s.signalChan <- shutdownRequest{}:
+	default:
+	}
 	return 0
 }
 
@@ -286,17 +634,24 @@ func (s *Server) shutdown(L *lua.LState, sig string) {
 	ctx, cancel := context.WithTimeout(context.Background(), s.config.shutdownTimeout)
 	defer cancel()
 
-	s.httpServer.SetKeepAlivesEnabled(false)
-	if err := s.httpServer.Close(); err != nil {
-		s.logger(L, "error", fmt.Sprintf("server closed error: %v", err))
-		return
+	if n := s.stats.inFlight.Load(); n > 0 {
+		s.logger(L, "shutdown", fmt.Sprintf("draining %d active requests", n))
 	}
 
+	// Shutdown stops accepting connections and waits for in-flight handlers;
+	// connections still busy when shutdownTimeout expires are closed forcibly.
+	if s.redirector != nil {
+		s.redirector.Close()
+	}
+	s.httpServer.SetKeepAlivesEnabled(false)
 	if err := s.httpServer.Shutdown(ctx); err != nil {
-		s.logger(L, "error", fmt.Sprintf("server shutdown error: %v", err))
-	} else {
-		s.logger(L, "shutdown", "server stopped gracefully")
+		s.logger(L, "error", fmt.Errorf("server shutdown error: %w", err))
+		if err := s.httpServer.Close(); err != nil {
+			s.logger(L, "error", fmt.Errorf("server closed error: %w", err))
+		}
+		return
 	}
+	s.logger(L, "shutdown", "server stopped gracefully")
 }
 
 func (s *Server) responseLog(L *lua.LState, ctx *Context, statusCode int, err error) {
@@ -317,55 +672,320 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html;charset=utf-8")
 	w.Header().Set("Server", pkg.Name+"/"+pkg.Version)
 
+	s.stats.requests.Add(1)
+	s.stats.inFlight.Add(1)
+	defer s.stats.inFlight.Add(-1)
+
+	if s.config.compress {
+		if cw, ok := newCompressWriter(w, r, s.config.compressMinSize); ok {
+			defer cw.Close()
+			w = cw
+		}
+	}
+
 	ctx := newContext(w, r)
-	defer ctx.Release()
 	ctx.ErrorTemplate = s.config.errorTemplate
+	ctx.config = s.config
+	ctx.server = s
+
+	// After a timeout the handler goroutine outlives this call and still
+	// uses ctx, so whichever side finishes last returns it to the pool.
+	var owners atomic.Int32
+	owners.Store(2)
+	release := func() {
+		if owners.Add(-1) == 0 {
+			ctx.Release()
+		}
+	}
+	defer release()
 
-	// Request timeout context
+	// Request timeout context, routes and handlers that raise their
+	// connection deadlines push it out through ctx.extend
 	timeout := s.config.processingTimeout
-	timeoutCtx, cancel := context.WithTimeout(r.Context(), timeout)
+	deadline := time.Now().Add(timeout)
+	timeoutCtx, cancel := context.WithCancel(r.Context())
 	defer cancel()
+	timer := time.AfterFunc(timeout, cancel)
+	defer timer.Stop()
+	var extendMu sync.Mutex
+	ctx.extend = func(d time.Duration) {
+		extendMu.Lock()
+		defer extendMu.Unlock()
+		if until := time.Now().Add(d); until.After(deadline) && timer.Stop() {
+			deadline = until
+			timer.Reset(d)
+		}
+	}
+	// A connection taken over by the handler, such as a websocket, is no
+	// longer bound by processingTimeout and gives its worker back.
+	var freeWorker func()
+	ctx.detach = func() {
+		extendMu.Lock()
+		timer.Stop()
+		extendMu.Unlock()
+		if freeWorker != nil {
+			freeWorker()
+		}
+	}
 
 	// Execute handler asynchronously
 	responseDone := make(chan *HttpStatus, 1)
+	var acquired atomic.Bool
 
 	go func() {
+		defer release()
 		defer func() {
 			if rec := recover(); rec != nil {
-				err := fmt.Errorf("panic recovered: %v", rec)
-				responseDone <- &HttpStatus{
-					Code:  http.StatusInternalServerError,
-					Error: err,
-				}
+				responseDone <- s.recoverPanic(ctx, rec, debug.Stack())
 			}
 		}()
 
-		// Acquire semaphore for concurrency control
-		if err := s.semaphore.Acquire(timeoutCtx, 1); err != nil {
+		// Acquire semaphore for concurrency control, waiting at most
+		// queueTimeout for a free worker before rejecting the request
+		queueCtx := timeoutCtx
+		if s.config.queueTimeout > 0 {
+			var queueCancel context.CancelFunc
+			queueCtx, queueCancel = context.WithTimeout(timeoutCtx, s.config.queueTimeout)
+			defer queueCancel()
+		}
+		s.stats.queued.Add(1)
+		err := s.semaphore.Acquire(queueCtx, 1)
+		s.stats.queued.Add(-1)
+		if err != nil {
+			s.stats.rejected.Add(1)
 			responseDone <- &HttpStatus{
 				Code:  http.StatusServiceUnavailable,
 				Error: fmt.Errorf("concurrency limit: %w", err),
 			}
 			return
 		}
-		defer s.semaphore.Release(1)
+		acquired.Store(true)
+		s.stats.busy.Add(1)
+		freeWorker = sync.OnceFunc(func() {
+			s.stats.busy.Add(-1)
+			s.semaphore.Release(1)
+		})
+		defer freeWorker()
 
 		vm := util.VmPool.Clone(s.vm)
 		defer util.VmPool.Put(vm)
 
-		responseDone <- s.route.ServeHTTP(vm, ctx)
+		responseDone <- s.serveRoute(vm, ctx)
 	}()
 
 	select {
 	case status := <-responseDone:
 		s.responseLog(s.vm, ctx, status.Code, status.Error)
 	case <-timeoutCtx.Done():
-		ctx.Writer.TimedOut = true
-		err := errors.New("request processing timeout")
-		s.responseLog(s.vm, ctx, http.StatusRequestTimeout, err)
+		s.timeout(w, ctx, !acquired.Load())
 	}
 }
 
+// recoverPanic turns a handler panic into a 500. onPanic gets the ctx, the
+// panic value and the stack and may send its own response, without it the
+// stack goes to the server logger and so to onError.
+func (s *Server) recoverPanic(ctx *Context, rec interface{}, stack []byte) *HttpStatus {
+	err := fmt.Errorf("panic recovered: %v", rec)
+	if s.config.onPanic == nil {
+		s.logger(s.vm, "error", fmt.Errorf("%w\n%s", err, stack))
+		return &HttpStatus{Code: http.StatusInternalServerError, Error: err}
+	}
+
+	s.mu.Lock()
+	e := util.CallLua(s.vm, s.config.onPanic, ctx.luaContext(s.vm), lua.LString(fmt.Sprint(rec)), lua.LString(stack))
+	s.mu.Unlock()
+	if e != nil {
+		err = fmt.Errorf("%w (onPanic failed: %v)", err, e)
+	}
+	return &HttpStatus{Code: http.StatusInternalServerError, Error: err}
+}
+
+// timeout answers a request whose handler did not finish in time: 503 if it
+// was still waiting for a worker, 408 otherwise. The handler keeps running
+// but can no longer write, the response goes out through a fresh context
+// that onTimeout may use to send its own reply.
+func (s *Server) timeout(w http.ResponseWriter, ctx *Context, queued bool) {
+	code, err := http.StatusRequestTimeout, errors.New("request processing timeout")
+	if queued {
+		code, err = http.StatusServiceUnavailable, errors.New("no free worker within processingTimeout")
+	}
+	unwritten := ctx.Writer.timeout()
+
+	tctx := newContext(w, ctx.Request)
+	defer tctx.Release()
+	tctx.startTime = ctx.startTime
+	ctx.mu.RLock()
+	tctx.requestID = ctx.requestID
+	tctx.ErrorTemplate = ctx.ErrorTemplate
+	tctx.config = ctx.config
+	ctx.mu.RUnlock()
+	if !unwritten {
+		// The handler already started the response, it can only be logged.
+		tctx.Status.Code, tctx.Status.Text = code, http.StatusText(code)
+		tctx.Writer.written, tctx.Writer.sent = true, true
+	}
+
+	if s.config.onTimeout != nil {
+		s.mu.Lock()
+		e := util.CallLua(s.vm, s.config.onTimeout, tctx.luaContext(s.vm), lua.LNumber(code))
+		s.mu.Unlock()
+		if e != nil {
+			s.logger(s.vm, "error", fmt.Errorf("onTimeout: %w", e))
+		}
+	}
+
+	if tctx.Writer.written {
+		tctx.Status.Error = err
+		s.logger(s.vm, "request", tctx)
+		return
+	}
+	s.responseLog(s.vm, tctx, code, err)
+}
+
+// serveMiss runs the notFound or methodNotAllowed handler for a request no
+// route accepted. The status is preset, so handlers only write the body. The
+// default error page is sent when no handler is set or it writes nothing.
+func (s *Server) serveMiss(L *lua.LState, ctx *Context, miss *HttpStatus) *HttpStatus {
+	s.mu.RLock()
+	handler := s.notFound
+	if miss.Code == http.StatusMethodNotAllowed {
+		handler = s.notAllowed
+	}
+	s.mu.RUnlock()
+	if handler == nil {
+		return miss
+	}
+
+	ctx.Writer.statusCode = miss.Code
+	ctx.Status.Code = miss.Code
+	ctx.Status.Text = http.StatusText(miss.Code)
+	status := handler(L, ctx)
+	if status.Error != nil {
+		return status
+	}
+	if !ctx.Writer.written {
+		return miss
+	}
+	return &HttpStatus{Code: ctx.Writer.statusCode}
+}
+
+// serveRoute runs the matched route, handing handler errors and panics to the
+// route's recover callback. Routes without one fall through to the global recover.
+func (s *Server) serveRoute(L *lua.LState, ctx *Context) (status *HttpStatus) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			if ctx.Route == nil || ctx.Route.config.recover == nil {
+				panic(rec)
+			}
+			status = s.recoverRoute(L, ctx, lua.LString(fmt.Sprint(rec)), fmt.Errorf("panic recovered: %v", rec))
+		}
+	}()
+
+	status = s.route.ServeHTTP(L, ctx)
+	if ctx.Route == nil || ctx.Route.handler == nil {
+		status = s.serveMiss(L, ctx, status)
+	}
+	if status.Error != nil && ctx.Route != nil && ctx.Route.config.recover != nil {
+		var value lua.LValue = lua.LString(status.Error.Error())
+		var apiErr *lua.ApiError
+		if errors.As(status.Error, &apiErr) {
+			value = apiErr.Object
+		}
+		status = s.recoverRoute(L, ctx, value, status.Error)
+	}
+	return status
+}
+
+// recoverRoute calls the route's recover callback with the error value and ctx.
+// The default error page is only written if the callback sent no response.
+func (s *Server) recoverRoute(L *lua.LState, ctx *Context, value lua.LValue, err error) *HttpStatus {
+	if e := util.CallLua(L, ctx.Route.config.recover, value, ctx.luaContext(L)); e != nil {
+		err = fmt.Errorf("%w (recover failed: %v)", err, e)
+	}
+	return &HttpStatus{Code: http.StatusInternalServerError, Error: err}
+}
+
+// parseTrustedProxies accepts CIDR ranges as well as single addresses.
+func parseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0, len(list))
+	for _, item := range list {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", item)
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
+// parses the per-route options table passed before the handler.
+func getRouteOptions(L *lua.LState, opts *lua.LTable) *RouteOptions {
+	cfg := &RouteOptions{}
+	opts.ForEach(func(k lua.LValue, v lua.LValue) {
+		key := k.String()
+		switch key {
+		case "stripPrefix":
+			if val, ok := util.CheckString(L, key, v); ok {
+				cfg.stripPrefix = val
+			}
+		case "recover":
+			if val, ok := util.CheckFunction(L, key, v); ok {
+				cfg.recover = val
+			}
+		case "maxBodySize":
+			if val, ok := util.CheckInt64(L, key, v); ok {
+				cfg.maxBodySize = val
+			}
+		case "readTimeout":
+			if val, ok := util.CheckDuration(L, key, v); ok {
+				cfg.readTimeout = val
+			}
+		case "writeTimeout":
+			if val, ok := util.CheckDuration(L, key, v); ok {
+				cfg.writeTimeout = val
+			}
+		default:
+			L.ArgError(2, "unknown route field: "+key)
+		}
+	})
+	return cfg
+}
+
+// groupConfigFields are the settings that apply per matched route; listener,
+// worker and logging options belong to the server as a whole.
+var groupConfigFields = map[string]bool{
+	"errorTemplate":         true,
+	"cookieSecret":          true,
+	"maxBodySize":           true,
+	"maxFormSize":           true,
+	"maxFormFields":         true,
+	"redirectTrailingSlash": true,
+	"trustedProxies":        true,
+}
+
+// copies the parent config and applies the group overrides to it.
+func getGroupConfig(L *lua.LState, opts *lua.LTable, parent *ServerConfig) *ServerConfig {
+	opts.ForEach(func(k lua.LValue, _ lua.LValue) {
+		if key := k.String(); !groupConfigFields[key] {
+			L.ArgError(2, "unknown group field: "+key)
+		}
+	})
+	cfg := *parent
+	return getServerConfig(L, opts, &cfg)
+}
+
 // joins server prefix with the given pattern.
 func (s *Server) pathJoin(pattern string) string {
 	if pattern == "" {
@@ -380,6 +1000,7 @@ func (s *Server) pathJoin(pattern string) string {
 
 // parses the server configuration from a Lua table.
 func getServerConfig(L *lua.LState, opts *lua.LTable, cfg *ServerConfig) *ServerConfig {
+	clientAuthSet := false
 	opts.ForEach(func(k lua.LValue, v lua.LValue) {
 		key := k.String()
 		switch key {
@@ -387,6 +1008,15 @@ func getServerConfig(L *lua.LState, opts *lua.LTable, cfg *ServerConfig) *Server
 			if val, ok := util.CheckString(L, key, v); ok {
 				cfg.logLevel = val
 			}
+		case "logFormat":
+			if val, ok := util.CheckString(L, key, v); ok {
+				switch val {
+				case "text", "common", "combined", "json":
+					cfg.logFormat = val
+				default:
+					L.ArgError(1, "logFormat must be text, common, combined or json")
+				}
+			}
 		case "certFile":
 			if val, ok := util.CheckString(L, key, v); ok {
 				cfg.certFile = val
@@ -395,6 +1025,60 @@ func getServerConfig(L *lua.LState, opts *lua.LTable, cfg *ServerConfig) *Server
 			if val, ok := util.CheckString(L, key, v); ok {
 				cfg.keyFile = val
 			}
+		case "certPEM":
+			if val, ok := util.CheckString(L, key, v); ok {
+				cfg.certPEM = val
+			}
+		case "keyPEM":
+			if val, ok := util.CheckString(L, key, v); ok {
+				cfg.keyPEM = val
+			}
+		case "cookieSecret":
+			if val, ok := util.CheckString(L, key, v); ok {
+				cfg.cookieSecret = val
+			}
+		case "templateFuncs":
+			funcs, ok := v.(*lua.LTable)
+			if !ok {
+				L.ArgError(1, "templateFuncs must be a table")
+			}
+			funcs.ForEach(func(name, fn lua.LValue) {
+				util.CheckFunction(L, key+"."+name.String(), fn)
+			})
+			cfg.templateFuncs = funcs
+		case "tlsMinVersion":
+			if val, ok := util.CheckString(L, key, v); ok {
+				cfg.tlsMinVersion = checkTLSVersion(L, key, val)
+			}
+		case "tlsMaxVersion":
+			if val, ok := util.CheckString(L, key, v); ok {
+				cfg.tlsMaxVersion = checkTLSVersion(L, key, val)
+			}
+		case "tlsCipherSuites":
+			if val, ok := util.CheckTable(L, key, v); ok {
+				suites, err := parseCipherSuites(val)
+				if err != nil {
+					L.ArgError(1, err.Error())
+				}
+				cfg.tlsCipherSuites = suites
+			}
+		case "clientCAFile":
+			if val, ok := util.CheckString(L, key, v); ok {
+				cfg.clientCAFile = val
+			}
+		case "clientAuth":
+			if val, ok := util.CheckString(L, key, v); ok {
+				cfg.clientAuth = checkClientAuth(L, key, val)
+				clientAuthSet = true
+			}
+		case "trustedProxies":
+			if val, ok := util.CheckTable(L, key, v); ok {
+				proxies, err := parseTrustedProxies(val)
+				if err != nil {
+					L.ArgError(1, err.Error())
+				}
+				cfg.trustedProxies = proxies
+			}
 		case "readTimeout":
 			if val, ok := util.CheckDuration(L, key, v); ok {
 				cfg.readTimeout = val
@@ -403,6 +1087,10 @@ func getServerConfig(L *lua.LState, opts *lua.LTable, cfg *ServerConfig) *Server
 			if val, ok := util.CheckDuration(L, key, v); ok {
 				cfg.writeTimeout = val
 			}
+		case "readHeaderTimeout":
+			if val, ok := util.CheckDuration(L, key, v); ok {
+				cfg.readHeaderTimeout = val
+			}
 		case "idleTimeout":
 			if val, ok := util.CheckDuration(L, key, v); ok {
 				cfg.idleTimeout = val
@@ -411,6 +1099,10 @@ func getServerConfig(L *lua.LState, opts *lua.LTable, cfg *ServerConfig) *Server
 			if val, ok := util.CheckDuration(L, key, v); ok {
 				cfg.processingTimeout = val
 			}
+		case "queueTimeout":
+			if val, ok := util.CheckDuration(L, key, v); ok {
+				cfg.queueTimeout = val
+			}
 		case "shutdownTimeout":
 			if val, ok := util.CheckDuration(L, key, v); ok {
 				cfg.shutdownTimeout = val
@@ -419,10 +1111,58 @@ func getServerConfig(L *lua.LState, opts *lua.LTable, cfg *ServerConfig) *Server
 			if val, ok := util.CheckInt64(L, key, v); ok {
 				cfg.workers = val
 			}
+		case "maxBodySize":
+			if val, ok := util.CheckInt64(L, key, v); ok {
+				cfg.maxBodySize = val
+			}
+		case "maxFormSize":
+			if val, ok := util.CheckInt64(L, key, v); ok {
+				cfg.maxFormSize = val
+			}
+		case "maxFormFields":
+			if val, ok := util.CheckInt(L, key, v); ok {
+				cfg.maxFormFields = val
+			}
+		case "redirectTrailingSlash":
+			if val, ok := util.CheckBool(L, key, v); ok {
+				cfg.redirectSlash = val
+			}
+		case "compress":
+			if val, ok := util.CheckBool(L, key, v); ok {
+				cfg.compress = val
+			}
+		case "compressMinSize":
+			if val, ok := util.CheckInt(L, key, v); ok {
+				cfg.compressMinSize = val
+			}
+		case "http2":
+			if val, ok := util.CheckBool(L, key, v); ok {
+				cfg.http2 = val
+			}
+		case "h2c":
+			if val, ok := util.CheckBool(L, key, v); ok {
+				cfg.h2c = val
+			}
+		case "redirectHTTP":
+			switch val := v.(type) {
+			case lua.LBool:
+				cfg.redirectHTTP = ""
+				if val {
+					cfg.redirectHTTP = ":80"
+				}
+			case lua.LString:
+				cfg.redirectHTTP = string(val)
+			default:
+				L.ArgError(1, "redirectHTTP must be a boolean or a listen address")
+			}
 		case "onRequest":
 			if val, ok := util.CheckFunction(L, key, v); ok {
 				cfg.onRequest = val
 			}
+		case "onLog":
+			if val, ok := util.CheckFunction(L, key, v); ok {
+				cfg.onLog = val
+			}
 		case "onError":
 			if val, ok := util.CheckFunction(L, key, v); ok {
 				cfg.onError = val
@@ -435,6 +1175,14 @@ func getServerConfig(L *lua.LState, opts *lua.LTable, cfg *ServerConfig) *Server
 			if val, ok := util.CheckFunction(L, key, v); ok {
 				cfg.onShutdown = val
 			}
+		case "onTimeout":
+			if val, ok := util.CheckFunction(L, key, v); ok {
+				cfg.onTimeout = val
+			}
+		case "onPanic":
+			if val, ok := util.CheckFunction(L, key, v); ok {
+				cfg.onPanic = val
+			}
 		case "errorTemplate":
 			if val, ok := util.CheckString(L, key, v); ok {
 				cfg.errorTemplate = val
@@ -443,5 +1191,9 @@ func getServerConfig(L *lua.LState, opts *lua.LTable, cfg *ServerConfig) *Server
 			L.ArgError(1, "unknown cookie field: "+key)
 		}
 	})
+	// a CA file alone asks for verified client certificates
+	if cfg.clientCAFile != "" && !clientAuthSet {
+		cfg.clientAuth = tls.RequireAndVerifyClientCert
+	}
 	return cfg
 }
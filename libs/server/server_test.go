@@ -0,0 +1,294 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"golang.org/x/sync/semaphore"
+)
+
+// newTestServer builds a server with the defaults of newServer and logging
+// silenced, without going through Lua.
+func newTestServer(t testing.TB, configure func(cfg *ServerConfig)) *Server {
+	t.Helper()
+	cfg := &ServerConfig{
+		logLevel:          "silent",
+		logFormat:         "text",
+		addr:              "127.0.0.1:0",
+		workers:           100,
+		maxFormSize:       10 << 20,
+		maxFormFields:     1000,
+		readTimeout:       15 * time.Second,
+		readHeaderTimeout: 10 * time.Second,
+		writeTimeout:      30 * time.Second,
+		idleTimeout:       120 * time.Second,
+		processingTimeout: 30 * time.Second,
+		shutdownTimeout:   60 * time.Second,
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	L := lua.NewState()
+	t.Cleanup(L.Close)
+	return &Server{
+		route:      NewRoute(),
+		config:     cfg,
+		semaphore:  semaphore.NewWeighted(cfg.workers),
+		stats:      &serverStats{},
+		signalChan: make(chan os.Signal, 1),
+		vm:         L,
+	}
+}
+
+func (s *Server) handleFunc(t testing.TB, method, path string, handler Handler) {
+	t.Helper()
+	if err := s.route.Add(method, path, &RouteOptions{server: s.config}, handler); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handleLua routes path to the Lua function source. The handler can pass
+// values back to the test through the global report function.
+func (s *Server) handleLua(t testing.TB, method, path, source string) <-chan []lua.LValue {
+	t.Helper()
+	results := make(chan []lua.LValue, 1)
+	s.vm.SetGlobal("report", s.vm.NewFunction(func(L *lua.LState) int {
+		values := make([]lua.LValue, L.GetTop())
+		for i := range values {
+			values[i] = L.Get(i + 1)
+		}
+		results <- values
+		return 0
+	}))
+	if err := s.vm.DoString("handler = " + source); err != nil {
+		t.Fatal(err)
+	}
+	handler := s.vm.GetGlobal("handler").(*lua.LFunction)
+	s.handleFunc(t, method, path, s.luaHandler(handler, false))
+	return results
+}
+
+// TestTimeoutContextReuse lets processingTimeout fire while handlers are
+// still writing. The handler goroutine outlives ServeHTTP, so its Context
+// must not be handed to another request before it returns. Run with -race.
+func TestTimeoutContextReuse(t *testing.T) {
+	s := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.processingTimeout = 2 * time.Millisecond
+	})
+
+	var started, finished, recycled atomic.Int64
+	s.handleFunc(t, http.MethodGet, "/stream", func(L *lua.LState, ctx *Context) *HttpStatus {
+		started.Add(1)
+		defer finished.Add(1)
+		req := ctx.Request
+		if req.URL.Query().Has("late") {
+			// start writing only after the timeout answered the request
+			time.Sleep(5 * time.Millisecond)
+		}
+		for end := time.Now().Add(10 * time.Millisecond); time.Now().Before(end); {
+			if ctx.Request != req {
+				recycled.Add(1)
+			}
+			ctx.Writer.Write([]byte("chunk"))
+			time.Sleep(100 * time.Microsecond)
+		}
+		if ctx.Request != req {
+			recycled.Add(1)
+		}
+		return &HttpStatus{Code: http.StatusOK}
+	})
+
+	const requests = 200
+	var clients sync.WaitGroup
+	codes := make([]int, requests)
+	for i := 0; i < requests; i++ {
+		clients.Add(1)
+		go func(i int) {
+			defer clients.Done()
+			rec := httptest.NewRecorder()
+			target := "/stream"
+			if i%2 == 1 {
+				target += "?late"
+			}
+			s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			codes[i] = rec.Code
+		}(i)
+	}
+	clients.Wait()
+	// requests that timed out in the queue never reach the handler
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		if started.Load()+s.stats.rejected.Load() == requests && finished.Load() == started.Load() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("handlers did not finish: %d started, %d finished, %d rejected",
+				started.Load(), finished.Load(), s.stats.rejected.Load())
+		}
+	}
+
+	if n := recycled.Load(); n > 0 {
+		t.Fatalf("context recycled %d times while its handler was running", n)
+	}
+	timedOut := 0
+	for _, code := range codes {
+		if code == http.StatusRequestTimeout {
+			timedOut++
+		}
+	}
+	if timedOut == 0 {
+		t.Fatal("no request hit processingTimeout, the test did not exercise the race")
+	}
+}
+
+// TestRouteTimeoutExtendsProcessing checks that a route writeTimeout beyond
+// processingTimeout keeps the request alive, while other routes still time out.
+func TestRouteTimeoutExtendsProcessing(t *testing.T) {
+	s := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.processingTimeout = 20 * time.Millisecond
+	})
+	slow := func(L *lua.LState, ctx *Context) *HttpStatus {
+		time.Sleep(60 * time.Millisecond)
+		ctx.Writer.Write([]byte("done"))
+		return &HttpStatus{Code: http.StatusOK}
+	}
+	opts := &RouteOptions{server: s.config, writeTimeout: time.Second}
+	if err := s.route.Add(http.MethodGet, "/export", opts, slow); err != nil {
+		t.Fatal(err)
+	}
+	s.handleFunc(t, http.MethodGet, "/page", slow)
+	url := startTestServer(t, s)
+
+	res := <-get(url + "/export")
+	if res.err != nil || res.body != "done" {
+		t.Fatalf("route with writeTimeout was cut off: body %q, err %v", res.body, res.err)
+	}
+	res = <-get(url + "/page")
+	if res.err != nil || res.body == "done" {
+		t.Fatalf("route without override outlived processingTimeout: body %q, err %v", res.body, res.err)
+	}
+}
+
+// TestRouteDeadlineError checks that a connection that cannot take a route
+// deadline is reported instead of silently keeping the server timeout.
+func TestRouteDeadlineError(t *testing.T) {
+	s := newTestServer(t, nil)
+	var reported []string
+	s.vm.SetGlobal("onError", s.vm.NewFunction(func(L *lua.LState) int {
+		reported = append(reported, L.CheckString(1))
+		return 0
+	}))
+	s.config.onError = s.vm.GetGlobal("onError").(*lua.LFunction)
+	opts := &RouteOptions{server: s.config, readTimeout: time.Second}
+	if err := s.route.Add(http.MethodGet, "/", opts, func(L *lua.LState, ctx *Context) *HttpStatus {
+		return &HttpStatus{Code: http.StatusOK}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the recorder does not support deadlines
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if len(reported) != 1 || !strings.Contains(reported[0], "readTimeout") {
+		t.Fatalf("got reports %q, want the readTimeout failure", reported)
+	}
+}
+
+// TestPanicLogged checks that without onPanic the stack of a handler panic
+// reaches onError.
+func TestPanicLogged(t *testing.T) {
+	s := newTestServer(t, nil)
+	reported := make(chan string, 2)
+	s.vm.SetGlobal("onError", s.vm.NewFunction(func(L *lua.LState) int {
+		reported <- L.CheckString(1)
+		return 0
+	}))
+	s.config.onError = s.vm.GetGlobal("onError").(*lua.LFunction)
+	s.handleFunc(t, http.MethodGet, "/", func(L *lua.LState, ctx *Context) *HttpStatus {
+		panic("boom")
+	})
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500", rec.Code)
+	}
+	select {
+	case msg := <-reported:
+		if !strings.Contains(msg, "panic recovered: boom") || !strings.Contains(msg, "TestPanicLogged") {
+			t.Fatalf("report lacks the panic or its stack: %s", msg)
+		}
+	default:
+		t.Fatal("panic was not reported to onError")
+	}
+}
+
+func TestConfigureHTTP2Error(t *testing.T) {
+	s := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.http2 = true
+	})
+	// HTTP/2 requires TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 below TLS 1.3
+	srv := &http.Server{TLSConfig: &tls.Config{
+		CipherSuites: []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA},
+	}}
+	if err := s.configureHTTP2(srv); err == nil {
+		t.Fatal("expected the HTTP/2 setup to fail")
+	}
+}
+
+func TestHTTPSRedirectHost(t *testing.T) {
+	tests := []struct {
+		host string
+		port int
+		want string
+	}{
+		{"example.com", 443, "https://example.com/a?b=1"},
+		{"example.com:80", 8443, "https://example.com:8443/a?b=1"},
+		{"[::1]", 8443, "https://[::1]:8443/a?b=1"},
+		{"[::1]:80", 443, "https://[::1]/a?b=1"},
+		{"[::1]", 443, "https://[::1]/a?b=1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/a?b=1", nil)
+		r.Host = tt.host
+		rec := httptest.NewRecorder()
+		httpsRedirect(tt.port)(rec, r)
+		if got := rec.Header().Get("Location"); got != tt.want {
+			t.Errorf("host %q, port %d: redirected to %q, want %q", tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	s := newTestServer(t, nil)
+	rateLimit := s.vm.NewFunction(s.RateLimit)
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{`{ rps = 1, burst = 1 }`, ""},
+		{`{ burst = 0 }`, "burst must be at least 1"},
+		{`{ burst = -1 }`, "burst must be at least 1"},
+	}
+	for _, tt := range tests {
+		if err := s.vm.DoString("opts = " + tt.source); err != nil {
+			t.Fatal(err)
+		}
+		top := s.vm.GetTop()
+		err := s.vm.CallByParam(lua.P{Fn: rateLimit, NRet: 1, Protect: true}, s.vm.GetGlobal("opts"))
+		s.vm.SetTop(top)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.source, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error = %v, want %q", tt.source, err, tt.err)
+		}
+	}
+}
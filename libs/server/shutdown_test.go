@@ -0,0 +1,97 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// startTestServer serves s on a loopback port and returns its base URL.
+func startTestServer(t *testing.T, s *Server) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.httpServer = &http.Server{Handler: s, ConnState: s.stats.trackConn}
+	go s.httpServer.Serve(listener)
+	t.Cleanup(func() { s.httpServer.Close() })
+	return "http://" + listener.Addr().String()
+}
+
+type response struct {
+	body string
+	err  error
+}
+
+func get(url string) <-chan response {
+	done := make(chan response, 1)
+	go func() {
+		res, err := http.Get(url)
+		if err != nil {
+			done <- response{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		done <- response{body: string(body), err: err}
+	}()
+	return done
+}
+
+// slowHandler signals started, then answers after delay.
+func slowHandler(started chan<- struct{}, delay time.Duration) Handler {
+	return func(L *lua.LState, ctx *Context) *HttpStatus {
+		started <- struct{}{}
+		time.Sleep(delay)
+		ctx.Writer.Write([]byte("done"))
+		return &HttpStatus{Code: http.StatusOK}
+	}
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	s := newTestServer(t, nil)
+	started := make(chan struct{}, 1)
+	s.handleFunc(t, http.MethodGet, "/slow", slowHandler(started, 200*time.Millisecond))
+	url := startTestServer(t, s)
+
+	done := get(url + "/slow")
+	<-started
+	s.shutdown(s.vm, "")
+
+	select {
+	case res := <-done:
+		if res.err != nil || res.body != "done" {
+			t.Fatalf("in-flight request was cut off: body %q, err %v", res.body, res.err)
+		}
+	default:
+		t.Fatal("shutdown returned before the in-flight request completed")
+	}
+	if _, err := http.Get(url + "/slow"); err == nil {
+		t.Fatal("server still accepts requests after shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.shutdownTimeout = 50 * time.Millisecond
+	})
+	started := make(chan struct{}, 1)
+	s.handleFunc(t, http.MethodGet, "/slow", slowHandler(started, time.Second))
+	url := startTestServer(t, s)
+
+	done := get(url + "/slow")
+	<-started
+	begin := time.Now()
+	s.shutdown(s.vm, "")
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Fatalf("shutdown took %v, want it bounded by shutdownTimeout", elapsed)
+	}
+	if res := <-done; res.err == nil {
+		t.Fatalf("connection was not closed after shutdownTimeout, got body %q", res.body)
+	}
+}
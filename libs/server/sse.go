@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type EventStream struct {
+	ctx    *Context
+	closed bool
+}
+
+var errClientGone = errors.New("client disconnected")
+
+func (ctx *Context) sse(L *lua.LState) int {
+	stream, err := ctx.EventStream()
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	api := util.SetMethods(L, util.Methods{
+		"send":   stream.send,
+		"close":  stream.close,
+		"closed": stream.isClosed,
+	})
+	return util.Push(L, api)
+}
+
+// EventStream prepares the response for text/event-stream and flushes the
+// headers so the client starts receiving events immediately.
+func (ctx *Context) EventStream() (*EventStream, error) {
+	if err := ctx.Writer.Written(); err != nil {
+		return nil, err
+	}
+
+	header := ctx.Writer.ResponseWriter.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no")
+
+	if err := ctx.SetStatus(http.StatusOK); err != nil {
+		return nil, err
+	}
+	if err := ctx.Writer.Flush(); err != nil {
+		return nil, err
+	}
+	es := &EventStream{ctx: ctx}
+	es.keepAlive()
+	return es, nil
+}
+
+// keepAlive gives the stream a fresh processingTimeout and write deadline,
+// so it stays open as long as it keeps sending and only an idle stream
+// times out.
+func (es *EventStream) keepAlive() {
+	ctx := es.ctx
+	if ctx.config == nil {
+		return
+	}
+	ctx.extendProcessing(ctx.config.processingTimeout)
+	d := ctx.config.writeTimeout
+	if ctx.Route != nil && ctx.Route.config.writeTimeout > 0 {
+		d = ctx.Route.config.writeTimeout
+	}
+	if d > 0 {
+		// not every writer supports deadlines, the server connection does
+		rc := http.NewResponseController(ctx.Writer.ResponseWriter)
+		_ = rc.SetWriteDeadline(deadlineAfter(d))
+	}
+}
+
+func (es *EventStream) send(L *lua.LState) int {
+	event, data, id := L.OptString(1, ""), L.CheckString(2), L.OptString(3, "")
+	if err := es.Send(event, data, id); err != nil {
+		return util.Push(L, lua.LFalse, lua.LString(err.Error()))
+	}
+	return util.Push(L, lua.LTrue)
+}
+
+func (es *EventStream) close(L *lua.LState) int {
+	es.closed = true
+	return 0
+}
+
+func (es *EventStream) isClosed(L *lua.LState) int {
+	return util.Push(L, lua.LBool(es.Closed()))
+}
+
+// Closed reports whether the stream was closed or the client went away.
+func (es *EventStream) Closed() bool {
+	if es.closed {
+		return true
+	}
+	select {
+	case <-es.ctx.Request.Context().Done():
+		es.closed = true
+	default:
+	}
+	return es.closed
+}
+
+// Send writes a single event frame and flushes it to the client.
+func (es *EventStream) Send(event, data, id string) error {
+	if es.Closed() {
+		return errClientGone
+	}
+
+	var sb strings.Builder
+	if id != "" {
+		sb.WriteString("id: " + id + "\n")
+	}
+	if event != "" {
+		sb.WriteString("event: " + event + "\n")
+	}
+	for _, line := range strings.Split(data, "\n") {
+		sb.WriteString("data: " + strings.TrimSuffix(line, "\r") + "\n")
+	}
+	sb.WriteString("\n")
+
+	length, err := es.ctx.Writer.Write([]byte(sb.String()))
+	if err != nil {
+		es.closed = true
+		return err
+	}
+	es.ctx.Status.Length += length
+	if err := es.ctx.Writer.Flush(); err != nil {
+		return err
+	}
+	es.keepAlive()
+	return nil
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// TestEventStreamOutlivesTimeout sends events for longer than
+// processingTimeout. Each event pushes the timeout out, so the stream must
+// arrive in full.
+func TestEventStreamOutlivesTimeout(t *testing.T) {
+	s := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.processingTimeout = 50 * time.Millisecond
+	})
+	const events = 6
+	s.handleFunc(t, http.MethodGet, "/events", func(L *lua.LState, ctx *Context) *HttpStatus {
+		es, err := ctx.EventStream()
+		if err != nil {
+			return &HttpStatus{Code: http.StatusInternalServerError, Error: err}
+		}
+		for i := 0; i < events; i++ {
+			time.Sleep(25 * time.Millisecond)
+			if err := es.Send("tick", "data", ""); err != nil {
+				return &HttpStatus{Code: http.StatusOK, Error: err}
+			}
+		}
+		return &HttpStatus{Code: http.StatusOK}
+	})
+	url := startTestServer(t, s)
+
+	res := <-get(url + "/events")
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if n := strings.Count(res.body, "event: tick\n"); n != events {
+		t.Fatalf("got %d events, want %d:\n%s", n, events, res.body)
+	}
+}
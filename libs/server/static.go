@@ -0,0 +1,123 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"path"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type staticHandler struct {
+	dir    string
+	config FileConfig
+	spa    bool
+}
+
+// Static mounts a directory under a url prefix:
+//
+//	app.static("/assets", "./public", {maxAge = 86400, immutable = true, spa = true})
+func (s *Server) Static(L *lua.LState) int {
+	prefix, dir := s.pathJoin(L.CheckString(1)), L.CheckString(2)
+	lopt := L.OptTable(3, L.NewTable())
+	h := &staticHandler{dir: dir, config: defaultFileConfig}
+
+	lopt.ForEach(func(k, v lua.LValue) {
+		key := k.String()
+		switch key {
+		case "spa":
+			if val, ok := util.CheckBool(L, key, v, 3); ok {
+				h.spa = val
+			}
+		default:
+			if !setFileConfig(L, &h.config, key, v, 3) {
+				L.ArgError(3, "unknown static field: "+key)
+			}
+		}
+	})
+
+	handler := s.applyMiddleware(h.serve)
+	opts := &RouteOptions{stripPrefix: prefix, server: s.config}
+	for _, pattern := range []string{prefix, path.Join(prefix, "{path...}")} {
+		if err := s.route.Add(http.MethodGet, pattern, opts, handler); err != nil {
+			L.RaiseError("failed to add route: %v", err)
+		}
+		options := s.applyMiddleware(optionsHandler)
+		if err := s.route.AddDefault(http.MethodOptions, pattern, opts, options); err != nil {
+			L.RaiseError("failed to add route: %v", err)
+		}
+	}
+	return util.Push(L, s.api)
+}
+
+func (h *staticHandler) serve(L *lua.LState, ctx *Context) *HttpStatus {
+	if err := ctx.Writer.Written(); err != nil {
+		return &HttpStatus{Code: http.StatusInternalServerError, Error: err}
+	}
+
+	fs := NewFileServer(ctx.Writer.ResponseWriter, ctx.Request, &h.config)
+	_, status := fs.ServeFile(h.dir, ctx.Route.stripPath)
+
+	// Unknown paths belong to the client-side router, hand them the app shell.
+	if h.spa && status.Code == http.StatusNotFound {
+		shell := h.config
+		shell.autoIndex, shell.ignoreBase = true, true
+		shell.cacheControl = "no-cache"
+		_, status = NewFileServer(ctx.Writer.ResponseWriter, ctx.Request, &shell).ServeFile(h.dir)
+		if status.Code == http.StatusForbidden {
+			status = HttpStatus{Code: http.StatusNotFound, Error: errors.New("spa index file not found")}
+		}
+	}
+
+	if status.Error != nil {
+		return &status
+	}
+	ctx.Status.Length = status.Length
+	ctx.Status.Code = status.Code
+	ctx.Status.Text = http.StatusText(status.Code)
+	ctx.Writer.written = true
+	return &status
+}
+
+// setFileConfig applies one file server option and reports whether key was one.
+func setFileConfig(L *lua.LState, cfg *FileConfig, key string, v lua.LValue, n int) bool {
+	switch key {
+	case "ignoreBase":
+		if val, ok := util.CheckBool(L, key, v, n); ok {
+			cfg.ignoreBase = val
+		}
+	case "autoIndex":
+		if val, ok := util.CheckBool(L, key, v, n); ok {
+			cfg.autoIndex = val
+		}
+	case "index":
+		if val, ok := util.CheckTable(L, key, v, n); ok {
+			cfg.index = val
+		}
+	case "prettyIndex":
+		if val, ok := util.CheckBool(L, key, v, n); ok {
+			cfg.prettyIndex = val
+		}
+	case "maxAge":
+		if val, ok := util.CheckDuration(L, key, v, n); ok {
+			cfg.maxAge = val
+		}
+	case "immutable":
+		if val, ok := util.CheckBool(L, key, v, n); ok {
+			cfg.immutable = val
+		}
+	case "cacheControl":
+		if val, ok := util.CheckString(L, key, v, n); ok {
+			cfg.cacheControl = val
+		}
+	case "precompressed":
+		if val, ok := util.CheckBool(L, key, v, n); ok {
+			cfg.precompressed = val
+		}
+	default:
+		return false
+	}
+	return true
+}
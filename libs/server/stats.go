@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// serverStats keeps lock-free connection, request and worker counters. Gauges
+// move with connection state transitions and the worker queue, counters only
+// ever grow.
+type serverStats struct {
+	connTotal    atomic.Int64
+	connNew      atomic.Int64
+	connActive   atomic.Int64
+	connIdle     atomic.Int64
+	connClosed   atomic.Int64
+	connHijacked atomic.Int64
+	requests     atomic.Int64
+	inFlight     atomic.Int64
+	queued       atomic.Int64 // requests waiting for a worker
+	busy         atomic.Int64 // workers running a handler
+	rejected     atomic.Int64 // requests that got no worker in time
+	states       sync.Map     // net.Conn -> http.ConnState
+}
+
+// trackConn is registered as http.Server.ConnState.
+func (st *serverStats) trackConn(conn net.Conn, state http.ConnState) {
+	if prev, ok := st.states.Load(conn); ok {
+		if gauge := st.gauge(prev.(http.ConnState)); gauge != nil {
+			gauge.Add(-1)
+		}
+	}
+
+	switch state {
+	case http.StateNew:
+		st.connTotal.Add(1)
+	case http.StateClosed:
+		st.connClosed.Add(1)
+		st.states.Delete(conn)
+		return
+	case http.StateHijacked:
+		st.connHijacked.Add(1)
+		st.states.Delete(conn)
+		return
+	}
+
+	st.gauge(state).Add(1)
+	st.states.Store(conn, state)
+}
+
+func (st *serverStats) gauge(state http.ConnState) *atomic.Int64 {
+	switch state {
+	case http.StateNew:
+		return &st.connNew
+	case http.StateActive:
+		return &st.connActive
+	case http.StateIdle:
+		return &st.connIdle
+	}
+	return nil
+}
+
+func (s *Server) Stats(L *lua.LState) int {
+	st := s.stats
+	connections := util.SetMethods(L, util.Methods{
+		"total":    lua.LNumber(st.connTotal.Load()),
+		"new":      lua.LNumber(st.connNew.Load()),
+		"active":   lua.LNumber(st.connActive.Load()),
+		"idle":     lua.LNumber(st.connIdle.Load()),
+		"closed":   lua.LNumber(st.connClosed.Load()),
+		"hijacked": lua.LNumber(st.connHijacked.Load()),
+	})
+	workers := util.SetMethods(L, util.Methods{
+		"size":     lua.LNumber(s.config.workers),
+		"busy":     lua.LNumber(st.busy.Load()),
+		"queued":   lua.LNumber(st.queued.Load()),
+		"rejected": lua.LNumber(st.rejected.Load()),
+	})
+	stats := util.SetMethods(L, util.Methods{
+		"connections": connections,
+		"workers":     workers,
+		"requests":    lua.LNumber(st.requests.Load()),
+		"inFlight":    lua.LNumber(st.inFlight.Load()),
+	})
+	return util.Push(L, stats)
+}
@@ -73,9 +73,10 @@ var dirTemplatePure = `
 </head>
 <body>
   <h3>Index of {{.Name}}</h3><hr>
-  <pre>{{range .List}}{{if .IsDir}}
-<a href="{{.Name}}/">{{.Name}}/</a>{{else}}
-<a href="{{.Name}}">{{.Name}}</a>{{end}}{{end}}
+  <pre><a href="{{.SortLink "name"}}">Name</a>  <a href="{{.SortLink "date"}}">Modified</a>  <a href="{{.SortLink "size"}}">Size</a>
+{{range .List}}{{if .IsDir}}
+<a href="{{.Name}}/">{{.Name}}/</a>  {{.ModTime.Format "2006-01-02 15:04"}}  -{{else}}
+<a href="{{.Name}}">{{.Name}}</a>  {{.ModTime.Format "2006-01-02 15:04"}}  {{.HumanSize}}{{end}}{{end}}
   </pre>
 </body>
 </html>
@@ -154,6 +155,24 @@ var dirTemplatePretty = `
       font-size: 0.85rem;
       color: #868e96;
       margin-left: 1rem;
+      white-space: nowrap;
+    }
+    .size {
+      width: 5rem;
+      text-align: right;
+    }
+    .columns {
+      display: flex;
+      padding: 0.4rem 1rem;
+      font-size: 0.8rem;
+      border-bottom: 1px solid #e9ecef;
+    }
+    .columns a {
+      color: #868e96;
+      text-decoration: none;
+    }
+    .columns .name {
+      margin-left: 24px;
     }
   </style>
 </head>
@@ -161,16 +180,23 @@ var dirTemplatePretty = `
   <div class="header">
     <div class="title">Index of {{.Name}}</div>
   </div>
-  <div class="list">{{range .List}}{{if .IsDir}}
+  <div class="list">
+    <div class="columns">
+      <a class="name" href="{{.SortLink "name"}}">Name</a>
+      <a class="meta" href="{{.SortLink "date"}}">Modified</a>
+      <a class="meta size" href="{{.SortLink "size"}}">Size</a>
+    </div>{{range .List}}{{if .IsDir}}
     <a href="{{.Name}}/" class="item">
       <div class="icon dir-icon"></div>
       <div class="name">{{.Name}}</div>
-      <div class="meta">-</div>
+      <div class="meta">{{.ModTime.Format "2006-01-02 15:04"}}</div>
+      <div class="meta size">-</div>
     </a>{{else}}
     <a href="{{.Name}}" class="item">
       <div class="icon file-icon"></div>
       <div class="name">{{.Name}}</div>
-       <div class="meta">{{.Size}}</div>
+      <div class="meta">{{.ModTime.Format "2006-01-02 15:04"}}</div>
+      <div class="meta size">{{.HumanSize}}</div>
     </a>{{end}}{{end}}
   </div>
 </body>
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"lug/util"
+
+	"github.com/fsnotify/fsnotify"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// TemplateSet is a template collection parsed once from a glob and shared by
+// all handlers. In reload mode it is re-parsed whenever a matching file changes.
+type TemplateSet struct {
+	pattern string
+	tpl     *template.Template
+	watcher *fsnotify.Watcher
+	onError func(error) // reload and watch errors, the standard log if nil
+	scope   *util.TemplateScope
+	helpers func(*lua.LState) template.FuncMap // scope helpers bound to a state
+	mu      sync.RWMutex
+}
+
+func (s *Server) Templates(L *lua.LState) int {
+	pattern := L.CheckString(1)
+	lopt := L.OptTable(2, L.NewTable())
+	reload := false
+
+	lopt.ForEach(func(k, v lua.LValue) {
+		key := k.String()
+		switch key {
+		case "reload":
+			if val, ok := util.CheckBool(L, key, v); ok {
+				reload = val
+			}
+		default:
+			L.ArgError(2, "unknown templates field: "+key)
+		}
+	})
+
+	set, err := newTemplateSet(pattern, reload, func(err error) {
+		s.logger(s.vm, "error", err)
+	}, s.templates, s.templateHelpers)
+	if err != nil {
+		return util.NilError(L, err)
+	}
+
+	api := util.SetMethods(L, util.Methods{
+		"render": set.render,
+		"reload": set.reload,
+		"close":  set.close,
+	})
+	return util.Push(L, api)
+}
+
+// NewTemplateSet parses every file matching pattern and, if reload is set,
+// watches their directories for changes. Errors while reloading in the
+// background go to onError.
+func NewTemplateSet(pattern string, reload bool, onError func(error)) (*TemplateSet, error) {
+	return newTemplateSet(pattern, reload, onError, util.DefaultTemplates, nil)
+}
+
+// newTemplateSet parses the set in scope, helpers gives the scope helpers
+// running on the state of a caller.
+func newTemplateSet(pattern string, reload bool, onError func(error), scope *util.TemplateScope, helpers func(*lua.LState) template.FuncMap) (*TemplateSet, error) {
+	if scope == nil {
+		scope = util.DefaultTemplates
+	}
+	set := &TemplateSet{pattern: pattern, onError: onError, scope: scope, helpers: helpers}
+	if err := set.Reload(); err != nil {
+		return nil, err
+	}
+	if reload {
+		if err := set.watch(); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+func (set *TemplateSet) render(L *lua.LState) int {
+	name := L.CheckString(1)
+	var data interface{}
+	if L.GetTop() >= 2 && L.Get(2) != lua.LNil {
+		data = util.ToGoValue(L.CheckTable(2), false)
+	}
+
+	html, err := set.execute(L, name, data)
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, lua.LString(html))
+}
+
+func (set *TemplateSet) reload(L *lua.LState) int {
+	if err := set.Reload(); err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, lua.LTrue)
+}
+
+func (set *TemplateSet) close(L *lua.LState) int {
+	if err := set.Close(); err != nil {
+		return util.Error(L, err)
+	}
+	return 0
+}
+
+// Render executes the named template of the set.
+func (set *TemplateSet) Render(name string, data interface{}) (string, error) {
+	return set.execute(nil, name, data)
+}
+
+// execute is Render with the scope helpers running on L.
+func (set *TemplateSet) execute(L *lua.LState, name string, data interface{}) (string, error) {
+	set.mu.RLock()
+	tpl := set.tpl
+	set.mu.RUnlock()
+
+	var funcs template.FuncMap
+	if set.helpers != nil && L != nil {
+		funcs = set.helpers(L)
+	}
+	tpl, err := set.scope.Instance(tpl, funcs)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tpl.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Reload re-parses the set. On failure the previous templates stay in use.
+func (set *TemplateSet) Reload() error {
+	tpl, err := set.scope.ParseGlobUncached(set.pattern)
+	if err != nil {
+		return err
+	}
+	set.mu.Lock()
+	set.tpl = tpl
+	set.mu.Unlock()
+	return nil
+}
+
+// Close stops watching for changes.
+func (set *TemplateSet) Close() error {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if set.watcher == nil {
+		return nil
+	}
+	err := set.watcher.Close()
+	set.watcher = nil
+	return err
+}
+
+func (set *TemplateSet) watch() error {
+	files, err := filepath.Glob(set.pattern)
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// Watch directories rather than files, editors often replace files on
+	// save. The pattern's own directory catches the first file created in it,
+	// unless it is a glob itself.
+	dirs := map[string]bool{}
+	if dir := filepath.Dir(set.pattern); !strings.ContainsAny(dir, "*?[") {
+		dirs[dir] = true
+	}
+	for _, file := range files {
+		dirs[filepath.Dir(file)] = true
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("templates: watch %s: %w", dir, err)
+		}
+	}
+
+	set.watcher = watcher
+	go set.watchLoop(watcher)
+	return nil
+}
+
+func (set *TemplateSet) watchLoop(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Chmod) {
+				continue
+			}
+			if matched, _ := filepath.Match(set.pattern, event.Name); !matched {
+				continue
+			}
+			if err := set.Reload(); err != nil {
+				set.report(fmt.Errorf("templates: reload %s failed: %w", set.pattern, err))
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			if !errors.Is(err, fsnotify.ErrEventOverflow) {
+				set.report(fmt.Errorf("templates: watch %s: %w", set.pattern, err))
+			}
+		}
+	}
+}
+
+func (set *TemplateSet) report(err error) {
+	if set.onError == nil {
+		log.Println(err)
+		return
+	}
+	set.onError(err)
+}
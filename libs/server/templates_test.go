@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// writeTemplate replaces path in one step, so a watcher never sees it empty.
+func writeTemplate(t *testing.T, path, text string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".tmp", []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTemplateWatchGlobDir checks that a glob in the directory part of the
+// pattern does not make the watch fail.
+func TestTemplateWatchGlobDir(t *testing.T) {
+	root := t.TempDir()
+	writeTemplate(t, filepath.Join(root, "a", "page.html"), "a")
+	writeTemplate(t, filepath.Join(root, "b", "page.html"), "b")
+
+	set, err := NewTemplateSet(filepath.Join(root, "*", "page.html"), true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+}
+
+func TestTemplateReloadError(t *testing.T) {
+	root := t.TempDir()
+	page := filepath.Join(root, "page.html")
+	writeTemplate(t, page, "{{.name}}")
+
+	errs := make(chan error, 4)
+	set, err := NewTemplateSet(filepath.Join(root, "*.html"), true, func(err error) {
+		errs <- err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer set.Close()
+
+	writeTemplate(t, page, "{{.name")
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "reload") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload error was not reported")
+	}
+	// the previous templates stay in use
+	if html, err := set.Render("page.html", map[string]interface{}{"name": "ann"}); err != nil || html != "ann" {
+		t.Fatalf("got %q, %v", html, err)
+	}
+}
+
+// TestTemplateFuncsScoped renders one file from two servers whose
+// templateFuncs define the same helper. Each must get its own, running on
+// the state of the handler.
+func TestTemplateFuncsScoped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "page.html")
+	writeTemplate(t, path, "{{ greet }}")
+
+	render := func(helper string) string {
+		s := newTestServer(t, nil)
+		if err := s.vm.DoString("funcs = { greet = " + helper + " }"); err != nil {
+			t.Fatal(err)
+		}
+		s.config.templateFuncs = s.vm.GetGlobal("funcs").(*lua.LTable)
+		s.templates = util.NewTemplateScope(s.templateHelpers(nil))
+		s.handleLua(t, http.MethodGet, "/", `function(ctx)
+			user = "ann" -- a global of the handler state only
+			ctx.render("`+path+`")
+		end`)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Body.String()
+	}
+
+	if got := render(`function() return "hello " .. user end`); got != "hello ann" {
+		t.Fatalf("first server rendered %q", got)
+	}
+	if got := render(`function() return "bye " .. user end`); got != "bye ann" {
+		t.Fatalf("second server rendered %q", got)
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":             tls.NoClientCert,
+	"request":          tls.RequestClientCert,
+	"require":          tls.RequireAnyClientCert,
+	"verifyIfGiven":    tls.VerifyClientCertIfGiven,
+	"requireAndVerify": tls.RequireAndVerifyClientCert,
+}
+
+// tlsConfig builds the TLS settings of the listener from the server config.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	cfg := s.config
+	if cfg.tlsMaxVersion != 0 && cfg.tlsMaxVersion < cfg.tlsMinVersion {
+		return nil, fmt.Errorf("tlsMaxVersion %s is below tlsMinVersion %s",
+			tls.VersionName(cfg.tlsMaxVersion), tls.VersionName(cfg.tlsMinVersion))
+	}
+	cert, err := cfg.certificate()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   cfg.tlsMinVersion,
+		MaxVersion:   cfg.tlsMaxVersion,
+		// only applies up to TLS 1.2, the TLS 1.3 suites are not configurable
+		CipherSuites: cfg.tlsCipherSuites,
+		NextProtos:   []string{"http/1.1"},
+	}
+	if cfg.http2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	config.ClientAuth = cfg.clientAuth
+	if cfg.clientCAFile != "" {
+		if config.ClientCAs, err = loadCertPool(cfg.clientCAFile); err != nil {
+			return nil, err
+		}
+	} else if cfg.clientAuth >= tls.VerifyClientCertIfGiven {
+		return nil, fmt.Errorf("clientAuth %s needs a clientCAFile to verify against", cfg.clientAuth)
+	}
+	return config, nil
+}
+
+// loadCertPool reads the PEM encoded CA certificates client certificates
+// are verified against.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("clientCAFile: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("clientCAFile %s contains no PEM certificates", file)
+	}
+	return pool, nil
+}
+
+// useTLS reports whether a certificate and key were given, as files or inline.
+func (cfg *ServerConfig) useTLS() bool {
+	return (cfg.certFile != "" || cfg.certPEM != "") && (cfg.keyFile != "" || cfg.keyPEM != "")
+}
+
+// certificate loads the key pair, each half either from its PEM option or
+// from its file, so a key from a secret store can go with a cert on disk.
+func (cfg *ServerConfig) certificate() (tls.Certificate, error) {
+	certPEM, err := readPEM(cfg.certPEM, cfg.certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := readPEM(cfg.keyPEM, cfg.keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid certificate: %w", err)
+	}
+	return cert, nil
+}
+
+func readPEM(inline, file string) ([]byte, error) {
+	if inline != "" {
+		return []byte(inline), nil
+	}
+	return os.ReadFile(file)
+}
+
+// checkTLSVersion parses a version such as "1.2" or "1.3".
+func checkTLSVersion(L *lua.LState, key, version string) uint16 {
+	v, ok := tlsVersions[version]
+	if !ok {
+		L.ArgError(1, fmt.Sprintf("%s must be one of 1.0, 1.1, 1.2 or 1.3, got %q", key, version))
+	}
+	return v
+}
+
+// checkClientAuth parses a client certificate policy such as "requireAndVerify".
+func checkClientAuth(L *lua.LState, key, name string) tls.ClientAuthType {
+	auth, ok := clientAuthTypes[name]
+	if !ok {
+		L.ArgError(1, fmt.Sprintf("%s must be one of none, request, require, verifyIfGiven or requireAndVerify, got %q", key, name))
+	}
+	return auth
+}
+
+// parseCipherSuites maps IANA suite names, e.g.
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, to their ids. Suites known to be
+// insecure are rejected.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		switch {
+		case insecure[name]:
+			return nil, fmt.Errorf("insecure cipher suite: %s", name)
+		case !ok:
+			return nil, fmt.Errorf("unknown cipher suite: %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// tlsInfo returns the negotiated TLS parameters of the connection and the
+// client certificate, or nil for plain HTTP.
+func (ctx *Context) tlsInfo(L *lua.LState) int {
+	state := ctx.Request.TLS
+	if state == nil {
+		return util.Push(L, lua.LNil)
+	}
+	info := L.CreateTable(0, 6)
+	info.RawSetString("version", lua.LString(tls.VersionName(state.Version)))
+	info.RawSetString("cipherSuite", lua.LString(tls.CipherSuiteName(state.CipherSuite)))
+	info.RawSetString("serverName", lua.LString(state.ServerName))
+	info.RawSetString("protocol", lua.LString(state.NegotiatedProtocol))
+	info.RawSetString("verified", lua.LBool(len(state.VerifiedChains) > 0))
+	if len(state.PeerCertificates) > 0 {
+		info.RawSetString("peer", certificateTable(L, state.PeerCertificates[0]))
+	}
+	return util.Push(L, info)
+}
+
+func certificateTable(L *lua.LState, cert *x509.Certificate) *lua.LTable {
+	fingerprint := sha256.Sum256(cert.Raw)
+	pemBlock := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+
+	t := L.CreateTable(0, 10)
+	t.RawSetString("subject", lua.LString(cert.Subject.String()))
+	t.RawSetString("issuer", lua.LString(cert.Issuer.String()))
+	t.RawSetString("commonName", lua.LString(cert.Subject.CommonName))
+	t.RawSetString("serialNumber", lua.LString(strings.ToUpper(cert.SerialNumber.Text(16))))
+	t.RawSetString("notBefore", lua.LString(cert.NotBefore.UTC().Format(time.RFC3339)))
+	t.RawSetString("notAfter", lua.LString(cert.NotAfter.UTC().Format(time.RFC3339)))
+	t.RawSetString("dnsNames", stringsTable(L, cert.DNSNames))
+	t.RawSetString("emailAddresses", stringsTable(L, cert.EmailAddresses))
+	t.RawSetString("fingerprint", lua.LString(hex.EncodeToString(fingerprint[:])))
+	t.RawSetString("pem", lua.LString(pemBlock))
+	return t
+}
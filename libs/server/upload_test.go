@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func uploadRequest(t *testing.T, filename, content string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	file, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte(content))
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// TestUploadFileConfig uses UploadConfig the way Go callers of
+// Context.UploadFile do.
+func TestUploadFileConfig(t *testing.T) {
+	cfg := &UploadConfig{
+		MaxSize:    16,
+		Extensions: []string{"TXT", ".md"},
+		Types:      []string{"text/*"},
+	}
+	tests := []struct {
+		filename, content string
+		err               string
+	}{
+		{"notes.txt", "hello", ""},
+		{"README.MD", "# title", ""},
+		{"image.png", "hello", "has extension '.png'"},
+		{"noext", "hello", "has extension ''"},
+		{"big.txt", strings.Repeat("x", 17), "over the 16 bytes limit"},
+		{"fake.txt", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "has content type 'image/png'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			dst := t.TempDir()
+			ctx := newContext(httptest.NewRecorder(), uploadRequest(t, tt.filename, tt.content))
+			defer ctx.Release()
+
+			files, err := ctx.UploadFile("file", dst, cfg)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(filepath.Join(dst, tt.filename))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 || files[0].Size != int64(len(tt.content)) {
+				t.Fatalf("got %+v", files)
+			}
+			// a zero Mode falls back to the default
+			if info.Mode().Perm() != defaultUploadConfig.Mode {
+				t.Fatalf("file mode %v, want %v", info.Mode().Perm(), defaultUploadConfig.Mode)
+			}
+		})
+	}
+}
+
+// TestUploadFileSaveFailure makes the second of two files fail to save. The
+// first one must not be left behind.
+func TestUploadFileSaveFailure(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		file, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte("hello"))
+	}
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	dst := t.TempDir()
+	// a directory in the way of b.txt
+	if err := os.Mkdir(filepath.Join(dst, "b.txt"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ctx := newContext(httptest.NewRecorder(), r)
+	defer ctx.Release()
+
+	if _, err := ctx.UploadFile("file", dst, nil); err == nil || !strings.Contains(err.Error(), "b.txt") {
+		t.Fatalf("got error %v, want the b.txt save failure", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("a.txt left behind after the upload failed: %v", err)
+	}
+}
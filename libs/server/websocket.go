@@ -0,0 +1,421 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"lug/util"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type (
+	Websocket struct {
+		conn           net.Conn
+		rw             *bufio.ReadWriter
+		maxMessageSize int64
+		closed         bool
+		mu             sync.Mutex
+	}
+	WebsocketConfig struct {
+		maxMessageSize int64
+		protocols      []string
+	}
+	websocketError struct {
+		code   int
+		reason string
+	}
+)
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsCloseInvalidData   = 1007
+	wsCloseTooBig        = 1009
+
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var defaultWebsocketConfig = WebsocketConfig{
+	maxMessageSize: 1 << 20, // 1 MB
+}
+
+func (e *websocketError) Error() string {
+	return fmt.Sprintf("websocket closed (%d): %s", e.code, e.reason)
+}
+
+func (ctx *Context) websocket(L *lua.LState) int {
+	cfg := defaultWebsocketConfig
+	lopt := L.OptTable(1, L.NewTable())
+
+	lopt.ForEach(func(k, v lua.LValue) {
+		key := k.String()
+		switch key {
+		case "maxMessageSize":
+			if val, ok := util.CheckInt64(L, key, v); ok {
+				cfg.maxMessageSize = val
+			}
+		case "protocols":
+			if val, ok := util.CheckTable(L, key, v); ok {
+				cfg.protocols = val
+			}
+		default:
+			L.ArgError(1, "unknown websocket field: "+key)
+		}
+	})
+
+	ws, err := ctx.Websocket(&cfg)
+	if err != nil {
+		return util.NilError(L, err)
+	}
+
+	api := util.SetMethods(L, util.Methods{
+		"read":  ws.read,
+		"write": ws.write,
+		"ping":  ws.ping,
+		"close": ws.close,
+	})
+	return util.Push(L, api)
+}
+
+// Websocket performs the RFC 6455 opening handshake and takes over the
+// underlying connection. From then on the request is exempt from
+// processingTimeout and no longer counts against workers.
+func (ctx *Context) Websocket(cfg *WebsocketConfig) (*Websocket, error) {
+	if cfg == nil {
+		cfg = &defaultWebsocketConfig
+	}
+
+	r := ctx.Request
+	if r.Method != http.MethodGet {
+		return nil, errors.New("websocket handshake requires GET method")
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") {
+		return nil, errors.New("websocket handshake missing upgrade headers")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("websocket handshake missing Sec-WebSocket-Key")
+	}
+
+	protocol := selectProtocol(r.Header, cfg.protocols)
+
+	if err := ctx.Writer.Hijack(); err != nil {
+		return nil, err
+	}
+
+	// The server may have set deadlines on the connection; a websocket
+	// lives beyond the lifetime of a single request.
+	conn, rw := ctx.Writer.Conn, ctx.Writer.ReadWriter
+	_ = conn.SetDeadline(time.Time{})
+
+	var sb strings.Builder
+	sb.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	sb.WriteString("Upgrade: websocket\r\n")
+	sb.WriteString("Connection: Upgrade\r\n")
+	sb.WriteString("Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n")
+	if protocol != "" {
+		sb.WriteString("Sec-WebSocket-Protocol: " + protocol + "\r\n")
+	}
+	sb.WriteString("\r\n")
+
+	if _, err := rw.WriteString(sb.String()); err != nil {
+		ctx.Writer.CloseHijack()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		ctx.Writer.CloseHijack()
+		return nil, err
+	}
+
+	ctx.Status.Code = http.StatusSwitchingProtocols
+	ctx.Status.Text = http.StatusText(http.StatusSwitchingProtocols)
+	// the socket may stay open for hours without holding a worker
+	ctx.detachProcessing()
+
+	return &Websocket{
+		conn:           conn,
+		rw:             rw,
+		maxMessageSize: cfg.maxMessageSize,
+	}, nil
+}
+
+func (ws *Websocket) read(L *lua.LState) int {
+	opcode, message, err := ws.ReadMessage()
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	messageType := "text"
+	if opcode == wsOpBinary {
+		messageType = "binary"
+	}
+	return util.Push(L, lua.LString(message), lua.LString(messageType))
+}
+
+func (ws *Websocket) write(L *lua.LState) int {
+	message, binary := L.CheckString(1), L.OptBool(2, false)
+	opcode := byte(wsOpText)
+	if binary {
+		opcode = wsOpBinary
+	}
+	if err := ws.WriteFrame(opcode, []byte(message)); err != nil {
+		return util.Error(L, err)
+	}
+	return 0
+}
+
+func (ws *Websocket) ping(L *lua.LState) int {
+	payload := L.OptString(1, "")
+	if len(payload) > 125 {
+		L.ArgError(1, "ping payload must not exceed 125 bytes")
+	}
+	if err := ws.WriteFrame(wsOpPing, []byte(payload)); err != nil {
+		return util.Error(L, err)
+	}
+	return 0
+}
+
+func (ws *Websocket) close(L *lua.LState) int {
+	code, reason := L.OptInt(1, wsCloseNormal), L.OptString(2, "")
+	if err := ws.Close(code, reason); err != nil {
+		return util.Error(L, err)
+	}
+	return 0
+}
+
+// ReadMessage returns the next complete data message, answering control
+// frames and reassembling fragmented messages along the way.
+func (ws *Websocket) ReadMessage() (byte, []byte, error) {
+	var message []byte
+	var opcode byte
+
+	for {
+		fin, op, payload, err := ws.readFrame()
+		if err != nil {
+			var wsErr *websocketError
+			if errors.As(err, &wsErr) {
+				ws.Close(wsErr.code, wsErr.reason)
+			} else {
+				ws.closeConn()
+			}
+			return 0, nil, err
+		}
+
+		switch op {
+		case wsOpPing:
+			if err := ws.WriteFrame(wsOpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+
+		case wsOpPong:
+			continue
+
+		case wsOpClose:
+			code, reason := wsCloseNormal, ""
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+				reason = string(payload[2:])
+			}
+			ws.Close(code, "")
+			return 0, nil, &websocketError{code: code, reason: reason}
+
+		case wsOpText, wsOpBinary:
+			if opcode != 0 {
+				err := &websocketError{wsCloseProtocolError, "unexpected data frame"}
+				ws.Close(err.code, err.reason)
+				return 0, nil, err
+			}
+			opcode = op
+			message = payload
+
+		case wsOpContinuation:
+			if opcode == 0 {
+				err := &websocketError{wsCloseProtocolError, "unexpected continuation frame"}
+				ws.Close(err.code, err.reason)
+				return 0, nil, err
+			}
+			message = append(message, payload...)
+
+		default:
+			err := &websocketError{wsCloseProtocolError, "unknown opcode"}
+			ws.Close(err.code, err.reason)
+			return 0, nil, err
+		}
+
+		if ws.maxMessageSize > 0 && int64(len(message)) > ws.maxMessageSize {
+			err := &websocketError{wsCloseTooBig, "message too big"}
+			ws.Close(err.code, err.reason)
+			return 0, nil, err
+		}
+
+		if fin {
+			if opcode == wsOpText && !utf8.Valid(message) {
+				err := &websocketError{wsCloseInvalidData, "invalid utf-8 text"}
+				ws.Close(err.code, err.reason)
+				return 0, nil, err
+			}
+			return opcode, message, nil
+		}
+	}
+}
+
+func (ws *Websocket) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.rw, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &websocketError{wsCloseProtocolError, "reserved bits set"}
+	}
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	if !masked {
+		return false, 0, nil, &websocketError{wsCloseProtocolError, "client frame not masked"}
+	}
+
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+
+	if opcode >= wsOpClose && (!fin || length > 125) {
+		return false, 0, nil, &websocketError{wsCloseProtocolError, "invalid control frame"}
+	}
+	if length < 0 || (ws.maxMessageSize > 0 && length > ws.maxMessageSize) {
+		return false, 0, nil, &websocketError{wsCloseTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.rw, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.rw, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteFrame sends a single unfragmented frame; server frames are never masked.
+func (ws *Websocket) WriteFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.closed {
+		return errors.New("websocket already closed")
+	}
+
+	header := make([]byte, 0, 10)
+	header = append(header, 0x80|opcode)
+	length := len(payload)
+	switch {
+	case length <= 125:
+		header = append(header, byte(length))
+	case length <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	if _, err := ws.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := ws.rw.Write(payload); err != nil {
+		return err
+	}
+	return ws.rw.Flush()
+}
+
+// Close sends a close frame with the given status code and closes the connection.
+func (ws *Websocket) Close(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	err := ws.WriteFrame(wsOpClose, payload)
+	ws.closeConn()
+	return err
+}
+
+func (ws *Websocket) closeConn() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if !ws.closed {
+		ws.closed = true
+		ws.conn.Close()
+	}
+}
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func selectProtocol(header http.Header, supported []string) string {
+	for _, value := range header.Values("Sec-WebSocket-Protocol") {
+		for _, requested := range strings.Split(value, ",") {
+			requested = strings.TrimSpace(requested)
+			for _, protocol := range supported {
+				if requested == protocol {
+					return protocol
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// TestWebsocketDetach keeps a websocket open past processingTimeout on the
+// only worker. The upgrade must stop the timeout and give the worker back.
+func TestWebsocketDetach(t *testing.T) {
+	s := newTestServer(t, func(cfg *ServerConfig) {
+		cfg.workers = 1
+		cfg.processingTimeout = 50 * time.Millisecond
+	})
+	var timeouts atomic.Int32
+	s.config.onTimeout = s.vm.NewFunction(func(L *lua.LState) int {
+		timeouts.Add(1)
+		return 0
+	})
+	release := make(chan struct{})
+	s.handleFunc(t, http.MethodGet, "/ws", func(L *lua.LState, ctx *Context) *HttpStatus {
+		ws, err := ctx.Websocket(nil)
+		if err != nil {
+			return &HttpStatus{Code: http.StatusBadRequest, Error: err}
+		}
+		<-release
+		ws.WriteFrame(wsOpText, []byte("late"))
+		ws.Close(1000, "")
+		return &HttpStatus{Code: http.StatusSwitchingProtocols}
+	})
+	s.handleFunc(t, http.MethodGet, "/page", func(L *lua.LState, ctx *Context) *HttpStatus {
+		ctx.Writer.Write([]byte("ok"))
+		return &HttpStatus{Code: http.StatusOK}
+	})
+	url := startTestServer(t, s)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade: status %v, err %v", res, err)
+	}
+
+	if res := <-get(url + "/page"); res.err != nil || res.body != "ok" {
+		t.Fatalf("worker still held by the websocket: body %q, err %v", res.body, res.err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	close(release)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	header := make([]byte, 2)
+	if _, err := br.Read(header); err != nil {
+		t.Fatal(err)
+	}
+	if opcode := header[0] & 0x0f; opcode != wsOpText {
+		t.Fatalf("got opcode %#x after processingTimeout, want a text frame", opcode)
+	}
+	if n := timeouts.Load(); n != 0 {
+		t.Fatalf("processingTimeout fired %d times on the websocket", n)
+	}
+}
@@ -4,16 +4,24 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"lug/util"
 	"net"
 	"net/http"
+	"sync"
+	"syscall"
 )
 
+var errResponseSent = errors.New("response already sent")
+
 type Writer struct {
 	ResponseWriter http.ResponseWriter
 	ReadWriter     *bufio.ReadWriter
 	Conn           net.Conn
-	TimedOut       bool
+	done           chan struct{}
+	mu             sync.Mutex
+	disconnected   bool
+	sent           bool
 	hijacked       bool
 	written        bool
 	length         int
@@ -24,7 +32,9 @@ func (w *Writer) Reset(res http.ResponseWriter) {
 	w.ResponseWriter = res
 	w.ReadWriter = nil
 	w.Conn = nil
-	w.TimedOut = false
+	w.done = make(chan struct{})
+	w.disconnected = false
+	w.sent = false
 	w.hijacked = false
 	w.written = false
 	w.length = 0
@@ -36,11 +46,38 @@ func (w *Writer) Length() int {
 }
 
 func (w *Writer) Write(body []byte) (int, error) {
+	return w.write(func(rw http.ResponseWriter) (int, error) {
+		return rw.Write(body)
+	})
+}
+
+// WriteString writes s without first copying it into a byte slice when the
+// underlying writer supports io.StringWriter.
+func (w *Writer) WriteString(s string) (int, error) {
+	return w.write(func(rw http.ResponseWriter) (int, error) {
+		return io.WriteString(rw, s)
+	})
+}
+
+func (w *Writer) write(send func(http.ResponseWriter) (int, error)) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// The client is gone, there is nobody left to write to.
+	if w.disconnected {
+		return 0, errClientGone
+	}
+
 	// Check if the response is already hijacked or timed out.
 	if err := w.Hijacked(); err != nil {
 		return 0, err
 	}
 
+	// An error page or redirect already completed the response.
+	if w.sent {
+		return 0, errResponseSent
+	}
+
 	// If the header hasn't been written yet, write the default status code.
 	if !w.written {
 		if err := w.writeHeader(w.statusCode); err != nil {
@@ -48,8 +85,12 @@ func (w *Writer) Write(body []byte) (int, error) {
 		}
 	}
 
-	length, err := w.ResponseWriter.Write(body)
+	length, err := send(w.ResponseWriter)
 	if err != nil {
+		if isDisconnectError(err) {
+			w.disconnected = true
+			return 0, errClientGone
+		}
 		return 0, fmt.Errorf("error writing to response writer: %w", err)
 	}
 
@@ -58,6 +99,8 @@ func (w *Writer) Write(body []byte) (int, error) {
 }
 
 func (w *Writer) WriteHeader(statusCode int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	if w.written {
 		return errors.New("superfluous response.WriteHeader")
 	}
@@ -82,9 +125,14 @@ func (w *Writer) writeHeader(statusCode int) error {
 }
 
 func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	if err := w.Hijacked(); err != nil {
 		return err
 	}
+	if w.disconnected {
+		return nil
+	}
 	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
 		flusher.Flush()
 	}
@@ -92,6 +140,8 @@ func (w *Writer) Flush() error {
 }
 
 func (w *Writer) Hijack() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
 	if err := w.Hijacked(); err != nil {
 		return err
@@ -168,13 +218,46 @@ func (w *Writer) Hijacked() error {
 	switch {
 	case w.hijacked:
 		return errors.New("response already hijacked")
-	case w.TimedOut:
+	case w.TimedOut():
 		return errors.New("response processing timeout")
 	default:
 		return nil
 	}
 }
 
+// TimedOut reports whether the server gave up waiting for the handler.
+func (w *Writer) TimedOut() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// timeout takes the response away from the handler. A write in progress
+// finishes first, later ones fail. It reports whether nothing was written,
+// so the server can still send its own response.
+func (w *Writer) timeout() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	close(w.done)
+	return !w.written && !w.hijacked
+}
+
+// Disconnected reports whether a write failed because the client went away.
+func (w *Writer) Disconnected() bool {
+	return w.disconnected
+}
+
+// isDisconnectError reports whether err means the peer closed the connection.
+func isDisconnectError(err error) bool {
+	return errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, http.ErrHandlerTimeout) ||
+		errors.Is(err, net.ErrClosed)
+}
+
 func (w *Writer) Written() error {
 	if w.written {
 		return errors.New("response already written")
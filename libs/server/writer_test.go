@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// goneWriter is a ResponseWriter whose client has hung up.
+type goneWriter struct {
+	header http.Header
+	code   int
+	writes int
+}
+
+func (w *goneWriter) Header() http.Header { return w.header }
+
+func (w *goneWriter) WriteHeader(code int) { w.code = code }
+
+func (w *goneWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}
+}
+
+func TestWriterClientGone(t *testing.T) {
+	rw := &goneWriter{header: http.Header{}}
+	var w Writer
+	w.Reset(rw)
+
+	if _, err := w.Write([]byte("first")); !errors.Is(err, errClientGone) {
+		t.Fatalf("first write: got %v, want errClientGone", err)
+	}
+	if _, err := w.Write([]byte("second")); !errors.Is(err, errClientGone) {
+		t.Fatalf("second write: got %v, want errClientGone", err)
+	}
+	if rw.writes != 1 {
+		t.Fatalf("writes after the disconnect reached the connection: %d", rw.writes)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("flush after disconnect: %v", err)
+	}
+}
+
+// TestContextWriteClientGone checks that ctx.write on a closed connection
+// reports nothing written instead of failing the handler.
+func TestContextWriteClientGone(t *testing.T) {
+	s := newTestServer(t, nil)
+	results := s.handleLua(t, http.MethodGet, "/", `function(ctx)
+		local first = ctx.write("hello")
+		local second = ctx.write("world")
+		report(first, second)
+	end`)
+
+	rw := &goneWriter{header: http.Header{}}
+	s.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	values := <-results
+	for i, v := range values {
+		if v != lua.LNumber(0) {
+			t.Errorf("write %d returned %v, want 0", i+1, v)
+		}
+	}
+	if rw.writes != 1 {
+		t.Errorf("got %d writes on the closed connection, want 1", rw.writes)
+	}
+	if rw.code != http.StatusOK {
+		t.Errorf("status %d, the disconnect must not turn into an error response", rw.code)
+	}
+}
+
+// TestWriteAfterError checks that once the error page went out, neither
+// ctx.write nor another ctx.error can add to the response.
+func TestWriteAfterError(t *testing.T) {
+	s := newTestServer(t, nil)
+	results := s.handleLua(t, http.MethodGet, "/", `function(ctx)
+		local first = ctx.error(404, "missing")
+		local write = ctx.write("tail")
+		local second = ctx.error(500, "again")
+		report(first, write, second)
+	end`)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	values := <-results
+	if values[0] != lua.LNil {
+		t.Errorf("first error returned %v", values[0])
+	}
+	for i, v := range values[1:] {
+		if v != lua.LString(errResponseSent.Error()) {
+			t.Errorf("call %d returned %v, want %q", i+2, v, errResponseSent)
+		}
+	}
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", rec.Code)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "tail") || strings.Contains(body, "again") {
+		t.Errorf("response mixes content after the error page: %q", body)
+	}
+}
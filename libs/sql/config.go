@@ -11,11 +11,13 @@ import (
 
 type (
 	dbConfig struct {
-		shared       bool
-		maxOpenConns int
-		maxIdleConns int
-		dsn          string
-		driver       string
+		shared        bool
+		maxOpenConns  int
+		maxIdleConns  int
+		stmtCacheSize int
+		queryTimeout  time.Duration // 0 means statements may run forever
+		dsn           string
+		driver        string
 	}
 	txConfig struct {
 		options *sql.TxOptions
@@ -36,10 +38,11 @@ func getConfig(L *lua.LState) *dbConfig {
 		L.ArgError(2, "dsn cannot be empty")
 	}
 	config := &dbConfig{
-		maxOpenConns: 1,
-		maxIdleConns: 2,
-		dsn:          dsn,
-		driver:       driver,
+		maxOpenConns:  1,
+		maxIdleConns:  2,
+		stmtCacheSize: 64,
+		dsn:           dsn,
+		driver:        driver,
 	}
 
 	lopts.ForEach(func(k lua.LValue, v lua.LValue) {
@@ -66,6 +69,19 @@ func getConfig(L *lua.LState) *dbConfig {
 				config.maxOpenConns = val
 			}
 
+		case `queryTimeout`:
+			if val, ok := util.CheckDuration(L, key, v, 3); ok {
+				config.queryTimeout = val
+			}
+
+		case `stmtCacheSize`:
+			if val, ok := util.CheckInt(L, key, v, 3); ok {
+				if val < 0 {
+					L.ArgError(3, "stmtCacheSize must be non-negative")
+				}
+				config.stmtCacheSize = val
+			}
+
 		}
 	})
 
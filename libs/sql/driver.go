@@ -14,6 +14,7 @@ import (
 type SQL struct {
 	instance *sql.DB
 	config   dbConfig
+	stmts    *stmtCache // nil when stmtCacheSize is 0
 	refs     int
 	locker   sync.Mutex
 }
@@ -26,8 +27,11 @@ var (
 // NewSQL creates a new SQL instance with the given configuration.
 func NewSQL(config dbConfig) (*SQL, error) {
 
-	if config.driver == "sqlite" {
+	switch config.driver {
+	case "sqlite":
 		config.driver = "sqlite3"
+	case "postgresql", "pg":
+		config.driver = "postgres"
 	}
 
 	if !isDriverSupported(config.driver) {
@@ -62,12 +66,23 @@ func NewSQL(config dbConfig) (*SQL, error) {
 	}
 
 	sqlInstance := &SQL{instance: db, config: config, refs: 1}
+	if config.stmtCacheSize > 0 {
+		sqlInstance.stmts = newStmtCache(config.stmtCacheSize)
+	}
 	if config.shared {
 		shared[config.dsn] = sqlInstance
 	}
 	return sqlInstance, nil
 }
 
+// rebind adapts the ? placeholders built by the module to the driver.
+func (s *SQL) rebind(query string) string {
+	if s.config.driver == "postgres" {
+		return bindDollar(query)
+	}
+	return query
+}
+
 // isDriverSupported checks if the given driver is supported.
 func isDriverSupported(driver string) bool {
 	for _, d := range sql.Drivers() {
@@ -93,5 +108,8 @@ func (s *SQL) close() error {
 		}
 		delete(shared, s.config.dsn)
 	}
+	if s.stmts != nil {
+		s.stmts.clear()
+	}
 	return s.instance.Close()
 }
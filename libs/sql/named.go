@@ -0,0 +1,167 @@
+package sql
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// bindNamed rewrites :name parameters to positional ? placeholders and
+// returns the values in placeholder order. Quoted strings and identifiers,
+// comments and postgres ::casts are left untouched.
+func bindNamed(query string, params *lua.LTable) (string, []interface{}, error) {
+	var builder strings.Builder
+	var args []interface{}
+	runes := []rune(query)
+
+	for i := 0; i < len(runes); i++ {
+		if j := skipQuoted(runes, i); j > i {
+			builder.WriteString(string(runes[i:j]))
+			i = j - 1
+			continue
+		}
+		r := runes[i]
+		switch {
+		case r == ':' && runeAt(runes, i+1) == ':':
+			// ::type cast
+			builder.WriteString("::")
+			i++
+			continue
+		case r == ':' && isNameStart(runeAt(runes, i+1)):
+			j := i + 1
+			for j < len(runes) && isNamePart(runes[j]) {
+				j++
+			}
+			name := string(runes[i+1 : j])
+			value := params.RawGetString(name)
+			if value == lua.LNil {
+				return "", nil, fmt.Errorf("missing value for named parameter :%s", name)
+			}
+			builder.WriteByte('?')
+			args = append(args, value)
+			i = j - 1
+			continue
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String(), args, nil
+}
+
+// bindDollar rewrites ? placeholders to the $1, $2... form postgres expects.
+// Quoted strings and identifiers, comments and dollar-quoted bodies are left
+// untouched, as are the jsonb ?| and ?& operators. The jsonb ? operator is
+// written ?? since it cannot be told apart from a placeholder.
+func bindDollar(query string) string {
+	if !strings.ContainsRune(query, '?') {
+		return query
+	}
+	var builder strings.Builder
+	runes := []rune(query)
+	n := 0
+
+	for i := 0; i < len(runes); i++ {
+		if j := skipQuoted(runes, i); j > i {
+			builder.WriteString(string(runes[i:j]))
+			i = j - 1
+			continue
+		}
+		r := runes[i]
+		if r != '?' {
+			builder.WriteRune(r)
+			continue
+		}
+		switch next := runeAt(runes, i+1); {
+		case next == '?':
+			builder.WriteByte('?')
+			i++
+		case next == '|' && runeAt(runes, i+2) != '|',
+			next == '&' && runeAt(runes, i+2) != '&':
+			builder.WriteByte('?')
+		default:
+			n++
+			builder.WriteByte('$')
+			builder.WriteString(strconv.Itoa(n))
+		}
+	}
+	return builder.String()
+}
+
+// skipQuoted returns the index just past the quoted string or identifier,
+// comment or dollar-quoted body starting at runes[i], or i if none does.
+// Unterminated ones run to the end of the query.
+func skipQuoted(runes []rune, i int) int {
+	switch r := runes[i]; {
+	case r == '\'' || r == '"' || r == '`':
+		if end := indexRunes(runes, i+1, []rune{r}); end >= 0 {
+			return end + 1
+		}
+	case r == '-' && runeAt(runes, i+1) == '-':
+		if end := indexRunes(runes, i+2, []rune{'\n'}); end >= 0 {
+			return end
+		}
+	case r == '/' && runeAt(runes, i+1) == '*':
+		// postgres block comments nest
+		depth := 0
+		for j := i; j+1 < len(runes); j++ {
+			switch {
+			case runes[j] == '/' && runes[j+1] == '*':
+				depth++
+				j++
+			case runes[j] == '*' && runes[j+1] == '/':
+				depth--
+				j++
+				if depth == 0 {
+					return j + 1
+				}
+			}
+		}
+	case r == '$' && (i == 0 || !isNamePart(runes[i-1])):
+		// $$body$$ or $tag$body$tag$, but not a $1 parameter
+		j := i + 1
+		if isNameStart(runeAt(runes, j)) {
+			for j < len(runes) && isNamePart(runes[j]) {
+				j++
+			}
+		}
+		if runeAt(runes, j) != '$' {
+			return i
+		}
+		tag := runes[i : j+1]
+		if end := indexRunes(runes, j+1, tag); end >= 0 {
+			return end + len(tag)
+		}
+	default:
+		return i
+	}
+	return len(runes)
+}
+
+// runeAt returns runes[i], or 0 past the end.
+func runeAt(runes []rune, i int) rune {
+	if i < len(runes) {
+		return runes[i]
+	}
+	return 0
+}
+
+// indexRunes finds sub in runes at or after from, -1 if it is not there.
+func indexRunes(runes []rune, from int, sub []rune) int {
+	for i := from; i+len(sub) <= len(runes); i++ {
+		if slices.Equal(runes[i:i+len(sub)], sub) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isNameStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isNamePart(r rune) bool {
+	return isNameStart(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,53 @@
+package sql
+
+import (
+	"reflect"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestBindDollar(t *testing.T) {
+	tests := []struct{ query, want string }{
+		{"SELECT * FROM t WHERE a = ? AND b = ?", "SELECT * FROM t WHERE a = $1 AND b = $2"},
+		{"SELECT '?', \"?\" FROM t WHERE a = ?", "SELECT '?', \"?\" FROM t WHERE a = $1"},
+		{"SELECT 'it''s ?' WHERE a = ?", "SELECT 'it''s ?' WHERE a = $1"},
+		{"SELECT a -- why?\nFROM t WHERE a = ?", "SELECT a -- why?\nFROM t WHERE a = $1"},
+		{"SELECT /* a? /* nested? */ b? */ a FROM t WHERE a = ?", "SELECT /* a? /* nested? */ b? */ a FROM t WHERE a = $1"},
+		{"SELECT $$ ? $$, $fn$ ? $fn$ WHERE a = ?", "SELECT $$ ? $$, $fn$ ? $fn$ WHERE a = $1"},
+		{"SELECT a$b FROM t WHERE a = ?", "SELECT a$b FROM t WHERE a = $1"},
+		{"SELECT * FROM t WHERE data ?| array['a'] AND data ?& ? AND id = ?", "SELECT * FROM t WHERE data ?| array['a'] AND data ?& $1 AND id = $2"},
+		{"SELECT * FROM t WHERE data ?? 'key' AND id = ?", "SELECT * FROM t WHERE data ? 'key' AND id = $1"},
+		{"SELECT ?||'x', ?&&array[1]", "SELECT $1||'x', $2&&array[1]"},
+		{"SELECT 1 -- trailing ?", "SELECT 1 -- trailing ?"},
+		{"SELECT '?", "SELECT '?"},
+	}
+	for _, tt := range tests {
+		if got := bindDollar(tt.query); got != tt.want {
+			t.Errorf("bindDollar(%q)\n got %q\nwant %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestBindNamed(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	params := L.NewTable()
+	params.RawSetString("id", lua.LNumber(7))
+	params.RawSetString("name", lua.LString("ann"))
+
+	query, args, err := bindNamed("SELECT x::int, ':id' -- :missing\n/* :missing */ FROM t WHERE id = :id AND name = :name OR id = :id", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "SELECT x::int, ':id' -- :missing\n/* :missing */ FROM t WHERE id = ? AND name = ? OR id = ?"; query != want {
+		t.Errorf("got %q, want %q", query, want)
+	}
+	if want := []interface{}{lua.LNumber(7), lua.LString("ann"), lua.LNumber(7)}; !reflect.DeepEqual(args, want) {
+		t.Errorf("got args %v, want %v", args, want)
+	}
+
+	if _, _, err := bindNamed("SELECT :missing", params); err == nil {
+		t.Error("expected an error for a parameter without value")
+	}
+}
@@ -3,8 +3,11 @@ package sql
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"lug/util"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -47,22 +50,31 @@ func Loader(L *lua.LState) int {
 
 func extendMethods(s *Sql) util.Methods {
 	return util.Methods{
-		"table":    s.Table,
-		"fields":   s.Fields,
-		"where":    s.Where,
-		"group":    s.Group,
-		"having":   s.Having,
-		"order":    s.Order,
-		"limit":    s.Limit,
-		"offset":   s.Offset,
-		"query":    s.Query,
-		"fetchAll": s.FetchAll,
-		"fetch":    s.Fetch,
-		"exec":     s.Exec,
-		"insert":   s.Insert,
-		"update":   s.Update,
-		"delete":   s.Delete,
-		"count":    s.Count,
+		"table":        s.Table,
+		"fields":       s.Fields,
+		"where":        s.Where,
+		"orWhere":      s.OrWhere,
+		"whereEq":      s.WhereEq,
+		"whereIn":      s.WhereIn,
+		"whereLike":    s.WhereLike,
+		"whereBetween": s.WhereBetween,
+		"group":        s.Group,
+		"having":       s.Having,
+		"order":        s.Order,
+		"limit":        s.Limit,
+		"offset":       s.Offset,
+		"query":        s.Query,
+		"fetchAll":     s.FetchAll,
+		"fetch":        s.Fetch,
+		"each":         s.Each,
+		"exec":         s.Exec,
+		"insert":       s.Insert,
+		"insertMany":   s.InsertMany,
+		"upsert":       s.Upsert,
+		"update":       s.Update,
+		"delete":       s.Delete,
+		"count":        s.Count,
+		"paginate":     s.Paginate,
 	}
 }
 
@@ -79,6 +91,7 @@ func open(L *lua.LState) int {
 
 	api := util.SetMethods(L, extendMethods(instance), util.Methods{
 		"transaction": instance.Transaction,
+		"stats":       instance.Stats,
 		"close":       instance.Close,
 	})
 	instance.api = api
@@ -138,6 +151,22 @@ func (s *Sql) Commit(L *lua.LState) int {
 	return 0
 }
 
+// Stats reports the state of the connection pool, durations are in seconds.
+func (s *Sql) Stats(L *lua.LState) int {
+	stats := s.sql.instance.Stats()
+	t := L.CreateTable(0, 9)
+	t.RawSetString("maxOpenConnections", lua.LNumber(stats.MaxOpenConnections))
+	t.RawSetString("openConnections", lua.LNumber(stats.OpenConnections))
+	t.RawSetString("inUse", lua.LNumber(stats.InUse))
+	t.RawSetString("idle", lua.LNumber(stats.Idle))
+	t.RawSetString("waitCount", lua.LNumber(stats.WaitCount))
+	t.RawSetString("waitDuration", lua.LNumber(stats.WaitDuration.Seconds()))
+	t.RawSetString("maxIdleClosed", lua.LNumber(stats.MaxIdleClosed))
+	t.RawSetString("maxIdleTimeClosed", lua.LNumber(stats.MaxIdleTimeClosed))
+	t.RawSetString("maxLifetimeClosed", lua.LNumber(stats.MaxLifetimeClosed))
+	return util.Push(L, t)
+}
+
 func (s *Sql) Close(L *lua.LState) int {
 	if err := s.sql.close(); err != nil {
 		return util.Error(L, err)
@@ -160,13 +189,89 @@ func (s *Sql) Fields(L *lua.LState) int {
 	return util.Push(L, s.api)
 }
 
+// Where adds a raw condition. Conditions added by the where builders are
+// joined with AND, orWhere joins with OR; AND binds tighter as in SQL.
+// Where adds a raw condition, ANDed with those added before it rather than
+// replacing them. OrWhere joins its condition with OR.
 func (s *Sql) Where(L *lua.LState) int {
 	query, args := s.getNativeQuery(L)
-	s.where = query
-	s.args = append(s.args, args...)
+	s.addWhere("AND", query, args...)
 	return util.Push(L, s.api)
 }
 
+func (s *Sql) OrWhere(L *lua.LState) int {
+	query, args := s.getNativeQuery(L)
+	s.addWhere("OR", query, args...)
+	return util.Push(L, s.api)
+}
+
+// WhereEq adds col = value, or col IS NULL for a nil value.
+func (s *Sql) WhereEq(L *lua.LState) int {
+	col := checkColumn(L, 1)
+	if value := L.Get(2); value == lua.LNil {
+		s.addWhere("AND", col+" IS NULL")
+	} else {
+		s.addWhere("AND", col+" = ?", value)
+	}
+	return util.Push(L, s.api)
+}
+
+// WhereIn adds col IN (...) with one placeholder per value. An empty list
+// matches no rows.
+func (s *Sql) WhereIn(L *lua.LState) int {
+	col := checkColumn(L, 1)
+	list := L.CheckTable(2)
+	n := list.Len()
+	if n == 0 {
+		s.addWhere("AND", "1 = 0")
+		return util.Push(L, s.api)
+	}
+	args := make([]interface{}, n)
+	for i := range args {
+		args[i] = list.RawGetInt(i + 1)
+	}
+	placeholders := strings.Repeat(", ?", n)[2:]
+	s.addWhere("AND", col+" IN ("+placeholders+")", args...)
+	return util.Push(L, s.api)
+}
+
+func (s *Sql) WhereLike(L *lua.LState) int {
+	col := checkColumn(L, 1)
+	pattern := L.CheckString(2)
+	s.addWhere("AND", col+" LIKE ?", lua.LString(pattern))
+	return util.Push(L, s.api)
+}
+
+func (s *Sql) WhereBetween(L *lua.LState) int {
+	col := checkColumn(L, 1)
+	low, high := L.CheckAny(2), L.CheckAny(3)
+	s.addWhere("AND", col+" BETWEEN ? AND ?", low, high)
+	return util.Push(L, s.api)
+}
+
+func (s *Sql) addWhere(op, cond string, args ...interface{}) {
+	if s.where == "" {
+		s.where = "(" + cond + ")"
+	} else {
+		s.where += " " + op + " (" + cond + ")"
+	}
+	s.args = append(s.args, args...)
+}
+
+// checkColumn only accepts plain, optionally table qualified, column names
+// since they are written into the query as is.
+func checkColumn(L *lua.LState, n int) string {
+	col := L.CheckString(n)
+	for _, part := range strings.Split(col, ".") {
+		if part == "" || !isNameStart([]rune(part)[0]) || strings.IndexFunc(part, func(r rune) bool {
+			return !isNamePart(r)
+		}) >= 0 {
+			L.ArgError(n, "invalid column name: "+col)
+		}
+	}
+	return col
+}
+
 func (s *Sql) Group(L *lua.LState) int {
 	s.groupBy = L.CheckString(1)
 	return util.Push(L, s.api)
@@ -209,6 +314,55 @@ func (s *Sql) Fetch(L *lua.LState) int {
 	return s.query(L, query, args, false)
 }
 
+// Each streams the rows of the built query, or of a raw query given before
+// the callback, to fn one at a time instead of collecting them in a table.
+// Returning false from fn stops the iteration. The number of rows passed to
+// fn is returned. A connection is held until the iteration ends, so with the
+// default maxOpenConns of 1 fn must not query the same database.
+func (s *Sql) Each(L *lua.LState) int {
+	top := L.GetTop()
+	fn := L.CheckFunction(top)
+	var query string
+	var args []interface{}
+	if top == 1 {
+		if err := s.checkTable("each"); err != nil {
+			return util.NilError(L, err)
+		}
+		query, args = s.getConditionalQuery()
+	} else {
+		L.Pop(1)
+		query, args = s.getNativeQuery(L)
+	}
+
+	rows, release, err := s.queryStmt(query, args)
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	defer release()
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		row, err := s.makeRow(L, rows)
+		if err != nil {
+			return util.NilError(L, err)
+		}
+		count++
+		if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, row); err != nil {
+			return util.NilError(L, err)
+		}
+		stop := L.Get(-1) == lua.LFalse
+		L.Pop(1)
+		if stop {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, lua.LNumber(count))
+}
+
 func (s *Sql) Exec(L *lua.LState) int {
 	query, args := s.getNativeQuery(L)
 	return s.exec(L, query, args)
@@ -231,6 +385,138 @@ func (s *Sql) Insert(L *lua.LState) int {
 	return s.exec(L, query, values)
 }
 
+// Upsert inserts a row or, when it collides on the conflict columns, updates
+// the update columns of the existing row with the new values. Without update
+// columns every inserted column except the conflict columns is updated, an
+// empty table leaves the existing row untouched. mysql resolves conflicts on
+// any unique key and ignores the conflict columns.
+func (s *Sql) Upsert(L *lua.LState) int {
+	if err := s.checkTable("upsert"); err != nil {
+		return util.NilError(L, err)
+	}
+	columns, values := s.processTableData(L)
+	if len(columns) == 0 {
+		L.ArgError(1, "upsert requires at least one column")
+	}
+	conflict, _ := util.CheckTable(L, "conflictColumns", L.Get(2), 2)
+
+	inserted := make(map[string]bool, len(columns))
+	for _, col := range columns {
+		inserted[col] = true
+	}
+	var update []string
+	if L.Get(3) == lua.LNil {
+		for _, col := range columns {
+			if !slices.Contains(conflict, col) {
+				update = append(update, col)
+			}
+		}
+		sort.Strings(update)
+	} else {
+		update, _ = util.CheckTable(L, "updateColumns", L.Get(3), 3)
+		for _, col := range update {
+			if !inserted[col] {
+				L.ArgError(3, "update column "+col+" is not in the inserted data")
+			}
+		}
+	}
+
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = "?"
+	}
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "INSERT INTO %s (%s) VALUES (%s)",
+		s.table,
+		strings.Join(columns, ", "),
+		strings.Join(placeholders, ", "),
+	)
+
+	assignments := make([]string, len(update))
+	if s.sql.config.driver == "mysql" {
+		for i, col := range update {
+			assignments[i] = col + " = VALUES(" + col + ")"
+		}
+		if len(assignments) == 0 {
+			// a self assignment is mysql's way to ignore the duplicate
+			assignments = append(assignments, columns[0]+" = "+columns[0])
+		}
+		builder.WriteString(" ON DUPLICATE KEY UPDATE ")
+		builder.WriteString(strings.Join(assignments, ", "))
+		return s.exec(L, builder.String(), values)
+	}
+
+	if len(conflict) == 0 {
+		L.ArgError(2, "upsert requires conflict columns")
+	}
+	builder.WriteString(" ON CONFLICT (")
+	builder.WriteString(strings.Join(conflict, ", "))
+	builder.WriteString(")")
+	if len(update) == 0 {
+		builder.WriteString(" DO NOTHING")
+	} else {
+		for i, col := range update {
+			assignments[i] = col + " = excluded." + col
+		}
+		builder.WriteString(" DO UPDATE SET ")
+		builder.WriteString(strings.Join(assignments, ", "))
+	}
+	return s.exec(L, builder.String(), values)
+}
+
+// InsertMany inserts an array of rows with one multi-row INSERT. Every row
+// must have the same columns.
+func (s *Sql) InsertMany(L *lua.LState) int {
+	if err := s.checkTable("insertMany"); err != nil {
+		return util.NilError(L, err)
+	}
+	rows := L.CheckTable(1)
+	n := rows.Len()
+	if n == 0 {
+		return util.NilError(L, errors.New("insertMany requires at least one row"))
+	}
+
+	var columns []string
+	first, ok := rows.RawGetInt(1).(*lua.LTable)
+	if !ok {
+		return util.NilError(L, errors.New("insertMany row 1 is not a table"))
+	}
+	first.ForEach(func(lk, _ lua.LValue) {
+		columns = append(columns, lk.String())
+	})
+	sort.Strings(columns)
+
+	placeholder := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")"
+	placeholders := make([]string, n)
+	values := make([]interface{}, 0, n*len(columns))
+	for i := 1; i <= n; i++ {
+		row, ok := rows.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			return util.NilError(L, fmt.Errorf("insertMany row %d is not a table", i))
+		}
+		count := 0
+		row.ForEach(func(_, _ lua.LValue) { count++ })
+		if count != len(columns) {
+			return util.NilError(L, fmt.Errorf("insertMany row %d has %d columns, expected %d", i, count, len(columns)))
+		}
+		for _, col := range columns {
+			value := row.RawGetString(col)
+			if value == lua.LNil {
+				return util.NilError(L, fmt.Errorf("insertMany row %d is missing column %s", i, col))
+			}
+			values = append(values, value)
+		}
+		placeholders[i-1] = placeholder
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s",
+		s.table,
+		strings.Join(columns, ", "),
+		strings.Join(placeholders, ", "),
+	)
+	return s.exec(L, query, values)
+}
+
 func (s *Sql) Update(L *lua.LState) int {
 	if err := s.checkTable("update"); err != nil {
 		return util.NilError(L, err)
@@ -272,37 +558,109 @@ func (s *Sql) Delete(L *lua.LState) int {
 }
 
 func (s *Sql) Count(L *lua.LState) int {
+	defer s.resetConditional()
+	count, err := s.count()
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	return util.Push(L, lua.LNumber(count))
+}
+
+// Paginate fetches one page of the built query together with the total
+// number of matching rows.
+func (s *Sql) Paginate(L *lua.LState) int {
+	page := L.CheckInt(1)
+	perPage := L.CheckInt(2)
+	if page < 1 {
+		L.ArgError(1, "page must be at least 1")
+	}
+	if perPage < 1 {
+		L.ArgError(2, "perPage must be at least 1")
+	}
+	if err := s.checkTable("paginate"); err != nil {
+		s.resetConditional()
+		return util.NilError(L, err)
+	}
+
+	total, err := s.count()
+	if err != nil {
+		s.resetConditional()
+		return util.NilError(L, err)
+	}
+
+	s.limit = perPage
+	s.offset = (page - 1) * perPage
+	query, args := s.getConditionalQuery()
+	rows, release, err := s.queryStmt(query, args)
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	defer release()
+	defer rows.Close()
+
+	lrows, err := s.parseRows(L, rows, true)
+	if err != nil {
+		return util.NilError(L, err)
+	}
+
+	result := L.CreateTable(0, 5)
+	result.RawSetString("rows", lrows)
+	result.RawSetString("total", lua.LNumber(total))
+	result.RawSetString("page", lua.LNumber(page))
+	result.RawSetString("perPage", lua.LNumber(perPage))
+	result.RawSetString("pages", lua.LNumber((total+int64(perPage)-1)/int64(perPage)))
+	return util.Push(L, result)
+}
+
+// count runs COUNT(*) over the table and where clause of the builder. A
+// grouped query is counted by its groups.
+func (s *Sql) count() (int64, error) {
 	var builder strings.Builder
-	builder.WriteString("SELECT count(*) FROM ")
+	if s.groupBy != "" {
+		builder.WriteString("SELECT count(*) FROM (SELECT 1 FROM ")
+	} else {
+		builder.WriteString("SELECT count(*) FROM ")
+	}
 	builder.WriteString(s.table)
 
 	if s.where != "" {
 		builder.WriteString(" WHERE ")
 		builder.WriteString(s.where)
 	}
+	if s.groupBy != "" {
+		builder.WriteString(" GROUP BY ")
+		builder.WriteString(s.groupBy)
+		if s.having != "" {
+			builder.WriteString(" HAVING ")
+			builder.WriteString(s.having)
+		}
+		builder.WriteString(") AS grouped")
+	}
 
-	query := builder.String()
-	row := s.sql.instance.QueryRow(query, s.args...)
+	rows, release, err := s.queryStmt(builder.String(), s.args)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	defer rows.Close()
 
 	var count int64
-	if err := row.Scan(&count); err != nil {
-		return util.NilError(L, err)
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, sql.ErrNoRows
 	}
-	return util.Push(L, lua.LNumber(count))
+	if err := rows.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
 }
 
+// exec runs a statement and ends the current builder chain.
 func (s *Sql) exec(L *lua.LState, query string, args []interface{}) int {
-	var result sql.Result
-	var err error
-	if s.tx != nil {
-		result, err = s.tx.Exec(query, args...)
-	} else {
-		result, err = s.sql.instance.Exec(query, args...)
-	}
-	if err != nil {
-		return util.NilError(L, err)
-	}
-	LastInsertId, err := result.LastInsertId()
+	s.resetConditional()
+	result, err := s.execStmt(query, args)
 	if err != nil {
 		return util.NilError(L, err)
 	}
@@ -311,22 +669,24 @@ func (s *Sql) exec(L *lua.LState, query string, args []interface{}) int {
 		return util.NilError(L, err)
 	}
 	rTable := L.NewTable()
-	rTable.RawSetString("lastInsertId", lua.LNumber(LastInsertId))
 	rTable.RawSetString("rowsAffected", lua.LNumber(RowsAffected))
+	// postgres has no last insert id, use RETURNING with query instead
+	if s.sql.config.driver != "postgres" {
+		LastInsertId, err := result.LastInsertId()
+		if err != nil {
+			return util.NilError(L, err)
+		}
+		rTable.RawSetString("lastInsertId", lua.LNumber(LastInsertId))
+	}
 	return util.Push(L, rTable)
 }
 
 func (s *Sql) query(L *lua.LState, query string, args []interface{}, isRows bool) int {
-	var rows *sql.Rows
-	var err error
-	if s.tx != nil {
-		rows, err = s.tx.Query(query, args...)
-	} else {
-		rows, err = s.sql.instance.Query(query, args...)
-	}
+	rows, release, err := s.queryStmt(query, args)
 	if err != nil {
 		return util.NilError(L, err)
 	}
+	defer release()
 	defer rows.Close()
 
 	lrows, err := s.parseRows(L, rows, isRows)
@@ -346,8 +706,15 @@ func (s *Sql) parseRows(L *lua.LState, rows *sql.Rows, isRows bool) (*lua.LTable
 			}
 			lRows.Append(rowTable)
 		}
+		// a query cancelled by queryTimeout ends the iteration early
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
 	} else {
 		if !rows.Next() {
+			if err := rows.Err(); err != nil {
+				return nil, err
+			}
 			return nil, sql.ErrNoRows
 		}
 		rowTable, err := s.makeRow(L, rows)
@@ -359,6 +726,8 @@ func (s *Sql) parseRows(L *lua.LState, rows *sql.Rows, isRows bool) (*lua.LTable
 	return lRows, nil
 }
 
+// makeRow converts the current row to a table keyed by column name. NULL
+// columns are nil in Lua and therefore not present in the table.
 func (s *Sql) makeRow(L *lua.LState, rows *sql.Rows) (*lua.LTable, error) {
 	columns, err := rows.Columns()
 	if err != nil {
@@ -377,19 +746,31 @@ func (s *Sql) makeRow(L *lua.LState, rows *sql.Rows) (*lua.LTable, error) {
 	lRows := L.CreateTable(0, clen)
 
 	for i, col := range columns {
-		val := values[i]
-		// lColumns.Append(lua.LString(col))
-		if bt, ok := val.([]byte); ok {
-			lRows.RawSetString(col, lua.LString(bt))
-		} else {
+		switch val := values[i].(type) {
+		case nil:
+			// NULL is nil, so the column is absent from the row table
+			// while an empty string stays ""
+			lRows.RawSetString(col, lua.LNil)
+		case []byte:
+			lRows.RawSetString(col, lua.LString(val))
+		default:
 			lRows.RawSetString(col, util.ToLuaValue(val))
 		}
 	}
 	return lRows, nil
 }
 
+// getNativeQuery reads a query and its arguments, either positional values
+// for ? placeholders or a single table of values for :name parameters.
 func (s *Sql) getNativeQuery(L *lua.LState) (string, []interface{}) {
 	query := L.CheckString(1)
+	if params, ok := L.Get(2).(*lua.LTable); ok && L.GetTop() == 2 {
+		query, args, err := bindNamed(query, params)
+		if err != nil {
+			L.ArgError(2, err.Error())
+		}
+		return query, args
+	}
 	var args []interface{}
 	for i := 2; i <= L.GetTop(); i++ {
 		args = append(args, L.CheckAny(i))
@@ -0,0 +1,65 @@
+package sql
+
+import (
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// runLua runs a script with the sql module preloaded and fails the test on
+// any Lua error.
+func runLua(t *testing.T, script string) {
+	t.Helper()
+	L := lua.NewState()
+	defer L.Close()
+	L.PreloadModule("sql", Loader)
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNullColumn(t *testing.T) {
+	runLua(t, `
+		local db = assert(require("sql").open("sqlite", ":memory:"))
+		assert(db.exec("CREATE TABLE t (id INTEGER, name TEXT, note TEXT)"))
+		assert(db.exec("INSERT INTO t VALUES (1, NULL, '')"))
+		assert(db.exec("INSERT INTO t VALUES (?, ?, ?)", 2, nil, "x"))
+
+		local rows = assert(db.query("SELECT * FROM t ORDER BY id"))
+		assert(#rows == 2, "expected 2 rows, got " .. #rows)
+		for _, row in ipairs(rows) do
+			assert(row.name == nil, "NULL must read as nil")
+			for col in pairs(row) do
+				assert(col ~= "name", "NULL column must be absent from the row")
+			end
+		end
+		assert(rows[1].note == "", "empty string must stay empty, not nil")
+		assert(rows[2].note == "x")
+
+		local count = db.table("t").whereEq("name", nil).count()
+		assert(count == 2, "whereEq(nil) must match IS NULL, got " .. tostring(count))
+	`)
+}
+
+func TestWhereAccumulates(t *testing.T) {
+	runLua(t, `
+		local db = assert(require("sql").open("sqlite", ":memory:"))
+		assert(db.exec("CREATE TABLE users (id INTEGER, age INTEGER, role TEXT, owner INTEGER)"))
+		assert(db.exec("INSERT INTO users VALUES (1, 30, 'admin', 0), (2, 30, 'guest', 0), (3, 10, 'admin', 0), (4, 10, 'guest', 1)"))
+
+		-- repeated where calls are ANDed, not replaced
+		local rows = assert(db.table("users").where("age > ?", 18).where("role = ?", "admin").fetchAll())
+		assert(#rows == 1 and rows[1].id == 1, "where: " .. #rows)
+
+		local rows = assert(db.table("users")
+			.where("age > ?", 18)
+			.whereIn("role", { "admin", "editor" })
+			.orWhere("owner = ?", 1)
+			.order("id")
+			.fetchAll())
+		assert(#rows == 2 and rows[1].id == 1 and rows[2].id == 4, "orWhere: " .. #rows)
+
+		-- conditions do not leak into the next query
+		assert(db.table("users").count() == 4)
+	`)
+}
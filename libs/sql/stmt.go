@@ -0,0 +1,212 @@
+package sql
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type (
+	// stmtCache keeps the most recently used prepared statements of a
+	// connection pool, keyed by query text.
+	stmtCache struct {
+		size  int
+		order *list.List // front is the most recently used
+		items map[string]*list.Element
+		mu    sync.Mutex
+	}
+	cachedStmt struct {
+		query   string
+		stmt    *sql.Stmt
+		refs    int
+		evicted bool
+	}
+)
+
+func newStmtCache(size int) *stmtCache {
+	return &stmtCache{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// lookup returns the cached statement for query or nil on a miss.
+// The statement stays open until released, even if it is evicted meanwhile.
+func (c *stmtCache) lookup(query string) *cachedStmt {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[query]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cachedStmt)
+	entry.refs++
+	c.order.MoveToFront(elem)
+	return entry
+}
+
+// acquire is lookup that prepares and caches the statement on a miss.
+func (c *stmtCache) acquire(ctx context.Context, db *sql.DB, query string) (*cachedStmt, error) {
+	if entry := c.lookup(query); entry != nil {
+		return entry, nil
+	}
+
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// another caller may have prepared the same query in the meantime
+	if elem, ok := c.items[query]; ok {
+		stmt.Close()
+		entry := elem.Value.(*cachedStmt)
+		entry.refs++
+		c.order.MoveToFront(elem)
+		return entry, nil
+	}
+	entry := &cachedStmt{query: query, stmt: stmt, refs: 1}
+	c.items[query] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.evict(c.order.Back())
+	}
+	return entry, nil
+}
+
+func (c *stmtCache) release(entry *cachedStmt) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.refs--
+	if entry.evicted && entry.refs == 0 {
+		entry.stmt.Close()
+	}
+}
+
+// clear closes every idle statement, statements in use close on release.
+func (c *stmtCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.order.Len() > 0 {
+		c.evict(c.order.Back())
+	}
+}
+
+func (c *stmtCache) evict(elem *list.Element) {
+	entry := c.order.Remove(elem).(*cachedStmt)
+	delete(c.items, entry.query)
+	entry.evicted = true
+	if entry.refs == 0 {
+		entry.stmt.Close()
+	}
+}
+
+// cachedStmt returns the statement for query from the cache, or nil when
+// the cache is disabled. Transactions only reuse statements that are already
+// cached: preparing on the pool could wait for the connection the
+// transaction itself holds.
+func (s *Sql) cachedStmt(ctx context.Context, query string) (*cachedStmt, error) {
+	cache := s.sql.stmts
+	switch {
+	case cache == nil:
+		return nil, nil
+	case s.tx != nil:
+		return cache.lookup(query), nil
+	}
+	return cache.acquire(ctx, s.sql.instance, query)
+}
+
+// context bounds a statement by the queryTimeout of the connection.
+func (s *Sql) context() (context.Context, context.CancelFunc) {
+	if timeout := s.sql.config.queryTimeout; timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// driverArgs turns Lua nil arguments into SQL NULL, the drivers reject the
+// lua.LNil value itself.
+func driverArgs(args []interface{}) []interface{} {
+	converted := make([]interface{}, len(args))
+	for i, arg := range args {
+		if arg != lua.LNil {
+			converted[i] = arg
+		}
+	}
+	return converted
+}
+
+// execStmt runs a statement, through the statement cache when it is enabled.
+func (s *Sql) execStmt(query string, args []interface{}) (sql.Result, error) {
+	query, args = s.sql.rebind(query), driverArgs(args)
+	ctx, cancel := s.context()
+	defer cancel()
+
+	entry, err := s.cachedStmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		if s.tx != nil {
+			return s.tx.ExecContext(ctx, query, args...)
+		}
+		return s.sql.instance.ExecContext(ctx, query, args...)
+	}
+	defer s.sql.stmts.release(entry)
+
+	stmt := entry.stmt
+	if s.tx != nil {
+		stmt = s.tx.StmtContext(ctx, stmt)
+		defer stmt.Close()
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+// queryStmt is execStmt for row returning statements. The release func must
+// be called once the rows are closed, it also ends the query timeout.
+func (s *Sql) queryStmt(query string, args []interface{}) (*sql.Rows, func(), error) {
+	query, args = s.sql.rebind(query), driverArgs(args)
+	ctx, cancel := s.context()
+
+	entry, err := s.cachedStmt(ctx, query)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if entry == nil {
+		var rows *sql.Rows
+		if s.tx != nil {
+			rows, err = s.tx.QueryContext(ctx, query, args...)
+		} else {
+			rows, err = s.sql.instance.QueryContext(ctx, query, args...)
+		}
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		return rows, cancel, nil
+	}
+
+	stmt := entry.stmt
+	if s.tx != nil {
+		stmt = s.tx.StmtContext(ctx, stmt)
+	}
+	release := func() {
+		if stmt != entry.stmt {
+			stmt.Close()
+		}
+		s.sql.stmts.release(entry)
+		cancel()
+	}
+
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return rows, release, nil
+}
@@ -0,0 +1,35 @@
+package libs
+
+import (
+	"lug/util"
+	"net/http"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type Status struct{}
+
+func StatusLoader(L *lua.LState) int {
+	instance := &Status{}
+	api := util.SetMethods(L, util.Methods{
+		"text":          instance.Text,
+		"isInformation": instance.class(1),
+		"isSuccess":     instance.class(2),
+		"isRedirect":    instance.class(3),
+		"isClientError": instance.class(4),
+		"isServerError": instance.class(5),
+	})
+	return util.Push(L, api)
+}
+
+// Text lua status.text(code) returns the standard reason phrase, or an empty string
+func (s *Status) Text(L *lua.LState) int {
+	return util.Push(L, lua.LString(http.StatusText(L.CheckInt(1))))
+}
+
+// class lua status.isSuccess(code) etc. report the class of a status code
+func (s *Status) class(class int) lua.LGFunction {
+	return func(L *lua.LState) int {
+		return util.Push(L, lua.LBool(util.StatusClass(L.CheckInt(1)) == class))
+	}
+}
@@ -0,0 +1,167 @@
+package libs
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"lug/util"
+
+	"github.com/fsnotify/fsnotify"
+	lua "github.com/yuin/gopher-lua"
+)
+
+type fsWatcher struct {
+	watcher   *fsnotify.Watcher
+	path      string
+	recursive bool
+	onError   *lua.LFunction
+	vm        *lua.LState // runs the callbacks
+	done      chan struct{}
+	stopOnce  sync.Once
+}
+
+// watch calls fn(event, path) for create, write, remove and rename events
+// under path until stop is called on the returned handle. The callback runs
+// on its own Lua state, one event at a time. Watch and callback errors go
+// to the onError option, or to the log without one.
+func (f *Fs) watch(L *lua.LState) int {
+	path, fn := L.CheckString(1), L.CheckFunction(2)
+	lopt := L.OptTable(3, L.NewTable())
+	w := &fsWatcher{path: path, done: make(chan struct{})}
+
+	lopt.ForEach(func(k, v lua.LValue) {
+		key := k.String()
+		switch key {
+		case "recursive":
+			if val, ok := util.CheckBool(L, key, v, 3); ok {
+				w.recursive = val
+			}
+		case "onError":
+			if val, ok := util.CheckFunction(L, key, v, 3); ok {
+				w.onError = val
+			}
+		default:
+			L.ArgError(3, "unknown watch field: "+key)
+		}
+	})
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	w.watcher = watcher
+	if err := w.add(path); err != nil {
+		watcher.Close()
+		return util.NilError(L, err)
+	}
+
+	w.vm = util.VmPool.Clone(L)
+	go w.loop(w.vm, fn)
+
+	api := util.SetMethods(L, util.Methods{
+		"stop": w.stop,
+		"wait": w.wait,
+	})
+	return util.Push(L, api)
+}
+
+// add watches path, and every directory below it in recursive mode.
+func (w *fsWatcher) add(path string) error {
+	if !w.recursive {
+		return w.watcher.Add(path)
+	}
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || p == path {
+			return w.watcher.Add(p)
+		}
+		return nil
+	})
+}
+
+func (w *fsWatcher) loop(vm *lua.LState, fn *lua.LFunction) {
+	defer util.VmPool.Put(vm)
+	defer close(w.done)
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			op := watchOp(event.Op)
+			if op == "" {
+				continue
+			}
+			if w.recursive && event.Has(fsnotify.Create) {
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					if err := w.add(event.Name); err != nil {
+						w.report(vm, err)
+					}
+				}
+			}
+			if err := util.CallLua(vm, fn, lua.LString(op), lua.LString(event.Name)); err != nil {
+				w.report(vm, err)
+			}
+			vm.SetTop(0)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.report(vm, err)
+		}
+	}
+}
+
+// report passes err to onError, logging it when there is no handler or the
+// handler fails itself.
+func (w *fsWatcher) report(vm *lua.LState, err error) {
+	if w.onError != nil {
+		err = util.CallLua(vm, w.onError, lua.LString(err.Error()))
+		vm.SetTop(0)
+		if err == nil {
+			return
+		}
+	}
+	log.Printf("watch %s: %v", w.path, err)
+}
+
+func watchOp(op fsnotify.Op) string {
+	switch {
+	case op.Has(fsnotify.Create):
+		return "create"
+	case op.Has(fsnotify.Write):
+		return "write"
+	case op.Has(fsnotify.Remove):
+		return "remove"
+	case op.Has(fsnotify.Rename):
+		return "rename"
+	}
+	return ""
+}
+
+func (w *fsWatcher) stop(L *lua.LState) int {
+	var err error
+	w.stopOnce.Do(func() {
+		err = w.watcher.Close()
+	})
+	if err != nil {
+		return util.NilError(L, err)
+	}
+	// from inside a callback the loop only ends once the callback returned
+	if L != w.vm {
+		<-w.done
+	}
+	return util.Push(L, lua.LTrue)
+}
+
+// wait blocks until the watcher is stopped.
+func (w *fsWatcher) wait(L *lua.LState) int {
+	<-w.done
+	return 0
+}
@@ -0,0 +1,40 @@
+package libs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// TestWatchStopInCallback stops a watcher from its own callback, which must
+// neither deadlock nor keep the watcher running.
+func TestWatchStopInCallback(t *testing.T) {
+	dir := t.TempDir()
+	L := lua.NewState()
+	defer L.Close()
+	L.PreloadModule("fs", FsLoader)
+	L.SetGlobal("dir", lua.LString(dir))
+	if err := L.DoString(`
+		local fs = require("fs")
+		w = fs.watch(dir, function() assert(w.stop()) end)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- L.DoString(`w.wait()`) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not stop from its callback")
+	}
+}
@@ -41,9 +41,11 @@ func CheckInt64(L *lua.LState, key string, v lua.LValue, n ...int) (int64, bool)
 	return 0, false
 }
 
+// CheckDuration reads a number of seconds. Fractions are kept, so 0.25 is a
+// quarter second rather than zero.
 func CheckDuration(L *lua.LState, key string, v lua.LValue, n ...int) (time.Duration, bool) {
 	if val, ok := v.(lua.LNumber); ok {
-		return time.Duration(int(val)) * time.Second, true
+		return time.Duration(float64(val) * float64(time.Second)), true
 	}
 	i := getIndex(n)
 	L.ArgError(i, fmt.Sprintf("%s must be a number (in seconds)", key))
@@ -104,6 +106,25 @@ func CheckTable(L *lua.LState, key string, v lua.LValue, n ...int) ([]string, bo
 	return nil, false
 }
 
+func CheckIntTable(L *lua.LState, key string, v lua.LValue, n ...int) ([]int, bool) {
+	i := getIndex(n)
+	if val, ok := v.(*lua.LTable); ok {
+		maxn := val.Len()
+		result := make([]int, 0, maxn)
+		for idx := 1; idx <= maxn; idx++ {
+			if num, ok := val.RawGetInt(idx).(lua.LNumber); ok {
+				result = append(result, int(num))
+			} else {
+				L.ArgError(i, fmt.Sprintf("%s table contains non-number value at index %d", key, idx))
+				return nil, false
+			}
+		}
+		return result, true
+	}
+	L.ArgError(i, fmt.Sprintf("%s must be a table (array)", key))
+	return nil, false
+}
+
 func CheckTableMap(L *lua.LState, key string, v lua.LValue, n ...int) (map[string]string, bool) {
 	i := getIndex(n)
 	if val, ok := v.(*lua.LTable); ok {
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestCheckDuration(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	tests := []struct {
+		name  string
+		value lua.LValue
+		want  time.Duration
+		err   string
+	}{
+		{"seconds", lua.LNumber(30), 30 * time.Second, ""},
+		{"fraction", lua.LNumber(0.25), 250 * time.Millisecond, ""},
+		{"below a second", lua.LNumber(0.001), time.Millisecond, ""},
+		{"zero", lua.LNumber(0), 0, ""},
+		{"string", lua.LString("1s"), 0, "timeout must be a number (in seconds)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got time.Duration
+			check := L.NewFunction(func(L *lua.LState) int {
+				got, _ = CheckDuration(L, "timeout", tt.value)
+				return 0
+			})
+			err := L.CallByParam(lua.P{Fn: check, Protect: true})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("CheckDuration(%v) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package util
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+)
+
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// HashFunc returns the constructor of a digest algorithm by name: md5, sha1,
+// sha256 or sha512.
+func HashFunc(algo string) (func() hash.Hash, bool) {
+	newHash, ok := hashes[algo]
+	return newHash, ok
+}
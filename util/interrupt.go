@@ -0,0 +1,40 @@
+package util
+
+import (
+	"context"
+	"sync/atomic"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var interruptClaims atomic.Int32
+
+// ClaimInterrupts tells the runtime that the caller handles SIGINT itself,
+// such as a server shutting down gracefully, so the running script is not
+// interrupted as well. The returned func ends the claim.
+func ClaimInterrupts() func() {
+	interruptClaims.Add(1)
+	return func() {
+		interruptClaims.Add(-1)
+	}
+}
+
+// InterruptsClaimed reports whether a ClaimInterrupts call is active.
+func InterruptsClaimed() bool {
+	return interruptClaims.Load() > 0
+}
+
+// Context returns the context Go code started from L should run under. The
+// context of the main state re-arms after every interrupt it raises, so when
+// it offers a standard context through a Context method, that one is used:
+// it stays cancelled once an interrupt arrived.
+func Context(L *lua.LState) context.Context {
+	ctx := L.Context()
+	if c, ok := ctx.(interface{ Context() context.Context }); ok {
+		return c.Context()
+	}
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
@@ -0,0 +1,73 @@
+package util
+
+import (
+	"fmt"
+	"math"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ToJSONValue converts a Lua value into plain Go values that encoding/json
+// can marshal. Sequences become arrays and other tables objects with string
+// keys. Functions, userdata, threads, channels, cycles and non-finite numbers
+// are rejected with an error naming the offending key path.
+func ToJSONValue(lv lua.LValue) (interface{}, error) {
+	return toJSONValue(lv, "value", make(map[*lua.LTable]bool))
+}
+
+func toJSONValue(lv lua.LValue, path string, visiting map[*lua.LTable]bool) (interface{}, error) {
+	switch v := lv.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LString:
+		return string(v), nil
+	case lua.LNumber:
+		num := float64(v)
+		if math.IsNaN(num) || math.IsInf(num, 0) {
+			return nil, fmt.Errorf("json: cannot encode %v at %s", num, path)
+		}
+		return num, nil
+	case *lua.LTable:
+		if visiting[v] {
+			return nil, fmt.Errorf("json: cyclic table at %s", path)
+		}
+		visiting[v] = true
+		defer delete(visiting, v)
+
+		if n := v.MaxN(); n > 0 && isSequence(v, n) {
+			arr := make([]interface{}, n)
+			for i := 1; i <= n; i++ {
+				val, err := toJSONValue(v.RawGetInt(i), fmt.Sprintf("%s[%d]", path, i), visiting)
+				if err != nil {
+					return nil, err
+				}
+				arr[i-1] = val
+			}
+			return arr, nil
+		}
+
+		obj := make(map[string]interface{})
+		var err error
+		v.ForEach(func(key, value lua.LValue) {
+			if err != nil {
+				return
+			}
+			switch key.(type) {
+			case lua.LString, lua.LNumber:
+			default:
+				err = fmt.Errorf("json: cannot use %s as object key at %s", key.Type().String(), path)
+				return
+			}
+			name := key.String()
+			obj[name], err = toJSONValue(value, path+"."+name, visiting)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}
+
+	return nil, fmt.Errorf("json: cannot encode %s at %s", lv.Type().String(), path)
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestToJSONValue(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	eval := func(t *testing.T, source string) lua.LValue {
+		t.Helper()
+		if err := L.DoString("value = " + source); err != nil {
+			t.Fatal(err)
+		}
+		return L.GetGlobal("value")
+	}
+	L.SetGlobal("userdata", L.NewUserData())
+
+	tests := []struct {
+		name   string
+		source string
+		want   interface{}
+		err    string
+	}{
+		{"object", `{ a = 1, b = { true, "x" } }`, map[string]interface{}{"a": 1.0, "b": []interface{}{true, "x"}}, ""},
+		{"shared table", `(function() local t = { 1 } return { t, t } end)()`, []interface{}{[]interface{}{1.0}, []interface{}{1.0}}, ""},
+		{"function", `print`, nil, "cannot encode function at value"},
+		{"nested function", `{ list = { 1, function() end } }`, nil, "cannot encode function at value.list[2]"},
+		{"userdata", `{ u = userdata }`, nil, "cannot encode userdata at value.u"},
+		{"cycle", `(function() local t = {} t.self = t return t end)()`, nil, "cyclic table at value.self"},
+		{"nested cycle", `(function() local t = { a = {} } t.a.b = { t } return t end)()`, nil, "cyclic table at value.a.b[1]"},
+		{"nan", `{ n = 0/0 }`, nil, "cannot encode NaN at value.n"},
+		{"table key", `{ [{}] = 1 }`, nil, "cannot use table as object key at value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ToJSONValue(eval(t, tt.source))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
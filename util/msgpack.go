@@ -0,0 +1,297 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf8"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const msgpackMaxDepth = 128
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+// EncodeMsgpack serializes a Lua value into MessagePack. Nested tables and
+// scalars are supported; functions, userdata, threads and channels are not.
+func EncodeMsgpack(lv lua.LValue) ([]byte, error) {
+	return appendMsgpack(nil, lv, "value", 0)
+}
+
+// DecodeMsgpack parses MessagePack data produced by EncodeMsgpack (or any
+// other encoder that sticks to the core types) back into a Lua value.
+func DecodeMsgpack(data []byte) (lua.LValue, error) {
+	d := &msgpackDecoder{data: data}
+	lv, err := d.decode(0)
+	if err != nil {
+		return lua.LNil, err
+	}
+	if d.off != len(d.data) {
+		return lua.LNil, errors.New("msgpack: trailing data")
+	}
+	return lv, nil
+}
+
+func appendMsgpack(buf []byte, lv lua.LValue, path string, depth int) ([]byte, error) {
+	if depth > msgpackMaxDepth {
+		return nil, fmt.Errorf("msgpack: nesting too deep at %s", path)
+	}
+
+	switch v := lv.(type) {
+	case *lua.LNilType:
+		return append(buf, 0xc0), nil
+
+	case lua.LBool:
+		if v {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+
+	case lua.LNumber:
+		num := float64(v)
+		if num == math.Trunc(num) && num >= math.MinInt64 && num < math.MaxInt64 {
+			return appendMsgpackInt(buf, int64(num)), nil
+		}
+		buf = append(buf, 0xcb)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(num)), nil
+
+	case lua.LString:
+		str := string(v)
+		if utf8.ValidString(str) {
+			buf = appendMsgpackHeader(buf, len(str), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		} else {
+			buf = appendMsgpackHeader(buf, len(str), 0, -1, 0xc4, 0xc5, 0xc6)
+		}
+		return append(buf, str...), nil
+
+	case *lua.LTable:
+		var err error
+		if n := v.MaxN(); n > 0 && isSequence(v, n) {
+			buf = appendMsgpackHeader(buf, n, 0x90, 15, 0, 0xdc, 0xdd)
+			for i := 1; i <= n; i++ {
+				elemPath := fmt.Sprintf("%s[%d]", path, i)
+				if buf, err = appendMsgpack(buf, v.RawGetInt(i), elemPath, depth+1); err != nil {
+					return nil, err
+				}
+			}
+			return buf, nil
+		}
+
+		size := 0
+		v.ForEach(func(_, _ lua.LValue) { size++ })
+		buf = appendMsgpackHeader(buf, size, 0x80, 15, 0, 0xde, 0xdf)
+		v.ForEach(func(key, value lua.LValue) {
+			if err != nil {
+				return
+			}
+			elemPath := fmt.Sprintf("%s.%s", path, key.String())
+			if buf, err = appendMsgpack(buf, key, elemPath, depth+1); err != nil {
+				return
+			}
+			buf, err = appendMsgpack(buf, value, elemPath, depth+1)
+		})
+		return buf, err
+	}
+
+	return nil, fmt.Errorf("msgpack: cannot encode %s at %s", lv.Type().String(), path)
+}
+
+func appendMsgpackInt(buf []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(buf, byte(n))
+	case n < 0 && n >= -32:
+		return append(buf, byte(n))
+	case n >= 0 && n <= math.MaxUint8:
+		return append(buf, 0xcc, byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(n))
+	case n >= 0 && n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(n))
+	case n >= 0:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcf), uint64(n))
+	case n >= math.MinInt8:
+		return append(buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(n))
+	}
+}
+
+// appendMsgpackHeader writes the smallest length header available for a
+// type family; a zero code means that width does not exist for the family.
+func appendMsgpackHeader(buf []byte, n int, fix byte, fixMax int, code8, code16, code32 byte) []byte {
+	switch {
+	case n <= fixMax:
+		return append(buf, fix|byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		return append(buf, code8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, code16), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(buf, code32), uint32(n))
+	}
+}
+
+func isSequence(t *lua.LTable, n int) bool {
+	count := 0
+	t.ForEach(func(_, _ lua.LValue) { count++ })
+	return count == n
+}
+
+type msgpackDecoder struct {
+	data []byte
+	off  int
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || d.off+n > len(d.data) {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+func (d *msgpackDecoder) decode(depth int) (lua.LValue, error) {
+	if depth > msgpackMaxDepth {
+		return lua.LNil, errors.New("msgpack: nesting too deep")
+	}
+
+	b, err := d.next(1)
+	if err != nil {
+		return lua.LNil, err
+	}
+	code := b[0]
+
+	switch {
+	case code <= 0x7f:
+		return lua.LNumber(code), nil
+	case code >= 0xe0:
+		return lua.LNumber(int8(code)), nil
+	case code >= 0x80 && code <= 0x8f:
+		return d.decodeMap(int(code&0x0f), depth)
+	case code >= 0x90 && code <= 0x9f:
+		return d.decodeArray(int(code&0x0f), depth)
+	case code >= 0xa0 && code <= 0xbf:
+		return d.decodeString(int(code & 0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return lua.LNil, nil
+	case 0xc2:
+		return lua.LFalse, nil
+	case 0xc3:
+		return lua.LTrue, nil
+	case 0xc4, 0xd9:
+		return d.decodeSized(1, d.decodeString)
+	case 0xc5, 0xda:
+		return d.decodeSized(2, d.decodeString)
+	case 0xc6, 0xdb:
+		return d.decodeSized(4, d.decodeString)
+	case 0xca:
+		n, err := d.uint(4)
+		return lua.LNumber(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return lua.LNumber(math.Float64frombits(n)), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (code - 0xcc))
+		return lua.LNumber(n), err
+	case 0xd0:
+		n, err := d.uint(1)
+		return lua.LNumber(int8(n)), err
+	case 0xd1:
+		n, err := d.uint(2)
+		return lua.LNumber(int16(n)), err
+	case 0xd2:
+		n, err := d.uint(4)
+		return lua.LNumber(int32(n)), err
+	case 0xd3:
+		n, err := d.uint(8)
+		return lua.LNumber(int64(n)), err
+	case 0xdc:
+		return d.decodeSized(2, func(n int) (lua.LValue, error) { return d.decodeArray(n, depth) })
+	case 0xdd:
+		return d.decodeSized(4, func(n int) (lua.LValue, error) { return d.decodeArray(n, depth) })
+	case 0xde:
+		return d.decodeSized(2, func(n int) (lua.LValue, error) { return d.decodeMap(n, depth) })
+	case 0xdf:
+		return d.decodeSized(4, func(n int) (lua.LValue, error) { return d.decodeMap(n, depth) })
+	}
+
+	return lua.LNil, fmt.Errorf("msgpack: unsupported type code 0x%02x", code)
+}
+
+func (d *msgpackDecoder) decodeSized(width int, fn func(int) (lua.LValue, error)) (lua.LValue, error) {
+	n, err := d.uint(width)
+	if err != nil {
+		return lua.LNil, err
+	}
+	if n > uint64(len(d.data)) {
+		return lua.LNil, errMsgpackShort
+	}
+	return fn(int(n))
+}
+
+func (d *msgpackDecoder) decodeString(n int) (lua.LValue, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return lua.LNil, err
+	}
+	return lua.LString(b), nil
+}
+
+func (d *msgpackDecoder) decodeArray(n int, depth int) (lua.LValue, error) {
+	arr := &lua.LTable{}
+	for i := 1; i <= n; i++ {
+		lv, err := d.decode(depth + 1)
+		if err != nil {
+			return lua.LNil, err
+		}
+		arr.RawSetInt(i, lv)
+	}
+	return arr, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int, depth int) (lua.LValue, error) {
+	obj := &lua.LTable{}
+	for i := 0; i < n; i++ {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return lua.LNil, err
+		}
+		if key == lua.LNil {
+			return lua.LNil, errors.New("msgpack: nil map key")
+		}
+		val, err := d.decode(depth + 1)
+		if err != nil {
+			return lua.LNil, err
+		}
+		obj.RawSet(key, val)
+	}
+	return obj, nil
+}
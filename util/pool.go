@@ -62,6 +62,16 @@ var excludes = map[string]bool{
 	"coroutine":           true,
 }
 
+// resetKeys are registry keys that hold state for a single use of a VM, such
+// as the temporary files of one request. Put drops them.
+var resetKeys []string
+
+// ResetOnPut makes Put clear the registry key name of every VM returned to
+// the pool, so its next user starts without it. Call it from an init func.
+func ResetOnPut(name string) {
+	resetKeys = append(resetKeys, name)
+}
+
 func (p *Pool) New() *lua.LState {
 	return lua.NewState()
 }
@@ -96,6 +106,9 @@ func (p *Pool) Put(L *lua.LState) {
 		L.Close()
 	} else {
 		L.SetTop(0)
+		for _, key := range resetKeys {
+			L.G.Registry.RawSetString(key, lua.LNil)
+		}
 		p.vms = append(p.vms, L)
 	}
 }
@@ -1,10 +1,14 @@
 package util
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"html/template"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 type templateEntry struct {
@@ -13,32 +17,210 @@ type templateEntry struct {
 	err  error
 }
 
-var templateCache sync.Map
+// TemplateScope is a set of helpers added to the registered ones, together
+// with the cache of the templates parsed with them. Each server has its own,
+// so its helpers never reach the templates of another.
+type TemplateScope struct {
+	funcs template.FuncMap
+	cache sync.Map
+}
+
+// DefaultTemplates has no helpers of its own.
+var DefaultTemplates = &TemplateScope{}
+
+var (
+	templateFuncs   = template.FuncMap{}
+	templateFuncsMu sync.RWMutex
+)
+
+func init() {
+	RegisterTemplateFuncs(template.FuncMap{
+		"upper":    strings.ToUpper,
+		"lower":    strings.ToLower,
+		"json":     templateJSON,
+		"safeURL":  func(s string) template.URL { return template.URL(s) },
+		"safeHTML": func(s string) template.HTML { return template.HTML(s) },
+		"date":     templateDate,
+	})
+}
+
+// NewTemplateScope creates a scope whose templates also get funcs.
+func NewTemplateScope(funcs template.FuncMap) *TemplateScope {
+	return &TemplateScope{funcs: funcs}
+}
+
+// RegisterTemplateFuncs adds helpers available to every template parsed
+// afterwards. Templates already in the cache keep the functions they had.
+func RegisterTemplateFuncs(funcs template.FuncMap) {
+	templateFuncsMu.Lock()
+	defer templateFuncsMu.Unlock()
+	for name, fn := range funcs {
+		templateFuncs[name] = fn
+	}
+}
+
+// TemplateFuncs returns a copy of the registered template helpers.
+func TemplateFuncs() template.FuncMap {
+	templateFuncsMu.RLock()
+	defer templateFuncsMu.RUnlock()
+	funcs := make(template.FuncMap, len(templateFuncs))
+	for name, fn := range templateFuncs {
+		funcs[name] = fn
+	}
+	return funcs
+}
+
+// NewTemplate creates an empty template with the registered helpers attached.
+func NewTemplate(name string) *template.Template {
+	return DefaultTemplates.New(name)
+}
 
 func ParseTemplateFiles(paths ...string) (*template.Template, error) {
+	return DefaultTemplates.ParseFiles(paths...)
+}
+
+// ParseTemplateGlob parses every file matching pattern into one set, so
+// layouts and partials can reference each other by file name.
+func ParseTemplateGlob(pattern string) (*template.Template, error) {
+	return DefaultTemplates.ParseGlob(pattern)
+}
+
+func ParseTemplateString(str, cacheKey string) (*template.Template, error) {
+	return DefaultTemplates.ParseString(str, cacheKey)
+}
+
+// ParseGlob is template.ParseGlob with the registered helpers, uncached.
+func ParseGlob(pattern string) (*template.Template, error) {
+	return DefaultTemplates.ParseGlobUncached(pattern)
+}
+
+// New creates an empty template with the registered helpers and those of
+// the scope attached.
+func (sc *TemplateScope) New(name string) *template.Template {
+	return template.New(name).Funcs(TemplateFuncs()).Funcs(sc.funcs)
+}
+
+// ParseFiles parses the files into one template, cached by their paths.
+func (sc *TemplateScope) ParseFiles(paths ...string) (*template.Template, error) {
 	if len(paths) == 0 {
 		return nil, errors.New("at least one template file path is required")
 	}
-	key := strings.Join(paths, "\x00")
-	entry := getTemplateEntry(key)
+	return sc.cached(strings.Join(paths, "\x00"), func() (*template.Template, error) {
+		return sc.New(filepath.Base(paths[0])).ParseFiles(paths...)
+	})
+}
+
+// ParseGlob parses every file matching pattern into one set, cached by the
+// pattern.
+func (sc *TemplateScope) ParseGlob(pattern string) (*template.Template, error) {
+	return sc.cached("glob\x00"+pattern, func() (*template.Template, error) {
+		return sc.ParseGlobUncached(pattern)
+	})
+}
+
+// ParseString parses str, cached by cacheKey unless it is empty.
+func (sc *TemplateScope) ParseString(str, cacheKey string) (*template.Template, error) {
+	if cacheKey == "" {
+		return sc.New("").Parse(str)
+	}
+	return sc.cached(cacheKey, func() (*template.Template, error) {
+		return sc.New(cacheKey).Parse(str)
+	})
+}
+
+// ParseGlobUncached is ParseGlob without the cache.
+func (sc *TemplateScope) ParseGlobUncached(pattern string) (*template.Template, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("template: pattern matches no files: %#q", pattern)
+	}
+	return sc.New(filepath.Base(files[0])).ParseFiles(files...)
+}
+
+// Instance returns the template to execute for tpl, a template of the
+// scope, with funcs in place of the scope helpers of the same name. A scope
+// with helpers hands out a clone, since html/template cannot change the
+// functions of a template once it ran.
+func (sc *TemplateScope) Instance(tpl *template.Template, funcs template.FuncMap) (*template.Template, error) {
+	if len(sc.funcs) == 0 {
+		return tpl, nil
+	}
+	clone, err := tpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return clone.Funcs(funcs), nil
+}
+
+// cached parses once per key. A failed parse is not kept, the next call
+// tries again.
+func (sc *TemplateScope) cached(key string, parse func() (*template.Template, error)) (*template.Template, error) {
+	value, _ := sc.cache.LoadOrStore(key, &templateEntry{})
+	entry := value.(*templateEntry)
 	entry.once.Do(func() {
-		entry.tmpl, entry.err = template.ParseFiles(paths...)
+		entry.tmpl, entry.err = parse()
 	})
+	if entry.err != nil {
+		sc.cache.CompareAndDelete(key, entry)
+	}
 	return entry.tmpl, entry.err
 }
 
-func ParseTemplateString(str, cacheKey string) (*template.Template, error) {
-	if cacheKey != "" {
-		entry := getTemplateEntry(cacheKey)
-		entry.once.Do(func() {
-			entry.tmpl, entry.err = template.New(cacheKey).Parse(str)
-		})
-		return entry.tmpl, entry.err
+func templateJSON(v interface{}) (template.JS, error) {
+	data, err := json.Marshal(jsonCompatible(v))
+	if err != nil {
+		return "", err
+	}
+	return template.JS(data), nil
+}
+
+// jsonCompatible turns the map[interface{}]interface{} produced for Lua
+// tables into string keyed maps that encoding/json accepts.
+func jsonCompatible(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		obj := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			obj[fmt.Sprint(k)] = jsonCompatible(item)
+		}
+		return obj
+	case map[string]interface{}:
+		obj := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			obj[k] = jsonCompatible(item)
+		}
+		return obj
+	case []interface{}:
+		arr := make([]interface{}, len(val))
+		for i, item := range val {
+			arr[i] = jsonCompatible(item)
+		}
+		return arr
 	}
-	return template.New("").Parse(str)
+	return v
 }
 
-func getTemplateEntry(key string) *templateEntry {
-	entryInterface, _ := templateCache.LoadOrStore(key, &templateEntry{})
-	return entryInterface.(*templateEntry)
+// templateDate formats a unix timestamp or time.Time, layout defaults to RFC 3339.
+func templateDate(v interface{}, layout ...string) (string, error) {
+	var t time.Time
+	switch val := v.(type) {
+	case time.Time:
+		t = val
+	case int:
+		t = time.Unix(int64(val), 0)
+	case int64:
+		t = time.Unix(val, 0)
+	case float64:
+		t = time.Unix(0, int64(val*float64(time.Second)))
+	default:
+		return "", fmt.Errorf("date: unsupported value %v", v)
+	}
+	format := time.RFC3339
+	if len(layout) > 0 && layout[0] != "" {
+		format = layout[0]
+	}
+	return t.Format(format), nil
 }
@@ -19,6 +19,14 @@ func CheckStatusCode(code int) bool {
 	return code >= 100 && code < 600
 }
 
+// StatusClass returns the hundreds digit of a valid status code (2 for 2xx), or 0.
+func StatusClass(code int) int {
+	if !CheckStatusCode(code) {
+		return 0
+	}
+	return code / 100
+}
+
 func FormatBytes(size int64) string {
 	if size == 0 {
 		return "0B"